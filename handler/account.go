@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+)
+
+// ChangeEmail is a struct for changing the email of a user
+type ChangeEmail struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// VerifyEmail is a struct for verifying an email
+type VerifyEmail struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ResendVerification is a struct for resending an email verification link
+type ResendVerification struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPassword is a struct for requesting a password reset
+type ForgotPassword struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPassword is a struct for resetting a password
+type ResetPassword struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// IAccountHandler is an interface for account handlers
+type IAccountHandler interface {
+	// Change the email of the current user
+	ChangeEmail(c *gin.Context)
+
+	// Resend the email verification link
+	RequestEmailVerification(c *gin.Context)
+
+	// Resend the email verification link to an email without logging in
+	ResendEmailVerification(c *gin.Context)
+
+	// Verify an email
+	VerifyEmail(c *gin.Context)
+
+	// Request a password reset
+	ForgotPassword(c *gin.Context)
+
+	// Reset a password
+	ResetPassword(c *gin.Context)
+}
+
+// AccountHandler is a handler for email verification and password reset
+type AccountHandler struct {
+	service         service.IAccountService
+	throttleService service.IThrottleService
+}
+
+// NewAccountHandler creates a new account handler
+func NewAccountHandler(service service.IAccountService, throttleService service.IThrottleService) *AccountHandler {
+	return &AccountHandler{
+		service:         service,
+		throttleService: throttleService,
+	}
+}
+
+// ChangeEmail godoc
+// @Summary Change email
+// @Description Change the email of the current user and send a verification link
+// @Security Bearer
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param email body ChangeEmail true "Change Email"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 409 {object} string "Email already exists"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/me/email [put]
+func (h *AccountHandler) ChangeEmail(c *gin.Context) {
+	userID, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var changeEmail ChangeEmail
+	if err := c.ShouldBindJSON(&changeEmail); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := h.service.ChangeEmail(c, userID.(string), changeEmail.Email); err != nil {
+		if errors.Is(err, service.ErrEmailTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// RequestEmailVerification godoc
+// @Summary Resend email verification
+// @Description Send a new verification link to the email of the current user
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "User has no email"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/me/email/verification [post]
+func (h *AccountHandler) RequestEmailVerification(c *gin.Context) {
+	userID, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.service.RequestEmailVerification(c, userID.(string)); err != nil {
+		if errors.Is(err, service.ErrNoEmail) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// ResendEmailVerification godoc
+// @Summary Resend email verification without logging in
+// @Description Send a new verification link to the email if it belongs to an unverified account.
+// @Description Accounts that cannot log in before verifying their email use it, it is throttled like login.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param email body ResendVerification true "Resend Verification"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 429 {object} string "Too many attempts"
+// @Router /api/users/email/verification [post]
+func (h *AccountHandler) ResendEmailVerification(c *gin.Context) {
+	var resend ResendVerification
+	if err := c.ShouldBindJSON(&resend); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	emailKey := service.EmailKey(resend.Email)
+	ipKey := service.IPKey(c.ClientIP())
+	if throttled(c, h.throttleService, emailKey, ipKey) {
+		return
+	}
+
+	// Every link sent counts as a failed attempt so the endpoint cannot be used to flood an inbox
+	fail(c, h.throttleService, emailKey, ipKey)
+
+	// Always answer the same way so the endpoint cannot be used to probe emails
+	if err := h.service.ResendEmailVerification(c, resend.Email); err != nil {
+		log.Println("email verification:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email belongs to an unverified account a verification link has been sent"})
+}
+
+// VerifyEmail godoc
+// @Summary Verify email
+// @Description Verify an email with the token from the verification link
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param token body VerifyEmail true "Verify Email"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid or expired token"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/verify-email [post]
+func (h *AccountHandler) VerifyEmail(c *gin.Context) {
+	var verifyEmail VerifyEmail
+	if err := c.ShouldBindJSON(&verifyEmail); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := h.service.VerifyEmail(c, verifyEmail.Token); err != nil {
+		if errors.Is(err, service.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset
+// @Description Send a password reset link to the email if it belongs to an account
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param email body ForgotPassword true "Forgot Password"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Router /api/users/password/forgot [post]
+func (h *AccountHandler) ForgotPassword(c *gin.Context) {
+	var forgotPassword ForgotPassword
+	if err := c.ShouldBindJSON(&forgotPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	// Always answer the same way so the endpoint cannot be used to probe emails
+	if err := h.service.RequestPasswordReset(c, forgotPassword.Email); err != nil {
+		log.Println("password reset:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email belongs to an account a reset link has been sent"})
+}
+
+// ResetPassword godoc
+// @Summary Reset a password
+// @Description Reset a password with the token from the reset link
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param password body ResetPassword true "Reset Password"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid or expired token or weak password"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/password/reset [post]
+func (h *AccountHandler) ResetPassword(c *gin.Context) {
+	var resetPassword ResetPassword
+	if err := c.ShouldBindJSON(&resetPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := h.service.ResetPassword(c, resetPassword.Token, resetPassword.Password); err != nil {
+		var policyErr *service.PolicyError
+		if errors.Is(err, service.ErrInvalidToken) || errors.As(err, &policyErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
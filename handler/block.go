@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+)
+
+// IBlockHandler is an interface for block handlers
+type IBlockHandler interface {
+	// Block a user
+	Block(c *gin.Context)
+
+	// Unblock a user
+	Unblock(c *gin.Context)
+
+	// Mute a user
+	Mute(c *gin.Context)
+
+	// Unmute a user
+	Unmute(c *gin.Context)
+
+	// List blocked users
+	ListBlocked(c *gin.Context)
+
+	// List muted users
+	ListMuted(c *gin.Context)
+}
+
+// BlockHandler is a handler for blocking and muting users
+type BlockHandler struct {
+	service service.IBlockService
+}
+
+// NewBlockHandler creates a new block handler
+func NewBlockHandler(service service.IBlockService) *BlockHandler {
+	return &BlockHandler{
+		service: service,
+	}
+}
+
+// Block a user godoc
+// @Summary Block a user
+// @Description Block a user, blocked users cannot message or find each other
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Param userId path string true "User ID"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid user"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/{userId}/block [post]
+func (h *BlockHandler) Block(c *gin.Context) {
+	h.update(c, h.service.Block, "User blocked")
+}
+
+// Unblock a user godoc
+// @Summary Unblock a user
+// @Description Unblock a user
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Param userId path string true "User ID"
+// @Success 200 {object} string "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/{userId}/block [delete]
+func (h *BlockHandler) Unblock(c *gin.Context) {
+	h.update(c, h.service.Unblock, "User unblocked")
+}
+
+// Mute a user godoc
+// @Summary Mute a user
+// @Description Mute a user, messages from muted users do not trigger notifications
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Param userId path string true "User ID"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid user"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/{userId}/mute [post]
+func (h *BlockHandler) Mute(c *gin.Context) {
+	h.update(c, h.service.Mute, "User muted")
+}
+
+// Unmute a user godoc
+// @Summary Unmute a user
+// @Description Unmute a user
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Param userId path string true "User ID"
+// @Success 200 {object} string "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/{userId}/mute [delete]
+func (h *BlockHandler) Unmute(c *gin.Context) {
+	h.update(c, h.service.Unmute, "User unmuted")
+}
+
+// List blocked users godoc
+// @Summary List blocked users
+// @Description List the users blocked by the current user
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Success 200 {object} []model.User "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/me/blocks [get]
+func (h *BlockHandler) ListBlocked(c *gin.Context) {
+	users, err := h.service.ListBlocked(c, c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// List muted users godoc
+// @Summary List muted users
+// @Description List the users muted by the current user
+// @Security Bearer
+// @Tags users
+// @Produce json
+// @Success 200 {object} []model.User "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/me/mutes [get]
+func (h *BlockHandler) ListMuted(c *gin.Context) {
+	users, err := h.service.ListMuted(c, c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+func (h *BlockHandler) update(c *gin.Context, update func(ctx context.Context, userID string, targetID string) error, message string) {
+	userID, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := update(c, userID.(string), c.Param("userId")); err != nil {
+		if errors.Is(err, service.ErrInvalidTarget) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/service"
+	"github.com/guutong/chat-backend/socket"
+)
+
+// CreateContactRequest is a struct for sending a contact request
+type CreateContactRequest struct {
+	UserID string `json:"userId" binding:"required"`
+}
+
+// ContactSettings is a struct for updating the contact settings
+type ContactSettings struct {
+	DMContactsOnly *bool `json:"dmContactsOnly" binding:"required"`
+}
+
+// IContactHandler is an interface for contact handlers
+type IContactHandler interface {
+	// Send a contact request
+	SendRequest(c *gin.Context)
+
+	// Accept a contact request
+	Accept(c *gin.Context)
+
+	// Decline a contact request
+	Decline(c *gin.Context)
+
+	// Cancel a contact request
+	Cancel(c *gin.Context)
+
+	// List contact requests
+	ListRequests(c *gin.Context)
+
+	// List contacts
+	ListContacts(c *gin.Context)
+
+	// Remove a contact
+	RemoveContact(c *gin.Context)
+
+	// Update contact settings
+	UpdateSettings(c *gin.Context)
+}
+
+// ContactHandler is a handler for contacts
+type ContactHandler struct {
+	service   service.IContactService
+	publisher socket.IPublisher
+}
+
+// NewContactHandler creates a new contact handler
+func NewContactHandler(service service.IContactService, publisher socket.IPublisher) *ContactHandler {
+	return &ContactHandler{
+		service:   service,
+		publisher: publisher,
+	}
+}
+
+// Send a contact request godoc
+// @Summary Send a contact request
+// @Description Send a contact request, a pending request from the other user is accepted instead
+// @Security Bearer
+// @Tags contacts
+// @Accept json
+// @Produce json
+// @Param request body CreateContactRequest true "Create Contact Request"
+// @Success 200 {object} model.ContactRequest "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 403 {object} string "User is blocked"
+// @Failure 409 {object} string "Contact request already sent"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/requests [post]
+func (h *ContactHandler) SendRequest(c *gin.Context) {
+	var createRequest CreateContactRequest
+	if err := c.ShouldBindJSON(&createRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	request, err := h.service.SendRequest(c, c.GetString("userId"), createRequest.UserID)
+	if err != nil {
+		contactError(c, err)
+		return
+	}
+
+	if request.Status == model.ContactRequestAccepted {
+		h.publisher.SendToUser(request.From, "contactAccepted", request)
+	} else {
+		h.publisher.SendToUser(request.To, "contactRequest", request)
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// Accept a contact request godoc
+// @Summary Accept a contact request
+// @Description Accept a contact request sent to the current user
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Param requestId path string true "Request ID"
+// @Success 200 {object} model.ContactRequest "ok"
+// @Failure 403 {object} string "Contact request belongs to another user"
+// @Failure 404 {object} string "Contact request not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/requests/{requestId}/accept [post]
+func (h *ContactHandler) Accept(c *gin.Context) {
+	request, err := h.service.Accept(c, c.GetString("userId"), c.Param("requestId"))
+	if err != nil {
+		contactError(c, err)
+		return
+	}
+
+	h.publisher.SendToUser(request.From, "contactAccepted", request)
+	c.JSON(http.StatusOK, request)
+}
+
+// Decline a contact request godoc
+// @Summary Decline a contact request
+// @Description Decline a contact request sent to the current user
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Param requestId path string true "Request ID"
+// @Success 200 {object} model.ContactRequest "ok"
+// @Failure 403 {object} string "Contact request belongs to another user"
+// @Failure 404 {object} string "Contact request not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/requests/{requestId}/decline [post]
+func (h *ContactHandler) Decline(c *gin.Context) {
+	request, err := h.service.Decline(c, c.GetString("userId"), c.Param("requestId"))
+	if err != nil {
+		contactError(c, err)
+		return
+	}
+
+	h.publisher.SendToUser(request.From, "contactDeclined", request)
+	c.JSON(http.StatusOK, request)
+}
+
+// Cancel a contact request godoc
+// @Summary Cancel a contact request
+// @Description Cancel a contact request sent by the current user
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Param requestId path string true "Request ID"
+// @Success 200 {object} model.ContactRequest "ok"
+// @Failure 403 {object} string "Contact request belongs to another user"
+// @Failure 404 {object} string "Contact request not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/requests/{requestId}/cancel [post]
+func (h *ContactHandler) Cancel(c *gin.Context) {
+	request, err := h.service.Cancel(c, c.GetString("userId"), c.Param("requestId"))
+	if err != nil {
+		contactError(c, err)
+		return
+	}
+
+	h.publisher.SendToUser(request.To, "contactCancelled", request)
+	c.JSON(http.StatusOK, request)
+}
+
+// List contact requests godoc
+// @Summary List contact requests
+// @Description List the pending contact requests sent to the current user, or sent by them with direction=outgoing
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Param direction query string false "incoming or outgoing"
+// @Success 200 {object} []model.ContactRequest "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/requests [get]
+func (h *ContactHandler) ListRequests(c *gin.Context) {
+	requests, err := h.service.ListRequests(c, c.GetString("userId"), c.Query("direction") == "outgoing")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// List contacts godoc
+// @Summary List contacts
+// @Description List the contacts of the current user
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Success 200 {object} []model.User "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts [get]
+func (h *ContactHandler) ListContacts(c *gin.Context) {
+	users, err := h.service.ListContacts(c, c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, user := range users {
+		user.Email = ""
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// Remove a contact godoc
+// @Summary Remove a contact
+// @Description Remove a contact in both directions
+// @Security Bearer
+// @Tags contacts
+// @Produce json
+// @Param userId path string true "User ID"
+// @Success 200 {object} string "ok"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/{userId} [delete]
+func (h *ContactHandler) RemoveContact(c *gin.Context) {
+	if err := h.service.RemoveContact(c, c.GetString("userId"), c.Param("userId")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact removed"})
+}
+
+// Update contact settings godoc
+// @Summary Update contact settings
+// @Description Choose whether only contacts may start direct conversations with the current user
+// @Security Bearer
+// @Tags contacts
+// @Accept json
+// @Produce json
+// @Param settings body ContactSettings true "Contact Settings"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/contacts/settings [put]
+func (h *ContactHandler) UpdateSettings(c *gin.Context) {
+	var settings ContactSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := h.service.SetDMContactsOnly(c, c.GetString("userId"), *settings.DMContactsOnly); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dmContactsOnly": *settings.DMContactsOnly})
+}
+
+func contactError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidTarget):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrBlocked), errors.Is(err, service.ErrContactRequestForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrContactRequestNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrAlreadyContact), errors.Is(err, service.ErrContactRequestExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/service"
+	"github.com/guutong/chat-backend/socket"
 )
 
 // CreateConversation is a struct for creating a new conversation
@@ -14,12 +17,45 @@ type CreateConversation struct {
 	RecipientID string `json:"recipientId" binding:"required"`
 }
 
+// UpdateConversationSettings is a struct for updating the settings of a conversation, missing fields are left as they are
+type UpdateConversationSettings struct {
+	// Seconds to mute the conversation for, -1 mutes it until it is unmuted and 0 unmutes it
+	MuteFor     *int64  `json:"muteFor" binding:"omitempty,min=-1"`
+	NotifyLevel *string `json:"notifyLevel" binding:"omitempty,oneof=all mentions none"`
+
+	// Surrounding whitespace is trimmed, line breaks and control characters are rejected and an empty nickname clears it
+	Nickname *string `json:"nickname" binding:"omitempty,max=64"`
+}
+
+// ConversationListResponse is a page of conversations
+type ConversationListResponse struct {
+	Conversations []ConversationResponse `json:"conversations"`
+	NextCursor    string                 `json:"nextCursor,omitempty"`
+}
+
+const (
+	defaultConversationLimit = 20
+	maxConversationLimit     = 100
+)
+
 type ConversationResponse struct {
 	ID            string         `json:"id"`
 	Members       []model.User   `json:"members"`
 	CreateAt      *time.Time     `json:"createAt"`
 	LatestMessage *model.Message `json:"latestMessage"`
 	Recipient     *model.User    `json:"recipient"`
+	LastSeq       int64          `json:"lastSeq"`
+
+	// Time of the latest message, or of the creation of a conversation without messages
+	LastActivityAt time.Time `json:"lastActivityAt"`
+
+	// Pinned and archived are the state of the caller's own list
+	Pinned         bool                  `json:"pinned"`
+	Archived       bool                  `json:"archived"`
+	PinnedMessages []model.PinnedMessage `json:"pinnedMessages"`
+
+	// Settings of the caller for the conversation, set in the list of conversations
+	Settings *model.ConversationSettings `json:"settings,omitempty"`
 }
 
 // IConversationHandler is an interface for conversation handlers
@@ -32,13 +68,35 @@ type IConversationHandler interface {
 
 	// Join a conversation
 	Join(c *gin.Context)
+
+	// Pin a conversation in the list of the caller
+	Pin(c *gin.Context)
+
+	// Unpin a conversation in the list of the caller
+	Unpin(c *gin.Context)
+
+	// Archive a conversation for the caller
+	Archive(c *gin.Context)
+
+	// Unarchive a conversation for the caller
+	Unarchive(c *gin.Context)
+
+	// Get the settings of the caller for a conversation
+	GetSettings(c *gin.Context)
+
+	// Update the settings of the caller for a conversation
+	UpdateSettings(c *gin.Context)
 }
 
 // ConversationHandler is a handler for conversation
 type ConversationHandler struct {
-	service        service.IConversationService
-	userService    service.IUserService
-	messageService service.IMessageService
+	service         service.IConversationService
+	userService     service.IUserService
+	messageService  service.IMessageService
+	blockService    service.IBlockService
+	contactService  service.IContactService
+	settingsService service.ISettingsService
+	publisher       socket.IPublisher
 }
 
 // NewConversationHandler creates a new conversation handler
@@ -46,11 +104,19 @@ func NewConversationHandler(
 	service service.IConversationService,
 	userService service.IUserService,
 	messageService service.IMessageService,
+	blockService service.IBlockService,
+	contactService service.IContactService,
+	settingsService service.ISettingsService,
+	publisher socket.IPublisher,
 ) *ConversationHandler {
 	return &ConversationHandler{
-		service:        service,
-		userService:    userService,
-		messageService: messageService,
+		service:         service,
+		userService:     userService,
+		messageService:  messageService,
+		blockService:    blockService,
+		contactService:  contactService,
+		settingsService: settingsService,
+		publisher:       publisher,
 	}
 }
 
@@ -64,6 +130,7 @@ func NewConversationHandler(
 // @Param conversation body CreateConversation true "Create Conversation"
 // @Success 200 {object} string "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 403 {object} string "User is blocked or only accepts messages from contacts"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/conversations [post]
 func (h *ConversationHandler) Create(c *gin.Context) {
@@ -99,19 +166,31 @@ func (h *ConversationHandler) Create(c *gin.Context) {
 		return
 	}
 
-	user.Password = ""
-	recipient.Password = ""
+	blocked, err := h.blockService.IsBlocked(c, userID.(string), createConversation.RecipientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": service.ErrBlocked.Error()})
+		return
+	}
+
+	if err := h.contactService.CanMessage(c, userID.(string), recipient); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	publicUser(user)
+	publicUser(recipient)
 
 	// check if pair conversation already exists return pair conversation
 	conversation, err := h.service.FindByPair(c, userID.(string), createConversation.RecipientID)
 	if err == nil {
-		c.JSON(http.StatusOK, ConversationResponse{
-			ID:            conversation.ID.Hex(),
-			Members:       conversation.Members,
-			CreateAt:      conversation.CreateAt,
-			LatestMessage: nil,
-			Recipient:     recipient,
-		})
+		response := conversationResponse(userID.(string), conversation)
+		response.Recipient = recipient
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
@@ -126,24 +205,28 @@ func (h *ConversationHandler) Create(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, ConversationResponse{
-		ID:            created.ID.Hex(),
-		Members:       created.Members,
-		CreateAt:      created.CreateAt,
-		LatestMessage: nil,
-		Recipient:     recipient,
-	})
+	socket.PublishMembership(h.publisher, "conversationCreated", created, userID.(string))
+
+	response := conversationResponse(userID.(string), created)
+	response.Recipient = recipient
+	c.JSON(http.StatusOK, response)
 }
 
 // List conversations by user godoc
 // @Summary List conversations by user
-// @Description List conversations by user
+// @Description List the conversations of the caller, the ones they pinned first and then the most recently active.
+// @Description Archived conversations are left out unless archived is true, then only they are listed.
+// @Description A request without cursor and limit gets the first 100 conversations as a plain array, the response of earlier versions.
+// @Description That form is deprecated, pass limit to get a page of conversations instead.
 // @Security Bearer
 // @Tags conversations
 // @Accept json
 // @Produce json
-// @Param userId path string true "User ID"
-// @Success 200 {object} string "ok"
+// @Param archived query bool false "List archived conversations"
+// @Param cursor query string false "Cursor of the next page"
+// @Param limit query int false "Limit"
+// @Success 200 {object} ConversationListResponse "ok"
+// @Failure 400 {object} string "Invalid request payload"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/users/conversations [get]
 func (h *ConversationHandler) GetAllConversationsByUser(c *gin.Context) {
@@ -153,42 +236,85 @@ func (h *ConversationHandler) GetAllConversationsByUser(c *gin.Context) {
 		return
 	}
 
-	conversations, err := h.service.FindByUserID(c, userID.(string))
+	archived := false
+	if archivedQuery, exists := c.GetQuery("archived"); exists {
+		parsed, err := strconv.ParseBool(archivedQuery)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		archived = parsed
+	}
+
+	// Clients written before paging ask for neither and expect an array
+	_, hasCursor := c.GetQuery("cursor")
+	limitQuery, hasLimit := c.GetQuery("limit")
+	paged := hasCursor || hasLimit
+
+	limit := int64(defaultConversationLimit)
+	if !paged {
+		limit = maxConversationLimit
+	}
+	if hasLimit {
+		parsed, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		limit = parsed
+		if limit > maxConversationLimit {
+			limit = maxConversationLimit
+		}
+	}
+
+	conversations, nextCursor, err := h.service.FindByUserIDPagination(c, userID.(string), archived, c.Query("cursor"), limit)
+	if errors.Is(err, service.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get the latest message of each conversation
-	responses := make([]ConversationResponse, len(conversations))
+	conversationIDs := make([]string, len(conversations))
 	for i, conversation := range conversations {
-		latestMessage, _ := h.messageService.FindLastMessageByConversationID(c, conversation.ID.Hex())
-		recipient := conversation.Members[0]
-		if recipient.ID.Hex() == userID.(string) {
-			recipient = conversation.Members[1]
-		}
-
-		responses[i] = ConversationResponse{
-			ID:            conversation.ID.Hex(),
-			Members:       conversation.Members,
-			CreateAt:      conversation.CreateAt,
-			LatestMessage: latestMessage,
-			Recipient:     &recipient,
-		}
+		conversationIDs[i] = conversation.ID.Hex()
+	}
+	settings, err := h.settingsService.FindByUserID(c, userID.(string), conversationIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, responses)
+	// The latest message is kept on each conversation
+	responses := conversationResponses(userID.(string), conversations)
+	for i := range responses {
+		responses[i].Settings = settings[responses[i].ID]
+	}
+	if !paged {
+		c.JSON(http.StatusOK, responses)
+		return
+	}
+	c.JSON(http.StatusOK, ConversationListResponse{
+		Conversations: responses,
+		NextCursor:    nextCursor,
+	})
 }
 
 // Join a conversation godoc
 // @Summary Join a conversation
-// @Description Join a conversation
+// @Description Join a conversation, the caller must be allowed to message every member: nobody blocked the other and no member takes messages from contacts only unless the caller is one of them.
+// @Description Joining a conversation the caller is already a member of changes nothing.
 // @Security Bearer
 // @Tags conversations
 // @Accept json
 // @Produce json
 // @Param conversationId path string true "Conversation ID"
-// @Success 200 {object} string "ok"
+// @Success 200 {object} ConversationResponse
+// @Failure 403 {object} string "Blocked"
+// @Failure 404 {object} string "Conversation not found"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/conversations/{conversationId}/join [post]
 func (h *ConversationHandler) Join(c *gin.Context) {
@@ -199,29 +325,308 @@ func (h *ConversationHandler) Join(c *gin.Context) {
 		return
 	}
 
-	conversationID := c.Param("conversationId")
-	if err := h.service.Join(c, conversationID, userID.(string)); err != nil {
+	conversation, err := h.service.FindByID(c, c.Param("conversationId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	if !conversation.HasMember(userID.(string)) {
+		if err := h.canJoin(c, userID.(string), conversation); err != nil {
+			if errors.Is(err, service.ErrBlocked) || errors.Is(err, service.ErrContactsOnly) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := h.userService.FindByID(c, userID.(string))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		publicUser(user)
+
+		joined, err := h.service.Join(c, conversation.ID.Hex(), user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		conversation, err = h.service.FindByID(c, conversation.ID.Hex())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A concurrent join of the same user already told the members
+		if joined {
+			socket.PublishMembership(h.publisher, "memberJoined", conversation, userID.(string))
+		}
+	}
+
+	c.JSON(http.StatusOK, conversationResponse(userID.(string), conversation))
+}
+
+// canJoin checks whether a user may message every member of a conversation they are not in
+func (h *ConversationHandler) canJoin(c *gin.Context, userID string, conversation *model.Conversation) error {
+	userIDs := []string{userID}
+	for _, member := range conversation.Members {
+		userIDs = append(userIDs, member.ID.Hex())
+	}
+
+	hidden, err := h.blockService.FindBlockedAmong(c, userIDs)
+	if err != nil {
+		return err
+	}
+	if len(hidden[userID]) > 0 {
+		return service.ErrBlocked
+	}
+
+	// The stored members are copies without contacts, the contact lists are read from the users
+	for _, memberID := range userIDs[1:] {
+		member, err := h.userService.FindByID(c, memberID)
+		if err != nil {
+			return err
+		}
+		if err := h.contactService.CanMessage(c, userID, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin a conversation godoc
+// @Summary Pin a conversation
+// @Description Pin a conversation to the top of the caller's list, the other members do not see it
+// @Security Bearer
+// @Tags conversations
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/pin [post]
+func (h *ConversationHandler) Pin(c *gin.Context) {
+	h.updateState(c, func(conversation *model.Conversation, userID string) error {
+		return h.service.SetPinned(c, conversation.ID.Hex(), userID, true)
+	})
+}
+
+// Unpin a conversation godoc
+// @Summary Unpin a conversation
+// @Description Unpin a conversation in the caller's list
+// @Security Bearer
+// @Tags conversations
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/pin [delete]
+func (h *ConversationHandler) Unpin(c *gin.Context) {
+	h.updateState(c, func(conversation *model.Conversation, userID string) error {
+		return h.service.SetPinned(c, conversation.ID.Hex(), userID, false)
+	})
+}
+
+// Archive a conversation godoc
+// @Summary Archive a conversation
+// @Description Move a conversation out of the caller's list into their archived conversations
+// @Security Bearer
+// @Tags conversations
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/archive [post]
+func (h *ConversationHandler) Archive(c *gin.Context) {
+	h.updateState(c, func(conversation *model.Conversation, userID string) error {
+		return h.service.SetArchived(c, conversation.ID.Hex(), userID, true)
+	})
+}
+
+// Unarchive a conversation godoc
+// @Summary Unarchive a conversation
+// @Description Move an archived conversation back into the caller's list
+// @Security Bearer
+// @Tags conversations
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/archive [delete]
+func (h *ConversationHandler) Unarchive(c *gin.Context) {
+	h.updateState(c, func(conversation *model.Conversation, userID string) error {
+		return h.service.SetArchived(c, conversation.ID.Hex(), userID, false)
+	})
+}
+
+// updateState changes the state of a conversation in the caller's list and syncs it to their other sessions
+func (h *ConversationHandler) updateState(c *gin.Context, update func(conversation *model.Conversation, userID string) error) {
+	userID := c.GetString("userId")
+
+	conversation, err := h.service.FindByID(c, c.Param("conversationId"))
+	if err != nil || !conversation.HasMember(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	if err := update(conversation, userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	conversation, err := h.service.FindByID(c, conversationID)
+	updated, err := h.service.FindByID(c, conversation.ID.Hex())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	latestMessage, _ := h.messageService.FindLastMessageByConversationID(c, conversation.ID.Hex())
-	recipient := conversation.Members[0]
-	if recipient.ID.Hex() == userID.(string) {
-		recipient = conversation.Members[1]
+	state := socket.ConversationStateData{
+		ConversationID: updated.ID.Hex(),
+		Pinned:         updated.IsPinnedBy(userID),
+		Archived:       updated.IsArchivedBy(userID),
 	}
+	h.publisher.SendToUser(userID, "conversationState", state)
+	c.JSON(http.StatusOK, state)
+}
 
-	c.JSON(http.StatusOK, ConversationResponse{
-		ID:            conversation.ID.Hex(),
-		Members:       conversation.Members,
-		CreateAt:      conversation.CreateAt,
-		LatestMessage: latestMessage,
-		Recipient:     &recipient,
-	})
+// Get the settings of a conversation godoc
+// @Summary Get the settings of a conversation
+// @Description Get the notification settings and nickname the caller chose for a conversation
+// @Security Bearer
+// @Tags conversations
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {object} model.ConversationSettings "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/settings [get]
+func (h *ConversationHandler) GetSettings(c *gin.Context) {
+	userID := c.GetString("userId")
+
+	conversation, err := h.service.FindByID(c, c.Param("conversationId"))
+	if err != nil || !conversation.HasMember(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	settings, err := h.settingsService.Find(c, userID, conversation.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Update the settings of a conversation godoc
+// @Summary Update the settings of a conversation
+// @Description Mute a conversation for a number of seconds or until it is unmuted, choose which messages notify the caller
+// @Description and give the conversation a nickname in their list. The other members do not see the settings.
+// @Security Bearer
+// @Tags conversations
+// @Accept json
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Param settings body UpdateConversationSettings true "Update Conversation Settings"
+// @Success 200 {object} model.ConversationSettings "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/settings [put]
+func (h *ConversationHandler) UpdateSettings(c *gin.Context) {
+	userID := c.GetString("userId")
+
+	var updateSettings UpdateConversationSettings
+	if err := c.ShouldBindJSON(&updateSettings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	conversation, err := h.service.FindByID(c, c.Param("conversationId"))
+	if err != nil || !conversation.HasMember(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	update := service.SettingsUpdate{
+		NotifyLevel: updateSettings.NotifyLevel,
+		Nickname:    updateSettings.Nickname,
+	}
+	if updateSettings.MuteFor != nil {
+		muteFor := service.MuteForever
+		if *updateSettings.MuteFor >= 0 {
+			muteFor = time.Duration(*updateSettings.MuteFor) * time.Second
+		}
+		update.MuteFor = &muteFor
+	}
+
+	settings, err := h.settingsService.Update(c, userID, conversation.ID.Hex(), update)
+	if errors.Is(err, service.ErrInvalidSettings) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The other sessions of the caller pick up the new settings
+	h.publisher.SendToUser(userID, "conversationSettings", settings)
+	c.JSON(http.StatusOK, settings)
+}
+
+// conversationResponse builds the response of a conversation for one of its members
+func conversationResponse(userID string, conversation *model.Conversation) ConversationResponse {
+	response := ConversationResponse{
+		ID:             conversation.ID.Hex(),
+		Members:        conversation.Members,
+		CreateAt:       conversation.CreateAt,
+		LatestMessage:  conversation.LastMessage,
+		LastSeq:        conversation.LastSeq,
+		LastActivityAt: conversation.ActivityAt(),
+		Pinned:         conversation.IsPinnedBy(userID),
+		Archived:       conversation.IsArchivedBy(userID),
+		PinnedMessages: pinnedMessages(conversation),
+	}
+
+	for i := range conversation.Members {
+		if conversation.Members[i].ID.Hex() != userID {
+			response.Recipient = &conversation.Members[i]
+			break
+		}
+	}
+	return response
+}
+
+// conversationResponses builds the responses of the conversations of a member
+func conversationResponses(userID string, conversations []*model.Conversation) []ConversationResponse {
+	responses := make([]ConversationResponse, len(conversations))
+	for i, conversation := range conversations {
+		responses[i] = conversationResponse(userID, conversation)
+	}
+	return responses
+}
+
+// pinnedMessages returns the pinned messages of a conversation, never nil
+func pinnedMessages(conversation *model.Conversation) []model.PinnedMessage {
+	if conversation.PinnedMessages == nil {
+		return []model.PinnedMessage{}
+	}
+	return conversation.PinnedMessages
+}
+
+// publicUser clears the fields of a user that must not be shared with other users
+func publicUser(user *model.User) {
+	user.Password = ""
+	user.Email = ""
+	user.SearchTerms = nil
+	user.BlockedUsers = nil
+	user.MutedUsers = nil
+	user.Contacts = nil
 }
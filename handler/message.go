@@ -2,6 +2,8 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,13 +11,48 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/service"
+	"github.com/guutong/chat-backend/socket"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type CreateMessage struct {
 	Text string `json:"text" binding:"required"`
+
+	// Id chosen by the client to make retries safe, the Idempotency-Key header can be used instead
+	ClientMessageID string `json:"clientMessageId" binding:"omitempty,max=64"`
+}
+
+// MarkRead is a struct for marking the messages of a conversation as read
+type MarkRead struct {
+	Seq int64 `json:"seq" binding:"required,min=1"`
+}
+
+// ReceiptResponse is the status of a message for one of its recipients
+type ReceiptResponse struct {
+	UserID      string     `json:"userId"`
+	Status      string     `json:"status"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+}
+
+// PinnedMessageResponse is a pinned message of a conversation
+type PinnedMessageResponse struct {
+	Message  *model.Message `json:"message"`
+	PinnedBy string         `json:"pinnedBy"`
+	PinnedAt time.Time      `json:"pinnedAt"`
 }
 
+// MentionListResponse is a page of the messages mentioning the caller
+type MentionListResponse struct {
+	Messages   []*model.Message `json:"messages"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 200
+)
+
 // IMessageHandler is an interface for message handlers
 type IMessageHandler interface {
 	// Create a new message
@@ -26,17 +63,49 @@ type IMessageHandler interface {
 
 	// List messages by conversation pagination
 	ListMessagesByConversationPagination(c *gin.Context)
+
+	// Mark the messages of a conversation as read
+	MarkRead(c *gin.Context)
+
+	// List the receipts of a message
+	ListReceipts(c *gin.Context)
+
+	// Pin a message in its conversation
+	PinMessage(c *gin.Context)
+
+	// Unpin a message in its conversation
+	UnpinMessage(c *gin.Context)
+
+	// List the pinned messages of a conversation
+	ListPinnedMessages(c *gin.Context)
+
+	// List the messages mentioning the caller
+	ListMentions(c *gin.Context)
 }
 
 // MessageHandler is a handler for message
 type MessageHandler struct {
-	service service.IMessageService
+	service             service.IMessageService
+	conversationService service.IConversationService
+	blockService        service.IBlockService
+	receiptService      service.IReceiptService
+	publisher           socket.IPublisher
 }
 
 // NewMessageHandler creates a new message handler
-func NewMessageHandler(service service.IMessageService) *MessageHandler {
+func NewMessageHandler(
+	service service.IMessageService,
+	conversationService service.IConversationService,
+	blockService service.IBlockService,
+	receiptService service.IReceiptService,
+	publisher socket.IPublisher,
+) *MessageHandler {
 	return &MessageHandler{
-		service: service,
+		service:             service,
+		conversationService: conversationService,
+		blockService:        blockService,
+		receiptService:      receiptService,
+		publisher:           publisher,
 	}
 }
 
@@ -48,8 +117,11 @@ func NewMessageHandler(service service.IMessageService) *MessageHandler {
 // @Accept json
 // @Produce json
 // @Param message body CreateMessage true "Create Message"
+// @Param Idempotency-Key header string false "Client message id, a retry with the same key returns the stored message"
 // @Success 200 {object} model.Message "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 403 {object} string "User is blocked"
+// @Failure 404 {object} string "Conversation not found"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/conversations/{conversationId}/messages [post]
 func (h *MessageHandler) Create(c *gin.Context) {
@@ -66,39 +138,116 @@ func (h *MessageHandler) Create(c *gin.Context) {
 		return
 	}
 
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		if len(key) > 64 || (createMessage.ClientMessageID != "" && createMessage.ClientMessageID != key) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid idempotency key"})
+			return
+		}
+		createMessage.ClientMessageID = key
+	}
+
+	conversation, err := h.conversationService.FindByID(c, conversationID)
+	if err != nil || !conversation.HasMember(userID.(string)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	// A block in either direction closes the direct conversation
+	if recipient := conversation.Recipient(userID.(string)); recipient != nil {
+		blocked, err := h.blockService.IsBlocked(c, userID.(string), recipient.ID.Hex())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if blocked {
+			c.JSON(http.StatusForbidden, gin.H{"error": service.ErrBlocked.Error()})
+			return
+		}
+	}
+
 	// Create a new message
 	message := model.Message{
-		ID:             primitive.NewObjectID(),
-		ConversationID: conversationID,
-		Sender:         userID.(string),
-		Text:           createMessage.Text,
-		CreateAt:       time.Now(),
+		ID:              primitive.NewObjectID(),
+		ConversationID:  conversationID,
+		Sender:          userID.(string),
+		Text:            createMessage.Text,
+		ClientMessageID: createMessage.ClientMessageID,
+		CreateAt:        time.Now(),
 	}
 
-	err := h.service.Create(context.Background(), &message)
+	// A retried message gets the message stored by the first attempt
+	err = h.service.Create(context.Background(), &message)
+	if errors.Is(err, service.ErrDuplicateMessage) {
+		c.JSON(http.StatusOK, message)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recipients := []string{}
+	for _, member := range conversation.Members {
+		recipients = append(recipients, member.ID.Hex())
+	}
+
+	// The message is stored, a missing receipt only leaves its status unknown
+	if err := h.receiptService.Create(c, &message, recipients); err != nil {
+		log.Println("receipt:", err)
+	}
+
+	// Members who are blocked from or by the sender still get a receipt but not the message
+	delivered := []string{}
+	for _, recipientID := range recipients {
+		if recipientID == message.Sender {
+			continue
+		}
+
+		blocked, err := h.blockService.IsBlocked(c, message.Sender, recipientID)
+		if err == nil && !blocked {
+			delivered = append(delivered, recipientID)
+		}
+	}
+	h.publisher.DeliverMessage(delivered, &message)
+
 	c.JSON(http.StatusOK, message)
 }
 
 // List messages by conversation godoc
 // @Summary List messages by conversation
-// @Description List messages by conversation
+// @Description List messages by conversation ordered by sequence number.
+// @Description With after the messages following a sequence number are returned oldest first, use it to fill a gap.
+// @Description With before the messages preceding a sequence number are returned newest first, use it to load older history.
 // @Security Bearer
 // @Tags messages
 // @Accept json
 // @Produce json
 // @Param conversationId path string true "Conversation ID"
-// @Success 200 {object} string "ok"
+// @Param after query int false "Sequence number to list after"
+// @Param before query int false "Sequence number to list before"
+// @Param limit query int false "Limit, only used with after or before"
+// @Success 200 {array} model.Message "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 404 {object} string "Conversation not found"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/conversations/{conversationId}/messages [get]
 func (h *MessageHandler) ListMessagesByConversation(c *gin.Context) {
 	conversationID := c.Param("conversationId")
 
+	conversation, err := h.conversationService.FindByID(c, conversationID)
+	if err != nil || !conversation.HasMember(c.GetString("userId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	afterQuery, hasAfter := c.GetQuery("after")
+	beforeQuery, hasBefore := c.GetQuery("before")
+	if hasAfter || hasBefore {
+		h.listMessagesBySeq(c, conversationID, afterQuery, hasAfter, beforeQuery)
+		return
+	}
+
 	messages, err := h.service.FindByConversationID(context.Background(), conversationID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -110,16 +259,18 @@ func (h *MessageHandler) ListMessagesByConversation(c *gin.Context) {
 
 // List messages by conversation pagination godoc
 // @Summary List messages by conversation pagination
-// @Description List messages by conversation pagination
+// @Description List messages by conversation pagination, newest first.
+// @Description Page is an offset, a message sent between two requests shifts the pages. Use before on the list endpoint to load older history.
 // @Security Bearer
 // @Tags messages
 // @Accept json
 // @Produce json
 // @Param conversationId path string true "Conversation ID"
-// @Param page query int true "Page"
+// @Param page query int true "Number of newest messages to skip"
 // @Param limit query int true "Limit"
-// @Success 200 {object} string "ok"
+// @Success 200 {array} model.Message "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 404 {object} string "Conversation not found"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/conversations/{conversationId}/messages/pagination [get]
 func (h *MessageHandler) ListMessagesByConversationPagination(c *gin.Context) {
@@ -137,18 +288,27 @@ func (h *MessageHandler) ListMessagesByConversationPagination(c *gin.Context) {
 	}
 
 	page, err := strconv.ParseInt(pageQuery, 10, 64)
-	if err != nil {
+	if err != nil || page < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
 	limit, err := strconv.ParseInt(limitQuery, 10, 64)
-	if err != nil {
+	if err != nil || limit <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
+	if limit > maxMessageLimit {
+		limit = maxMessageLimit
+	}
+
+	conversation, err := h.conversationService.FindByID(c, conversationID)
+	if err != nil || !conversation.HasMember(c.GetString("userId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
 
-	messages, err := h.service.FindByConversationIDPagination(context.Background(), conversationID, page, limit)
+	messages, err := h.service.FindByConversationIDPagination(c, conversationID, page, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -156,3 +316,355 @@ func (h *MessageHandler) ListMessagesByConversationPagination(c *gin.Context) {
 
 	c.JSON(http.StatusOK, messages)
 }
+
+func (h *MessageHandler) listMessagesBySeq(c *gin.Context, conversationID string, afterQuery string, hasAfter bool, beforeQuery string) {
+	limit := int64(defaultMessageLimit)
+	if limitQuery, exists := c.GetQuery("limit"); exists {
+		parsed, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		limit = parsed
+		if limit > maxMessageLimit {
+			limit = maxMessageLimit
+		}
+	}
+
+	var messages []*model.Message
+	var err error
+	if hasAfter {
+		after, parseErr := strconv.ParseInt(afterQuery, 10, 64)
+		if parseErr != nil || after < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		messages, err = h.service.FindByConversationIDAfterSeq(c, conversationID, after, limit)
+	} else {
+		before, parseErr := strconv.ParseInt(beforeQuery, 10, 64)
+		if parseErr != nil || before < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		messages, err = h.service.FindByConversationIDBeforeSeq(c, conversationID, before, limit)
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
+
+// Mark the messages of a conversation as read godoc
+// @Summary Mark the messages of a conversation as read
+// @Description Mark the messages of a conversation up to a sequence number as read, their senders get a messageStatus event
+// @Security Bearer
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Param read body MarkRead true "Mark Read"
+// @Success 200 {object} string "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/read [post]
+func (h *MessageHandler) MarkRead(c *gin.Context) {
+	userID := c.GetString("userId")
+	conversationID := c.Param("conversationId")
+
+	var markRead MarkRead
+	if err := c.ShouldBindJSON(&markRead); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	conversation, err := h.conversationService.FindByID(c, conversationID)
+	if err != nil || !conversation.HasMember(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	receipts, err := h.receiptService.MarkRead(c, userID, conversationID, markRead.Seq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	socket.PublishStatus(h.publisher, receipts)
+	if len(receipts) > 0 {
+		socket.PublishReadPointer(h.publisher, conversation, userID, markRead.Seq)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// List the receipts of a message godoc
+// @Summary List the receipts of a message
+// @Description List the delivery status of a message for each of its recipients, only the sender can see them
+// @Security Bearer
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Param messageId path string true "Message ID"
+// @Success 200 {array} ReceiptResponse "ok"
+// @Failure 404 {object} string "Message not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/messages/{messageId}/receipts [get]
+func (h *MessageHandler) ListReceipts(c *gin.Context) {
+	messageID, err := primitive.ObjectIDFromHex(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	message, err := h.service.FindByID(c, messageID)
+	if err != nil || message.ConversationID != c.Param("conversationId") || message.Sender != c.GetString("userId") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	receipts, err := h.receiptService.FindByMessageID(c, messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	responses := make([]ReceiptResponse, len(receipts))
+	for i, receipt := range receipts {
+		responses[i] = ReceiptResponse{
+			UserID:      receipt.UserID,
+			Status:      receipt.Status(),
+			DeliveredAt: receipt.DeliveredAt,
+			ReadAt:      receipt.ReadAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// Pin a message godoc
+// @Summary Pin a message
+// @Description Pin a message in its conversation for every member, a conversation has a limited number of pinned messages.
+// @Description Pinning a pinned message changes nothing and notifies nobody.
+// @Security Bearer
+// @Tags messages
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Param messageId path string true "Message ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Message not found"
+// @Failure 409 {object} string "Pinned message limit reached"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/messages/{messageId}/pin [post]
+func (h *MessageHandler) PinMessage(c *gin.Context) {
+	conversation, message, ok := h.memberMessage(c)
+	if !ok {
+		return
+	}
+
+	pinned, err := h.conversationService.PinMessage(c, conversation.ID.Hex(), message.ID, c.GetString("userId"))
+	if errors.Is(err, service.ErrPinLimit) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if pinned {
+		h.publishPin(conversation, "messagePinned", message, c.GetString("userId"))
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Message pinned"})
+}
+
+// Unpin a message godoc
+// @Summary Unpin a message
+// @Description Unpin a message in its conversation for every member
+// @Security Bearer
+// @Tags messages
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Param messageId path string true "Message ID"
+// @Success 200 {object} string "ok"
+// @Failure 404 {object} string "Message not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/messages/{messageId}/pin [delete]
+func (h *MessageHandler) UnpinMessage(c *gin.Context) {
+	conversation, message, ok := h.memberMessage(c)
+	if !ok {
+		return
+	}
+
+	unpinned, err := h.conversationService.UnpinMessage(c, conversation.ID.Hex(), message.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if unpinned {
+		h.publishPin(conversation, "messageUnpinned", message, c.GetString("userId"))
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Message unpinned"})
+}
+
+// List the pinned messages of a conversation godoc
+// @Summary List the pinned messages of a conversation
+// @Description List the pinned messages of a conversation, oldest pin first
+// @Security Bearer
+// @Tags messages
+// @Produce json
+// @Param conversationId path string true "Conversation ID"
+// @Success 200 {array} PinnedMessageResponse "ok"
+// @Failure 404 {object} string "Conversation not found"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/conversations/{conversationId}/pins [get]
+func (h *MessageHandler) ListPinnedMessages(c *gin.Context) {
+	conversation, err := h.conversationService.FindByID(c, c.Param("conversationId"))
+	if err != nil || !conversation.HasMember(c.GetString("userId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	ids := make([]primitive.ObjectID, len(conversation.PinnedMessages))
+	for i, pin := range conversation.PinnedMessages {
+		ids[i] = pin.MessageID
+	}
+
+	messages, err := h.service.FindByIDs(c, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	byID := make(map[primitive.ObjectID]*model.Message, len(messages))
+	for _, message := range messages {
+		byID[message.ID] = message
+	}
+
+	responses := []PinnedMessageResponse{}
+	for _, pin := range conversation.PinnedMessages {
+		if message, ok := byID[pin.MessageID]; ok {
+			responses = append(responses, PinnedMessageResponse{
+				Message:  message,
+				PinnedBy: pin.PinnedBy,
+				PinnedAt: pin.PinnedAt,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// memberMessage finds the conversation and message of the path, it responds with 404 unless the caller is a member
+func (h *MessageHandler) memberMessage(c *gin.Context) (*model.Conversation, *model.Message, bool) {
+	messageID, err := primitive.ObjectIDFromHex(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, nil, false
+	}
+
+	conversation, err := h.conversationService.FindByID(c, c.Param("conversationId"))
+	if err != nil || !conversation.HasMember(c.GetString("userId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, nil, false
+	}
+
+	message, err := h.service.FindByID(c, messageID)
+	if err != nil || message.ConversationID != conversation.ID.Hex() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, nil, false
+	}
+
+	return conversation, message, true
+}
+
+// publishPin sends a pin event to every member of the conversation
+func (h *MessageHandler) publishPin(conversation *model.Conversation, event string, message *model.Message, userID string) {
+	members := []string{}
+	for _, member := range conversation.Members {
+		members = append(members, member.ID.Hex())
+	}
+
+	h.publisher.SendToUsers(members, event, socket.PinData{
+		ConversationID: conversation.ID.Hex(),
+		MessageID:      message.ID.Hex(),
+		UserID:         userID,
+	})
+}
+
+// List the messages mentioning the caller godoc
+// @Summary List the messages mentioning the caller
+// @Description List the messages of every conversation that mention the caller, newest first.
+// @Description Pass the nextCursor of a page as cursor to get the next one.
+// @Security Bearer
+// @Tags messages
+// @Produce json
+// @Param cursor query string false "Cursor of the next page"
+// @Param limit query int false "Limit"
+// @Success 200 {object} MentionListResponse "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/users/me/mentions [get]
+func (h *MessageHandler) ListMentions(c *gin.Context) {
+	userID := c.GetString("userId")
+
+	var before *primitive.ObjectID
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		before = &id
+	}
+
+	limit := int64(defaultMessageLimit)
+	if limitQuery, exists := c.GetQuery("limit"); exists {
+		parsed, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		limit = parsed
+		if limit > maxMessageLimit {
+			limit = maxMessageLimit
+		}
+	}
+
+	messages, err := h.service.FindByMention(c, userID, before, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := MentionListResponse{Messages: []*model.Message{}}
+	if int64(len(messages)) == limit {
+		response.NextCursor = messages[len(messages)-1].ID.Hex()
+	}
+
+	// Mentions from users blocked from or by the caller are left out of the feed
+	blocked := map[string]bool{}
+	for _, message := range messages {
+		isBlocked, checked := blocked[message.Sender]
+		if !checked {
+			isBlocked, err = h.blockService.IsBlocked(c, userID, message.Sender)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			blocked[message.Sender] = isBlocked
+		}
+
+		if !isBlocked {
+			response.Messages = append(response.Messages, message)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
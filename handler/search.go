@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/search"
+	"github.com/guutong/chat-backend/service"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// ISearchHandler is an interface for search handlers
+type ISearchHandler interface {
+	// Search messages
+	SearchMessages(c *gin.Context)
+}
+
+// SearchHandler is a handler for search
+type SearchHandler struct {
+	service service.ISearchService
+}
+
+// NewSearchHandler creates a new search handler
+func NewSearchHandler(service service.ISearchService) *SearchHandler {
+	return &SearchHandler{
+		service: service,
+	}
+}
+
+// Search messages godoc
+// @Summary Search messages
+// @Description Search the messages of the conversations the caller belongs to, best matches first.
+// @Description The snippet of a hit is an HTML escaped excerpt of the text with the matches in <mark> tags.
+// @Security Bearer
+// @Tags search
+// @Accept json
+// @Produce json
+// @Param q query string true "Search query"
+// @Param conversationId query string false "Conversation ID"
+// @Param senderId query string false "Sender ID"
+// @Param from query string false "Oldest creation time, RFC 3339"
+// @Param to query string false "Newest creation time, RFC 3339"
+// @Param offset query int false "Offset"
+// @Param limit query int false "Limit"
+// @Success 200 {array} search.Hit "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/search/messages [get]
+func (h *SearchHandler) SearchMessages(c *gin.Context) {
+	query := search.Query{
+		Text:     c.Query("q"),
+		SenderID: c.Query("senderId"),
+		Limit:    defaultSearchLimit,
+	}
+	if query.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query"})
+		return
+	}
+
+	if conversationID := c.Query("conversationId"); conversationID != "" {
+		query.ConversationIDs = []string{conversationID}
+	}
+
+	for name, bound := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+		if value := c.Query(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+				return
+			}
+			*bound = &parsed
+		}
+	}
+
+	if offsetQuery, exists := c.GetQuery("offset"); exists {
+		parsed, err := strconv.ParseInt(offsetQuery, 10, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		query.Offset = parsed
+	}
+
+	if limitQuery, exists := c.GetQuery("limit"); exists {
+		parsed, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		query.Limit = parsed
+		if query.Limit > maxSearchLimit {
+			query.Limit = maxSearchLimit
+		}
+	}
+
+	hits, err := h.service.SearchMessages(c, c.GetString("userId"), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, hits)
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+	"github.com/guutong/chat-backend/socket"
+)
+
+// SyncChange is a change since the sync token, it is the event the socket delivers live.
+// Messages are never edited or deleted, so a message change is always a new message.
+type SyncChange struct {
+	Seq     int64           `json:"seq"`
+	Event   string          `json:"event"`
+	Message json.RawMessage `json:"message"`
+}
+
+// SyncResponse is the result of a sync, next is the token of the following sync
+type SyncResponse struct {
+	Changes []SyncChange `json:"changes"`
+	Next    string       `json:"next"`
+
+	// Reset means the changes since the token are no longer known, the client reloads its state from the conversations
+	Reset         bool                   `json:"reset"`
+	Conversations []ConversationResponse `json:"conversations,omitempty"`
+}
+
+// ISyncHandler is an interface for sync handlers
+type ISyncHandler interface {
+	// Sync the changes since a token
+	Sync(c *gin.Context)
+}
+
+// SyncHandler is a handler for the sync of offline clients
+type SyncHandler struct {
+	eventService        service.IEventService
+	conversationService service.IConversationService
+	listener            socket.IListener
+	maxWait             time.Duration
+}
+
+// NewSyncHandler creates a new sync handler, a sync without changes waits at most maxWait for one
+func NewSyncHandler(
+	eventService service.IEventService,
+	conversationService service.IConversationService,
+	listener socket.IListener,
+	maxWait time.Duration,
+) *SyncHandler {
+	return &SyncHandler{
+		eventService:        eventService,
+		conversationService: conversationService,
+		listener:            listener,
+		maxWait:             maxWait,
+	}
+}
+
+// Sync the changes since a token godoc
+// @Summary Sync the changes since a token
+// @Description Return the changes of the caller's conversations since a token: new messages, read pointers and membership changes.
+// @Description Messages cannot be edited or deleted yet, so there are no edit or deletion changes.
+// @Description The request is held open until a change happens or the timeout passes, an empty page keeps the same token.
+// @Description Without a token, when the changes since it expired or when it is ahead of the latest change, the response is a reset with the conversations to reload.
+// @Security Bearer
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param since query string false "Token of the previous sync"
+// @Param timeout query int false "Seconds to wait for a change"
+// @Success 200 {object} SyncResponse "ok"
+// @Failure 400 {object} string "Invalid request payload"
+// @Failure 500 {object} string "Internal server error"
+// @Router /api/sync [get]
+func (h *SyncHandler) Sync(c *gin.Context) {
+	userID := c.GetString("userId")
+
+	wait := h.maxWait
+	if timeoutQuery, exists := c.GetQuery("timeout"); exists {
+		seconds, err := strconv.Atoi(timeoutQuery)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		if timeout := time.Duration(seconds) * time.Second; timeout < wait {
+			wait = timeout
+		}
+	}
+
+	since := c.Query("since")
+	if since == "" {
+		cursor, err := h.eventService.FindCursor(c, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		h.reset(c, userID, cursor.Seq)
+		return
+	}
+
+	seq, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || seq < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync token"})
+		return
+	}
+
+	// Listen before reading the log so a change in between still wakes the request
+	changed, stop := h.listener.Listen(userID)
+	defer stop()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		events, latest, err := h.eventService.Replay(c, userID, seq)
+		if err != nil && !errors.Is(err, service.ErrEventsExpired) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A token ahead of the log was not issued by it, waiting would never bring the changes it claims
+		if err != nil || seq > latest {
+			h.reset(c, userID, latest)
+			return
+		}
+
+		if len(events) > 0 {
+			changes := make([]SyncChange, len(events))
+			for i, event := range events {
+				changes[i] = SyncChange{Seq: event.Seq, Event: event.Event, Message: event.Message}
+			}
+
+			c.JSON(http.StatusOK, SyncResponse{
+				Changes: changes,
+				Next:    strconv.FormatInt(latest, 10),
+			})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			c.JSON(http.StatusOK, SyncResponse{Changes: []SyncChange{}, Next: since})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// reset responds with the conversations of the user, the changes up to seq are part of them
+func (h *SyncHandler) reset(c *gin.Context, userID string, seq int64) {
+	conversations, err := h.conversationService.FindByUserID(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, SyncResponse{
+		Changes:       []SyncChange{},
+		Next:          strconv.FormatInt(seq, 10),
+		Reset:         true,
+		Conversations: conversationResponses(userID, conversations),
+	})
+}
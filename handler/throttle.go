@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+)
+
+// throttled records an attempt of the keys, it responds with 429 and returns true when one of the keys has to wait.
+// The attempt counts as a failure unless it is forgiven.
+func throttled(c *gin.Context, throttleService service.IThrottleService, keys ...service.ThrottleKey) bool {
+	wait, err := throttleService.Attempt(c, keys...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+
+	if wait <= 0 {
+		return false
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+	return true
+}
+
+// fail confirms a failed attempt, a storage error must not change the response
+func fail(c *gin.Context, throttleService service.IThrottleService, keys ...service.ThrottleKey) {
+	if err := throttleService.Fail(c, keys...); err != nil {
+		log.Println("throttle:", err)
+	}
+}
+
+// forgive stops counting an attempt as a failure, a storage error must not change the response
+func forgive(c *gin.Context, throttleService service.IThrottleService, keys ...service.ThrottleKey) {
+	if err := throttleService.Forgive(c, keys...); err != nil {
+		log.Println("throttle:", err)
+	}
+}
@@ -1,14 +1,18 @@
 package handler
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -16,9 +20,22 @@ import (
 type RegisterUser struct {
 	Username       string `json:"username" binding:"required"`
 	Password       string `json:"password" binding:"required"`
+	Email          string `json:"email" binding:"omitempty,email"`
+	DisplayName    string `json:"displayName" binding:"max=64"`
 	ProfilePicture string `json:"profilePicture" binding:"required"`
 }
 
+// UserListResponse is a page of users
+type UserListResponse struct {
+	Users      []*model.User `json:"users"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+const (
+	defaultUserLimit = 20
+	maxUserLimit     = 100
+)
+
 // LoginUser is a struct for logging in a user
 type LoginUser struct {
 	Username string `json:"username" binding:"required"`
@@ -42,13 +59,21 @@ type IUserHandler interface {
 
 // UserHandler is a handler for user
 type UserHandler struct {
-	service service.IUserService
+	service         service.IUserService
+	accountService  service.IAccountService
+	throttleService service.IThrottleService
 }
 
 // NewUserHandler creates a new user handler
-func NewUserHandler(service service.IUserService) *UserHandler {
+func NewUserHandler(
+	service service.IUserService,
+	accountService service.IAccountService,
+	throttleService service.IThrottleService,
+) *UserHandler {
 	return &UserHandler{
-		service: service,
+		service:         service,
+		accountService:  accountService,
+		throttleService: throttleService,
 	}
 }
 
@@ -61,6 +86,8 @@ func NewUserHandler(service service.IUserService) *UserHandler {
 // @Param user body RegisterUser true "Register User"
 // @Success 200 {object} string "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 409 {object} string "Username already exists"
+// @Failure 429 {object} string "Too many attempts"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/users/register [post]
 func (h *UserHandler) Register(c *gin.Context) {
@@ -71,17 +98,49 @@ func (h *UserHandler) Register(c *gin.Context) {
 		return
 	}
 
+	if registerUser.Email == "" && h.accountService.RequiresEmail() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+		return
+	}
+
+	ipKey := service.IPKey(c.ClientIP())
+	if throttled(c, h.throttleService, ipKey) {
+		return
+	}
+
 	user := model.User{
 		Username:       registerUser.Username,
-		Password:       hashedPassword(registerUser.Password),
+		DisplayName:    registerUser.DisplayName,
+		Password:       registerUser.Password,
+		Email:          registerUser.Email,
 		ProfilePicture: registerUser.ProfilePicture,
 	}
 
 	err := h.service.Register(c, &user)
 	if err != nil {
+		fail(c, h.throttleService, ipKey)
+		var policyErr *service.PolicyError
+		if errors.As(err, &policyErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if errors.Is(err, service.ErrUsernameTaken) || errors.Is(err, service.ErrEmailTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	forgive(c, h.throttleService, ipKey)
+
+	if user.Email != "" {
+		// The account exists already, a failed email can be resent later
+		if err := h.accountService.RequestEmailVerification(c, user.ID.Hex()); err != nil {
+			log.Println("email verification:", err)
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully"})
 }
@@ -95,6 +154,7 @@ func (h *UserHandler) Register(c *gin.Context) {
 // @Param user body LoginUser true "Login User"
 // @Success 200 {object} string "ok"
 // @Failure 400 {object} string "Invalid request payload"
+// @Failure 429 {object} string "Too many attempts"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/users/login [post]
 func (h *UserHandler) Login(c *gin.Context) {
@@ -104,22 +164,42 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
+	usernameKey := service.UsernameKey(loginUser.Username)
+	ipKey := service.IPKey(c.ClientIP())
+	if throttled(c, h.throttleService, usernameKey, ipKey) {
+		return
+	}
+
 	user, err := h.service.FindByUsername(c, loginUser.Username)
 	if err != nil {
 		if err.Error() == "mongo: no documents in result" {
+			fail(c, h.throttleService, usernameKey, ipKey)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credentials"})
 			return
 		}
 
+		forgive(c, h.throttleService, usernameKey, ipKey)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginUser.Password)); err != nil {
+		fail(c, h.throttleService, usernameKey, ipKey)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	// A correct password only clears the username, the ip may still be trying other accounts
+	if err := h.throttleService.Succeed(c, usernameKey); err != nil {
+		log.Println("throttle:", err)
+	}
+	forgive(c, h.throttleService, ipKey)
+
+	if !h.accountService.CanLogin(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email not verified"})
+		return
+	}
+
 	// Generate JWT token
 	token, err := generateToken(user.ID.Hex(), os.Getenv("JWT_SECRET"))
 	if err != nil {
@@ -131,39 +211,77 @@ func (h *UserHandler) Login(c *gin.Context) {
 }
 
 // GetAll godoc
-// @Summary Get all users
-// @Description Get all users
+// @Summary Search users
+// @Description Search users by a prefix or substring of their username or display name.
+// @Description A request without q, cursor and limit gets the first 100 users as a plain array, the response of earlier versions.
+// @Description That form is deprecated, pass limit to get a page of users instead.
 // @Security Bearer
 // @Tags users
 // @Accept json
 // @Produce json
-// @Success 200 {object} string "ok"
+// @Param q query string false "Search query"
+// @Param cursor query string false "Cursor of the next page"
+// @Param limit query int false "Limit"
+// @Success 200 {object} UserListResponse "ok"
+// @Failure 400 {object} string "Invalid request payload"
 // @Failure 500 {object} string "Internal server error"
 // @Router /api/users [get]
 func (h *UserHandler) GetAll(c *gin.Context) {
-	users, err := h.service.FindAll(c)
+	if c.Request.URL.RawQuery == "" {
+		h.getAllLegacy(c)
+		return
+	}
+
+	limit := int64(defaultUserLimit)
+	if limitQuery, exists := c.GetQuery("limit"); exists {
+		parsed, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		limit = parsed
+		if limit > maxUserLimit {
+			limit = maxUserLimit
+		}
+	}
+
+	cursor := c.Query("cursor")
+	if cursor != "" && !primitive.IsValidObjectID(cursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+
+	users, nextCursor, err := h.service.Search(c, c.GetString("userId"), c.Query("q"), cursor, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	responses := []model.User{}
 	for _, user := range users {
-		if user.ID.Hex() != c.GetString("userId") {
-			responses = append(responses, *user)
-		}
+		user.Email = ""
 	}
 
-	c.JSON(http.StatusOK, responses)
+	c.JSON(http.StatusOK, UserListResponse{
+		Users:      users,
+		NextCursor: nextCursor,
+	})
 }
 
-func hashedPassword(password string) string {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// getAllLegacy responds with the first page of users the caller can see as an array, clients written before paging expect it.
+// The page is as large as a paged request may ask for so the response stays bounded.
+func (h *UserHandler) getAllLegacy(c *gin.Context) {
+	users, _, err := h.service.Search(c, c.GetString("userId"), "", "", maxUserLimit)
 	if err != nil {
-		panic(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, user := range users {
+		user.Email = ""
 	}
 
-	return string(hashedPassword)
+	c.JSON(http.StatusOK, users)
 }
 
 func generateToken(userID string, jwtSecret string) (string, error) {
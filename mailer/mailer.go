@@ -0,0 +1,16 @@
+package mailer
+
+import "context"
+
+// Mail is an email to be sent to a single recipient
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	// Send an email
+	Send(ctx context.Context, mail Mail) error
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailer is a mailer that keeps sent emails in memory, it is meant for local development
+type MemoryMailer struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+// NewMemoryMailer creates a new in-memory mailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send an email
+func (m *MemoryMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mails = append(m.mails, mail)
+	return nil
+}
+
+// Sent returns a copy of all sent emails
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mails := make([]Mail, len(m.mails))
+	copy(mails, m.mails)
+	return mails
+}
+
+// Last returns the last email sent to the recipient
+func (m *MemoryMailer) Last(to string) (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.mails) - 1; i >= 0; i-- {
+		if m.mails[i].To == to {
+			return m.mails[i], true
+		}
+	}
+	return Mail{}, false
+}
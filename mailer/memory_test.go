@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer()
+	if _, ok := m.Last("alice@example.com"); ok {
+		t.Fatal("found an email before anything was sent")
+	}
+
+	for _, mail := range []Mail{
+		{To: "alice@example.com", Subject: "first"},
+		{To: "bob@example.com", Subject: "other"},
+		{To: "alice@example.com", Subject: "second"},
+	} {
+		if err := m.Send(context.Background(), mail); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last, ok := m.Last("alice@example.com")
+	if !ok || last.Subject != "second" {
+		t.Fatalf("last email of alice = %+v, want the second one", last)
+	}
+
+	sent := m.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("sent %d emails, want 3", len(sent))
+	}
+
+	// Sent returns a copy
+	sent[0].Subject = "changed"
+	if m.Sent()[0].Subject != "first" {
+		t.Fatal("changing the result of Sent changed the mailer")
+	}
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPMailer is a mailer that sends emails through an SMTP server
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a new SMTP mailer, auth is skipped when username is empty
+func NewSMTPMailer(host string, port string, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: auth,
+		from: from,
+	}
+}
+
+// Send an email
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mail.Subject)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(mail.Body)
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, []byte(msg.String()))
+}
@@ -2,25 +2,31 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/guutong/chat-backend/handler"
+	"github.com/guutong/chat-backend/mailer"
 	"github.com/guutong/chat-backend/middleware"
-	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/repository"
+	"github.com/guutong/chat-backend/search"
 	"github.com/guutong/chat-backend/service"
-	"github.com/mitchellh/mapstructure"
-	"github.com/olahol/melody"
+	"github.com/guutong/chat-backend/socket"
+	"github.com/redis/go-redis/v9"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -49,6 +55,154 @@ func connectToDB() {
 
 var db *mongo.Database
 
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvList reads a comma separated list, empty items are dropped
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func newUsernamePolicy() service.UsernamePolicy {
+	reserved := map[string]struct{}{}
+	for _, name := range strings.Split(getEnv("USERNAME_RESERVED", "admin,administrator,root,system,support,me"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			reserved[name] = struct{}{}
+		}
+	}
+
+	return service.UsernamePolicy{
+		MinLength: getEnvInt("USERNAME_MIN_LENGTH", 3),
+		MaxLength: getEnvInt("USERNAME_MAX_LENGTH", 32),
+		Pattern:   regexp.MustCompile(getEnv("USERNAME_PATTERN", `^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)),
+		Reserved:  reserved,
+	}
+}
+
+func newPasswordPolicy() service.PasswordPolicy {
+	policy := service.PasswordPolicy{
+		MinLength:     getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:     72,
+		MaxSimilarity: getEnvFloat("PASSWORD_MAX_SIMILARITY", 0.7),
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := service.LoadBreachedPasswords(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policy.Breached = breached
+	}
+	return policy
+}
+
+func newAttemptRepository() repository.IAttemptRepository {
+	if getEnv("THROTTLE_STORE", "mongo") == "memory" {
+		return repository.NewMemoryAttemptRepository()
+	}
+
+	attemptRepository := repository.NewAttemptRepository(db)
+	if err := attemptRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	return attemptRepository
+}
+
+func newSearchIndex() search.SearchIndex {
+	if getEnv("SEARCH_INDEX", "mongo") == "bleve" {
+		index, err := search.NewBleveIndex(getEnv("SEARCH_INDEX_PATH", "data/messages.bleve"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Search works meanwhile, older messages show up as they are indexed
+		go func() {
+			indexed, err := index.Backfill(context.Background(), db)
+			if err != nil {
+				log.Println("search: backfill stopped after", indexed, "messages:", err)
+				return
+			}
+			if indexed > 0 {
+				log.Println("search: backfilled", indexed, "messages")
+			}
+		}()
+		return index
+	}
+
+	index := search.NewMongoIndex(db)
+	if err := index.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	return index
+}
+
+// newBroker creates the broker and presence of the hub, the presence of the node is kept alive until ctx is done
+func newBroker(ctx context.Context) (socket.Broker, socket.Presence) {
+	if getEnv("BROKER", "local") != "redis" {
+		return socket.NewLocalBroker(), socket.NewLocalPresence()
+	}
+
+	opts, err := redis.ParseURL(getEnv("REDIS_URL", "redis://localhost:6379"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := redis.NewClient(opts)
+	broker := socket.NewRedisBroker(client, getEnv("REDIS_CHANNEL", "chat:socket"))
+	presence := socket.NewRedisPresence(ctx, client, "chat:presence:", uuid.NewString(), time.Minute)
+	return broker, presence
+}
+
+func newMailer() mailer.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST is not set, emails are kept in memory")
+		return mailer.NewMemoryMailer()
+	}
+
+	return mailer.NewSMTPMailer(
+		host,
+		getEnv("SMTP_PORT", "587"),
+		os.Getenv("SMTP_USERNAME"),
+		os.Getenv("SMTP_PASSWORD"),
+		getEnv("SMTP_FROM", "no-reply@chat-api.odds.team"),
+	)
+}
+
 // @title Chat API
 // @description This is a sample chat application API.
 // @version 1
@@ -64,11 +218,16 @@ var db *mongo.Database
 func main() {
 	connectToDB()
 
-	r := gin.Default()
+	r := gin.New()
+	r.Use(middleware.LoggerMiddleware(), gin.Recovery())
+	// Logins are throttled by client ip, X-Forwarded-For is only read from the proxies in TRUSTED_PROXIES
+	if err := r.SetTrustedProxies(getEnvList("TRUSTED_PROXIES")); err != nil {
+		log.Fatal(err)
+	}
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
 	config.AllowCredentials = true
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Idempotency-Key"}
 	r.Use(cors.New(config))
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
@@ -76,112 +235,237 @@ func main() {
 	userRepository := repository.NewUserRepository(db)
 	conversationRepository := repository.NewConversationRepository(db)
 	messageRepository := repository.NewMessageRepository(db)
+	tokenRepository := repository.NewTokenRepository(db)
+	auditRepository := repository.NewAuditRepository(db)
+	contactRepository := repository.NewContactRepository(db)
+	receiptRepository := repository.NewReceiptRepository(db)
+	settingsRepository := repository.NewSettingsRepository(db)
+	eventRepository := repository.NewEventRepository(db, getEnvDuration("EVENT_LOG_TTL", 72*time.Hour))
 
-	userService := service.NewUserService(userRepository)
-	conversationService := service.NewConversationService(conversationRepository)
-	messageService := service.NewMessageService(messageRepository)
+	if err := userRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := userRepository.BackfillSearchTerms(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := tokenRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := contactRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := messageRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := conversationRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := conversationRepository.BackfillLastMessages(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := receiptRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := settingsRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := eventRepository.EnsureIndexes(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	passwordPolicy := newPasswordPolicy()
+	userService := service.NewUserService(userRepository, newUsernamePolicy(), passwordPolicy)
+	maxPinnedMessages := getEnvInt("MAX_PINNED_MESSAGES", 10)
+	if maxPinnedMessages <= 0 {
+		log.Fatal("MAX_PINNED_MESSAGES must be positive")
+	}
+	conversationService := service.NewConversationService(conversationRepository, maxPinnedMessages)
+	searchIndex := newSearchIndex()
+	messageService := service.NewMessageService(messageRepository, conversationRepository, userRepository, searchIndex)
+	searchService := service.NewSearchService(searchIndex, conversationRepository)
+	blockService := service.NewBlockService(userRepository)
+	contactService := service.NewContactService(contactRepository, userRepository)
+	receiptService := service.NewReceiptService(receiptRepository)
+	settingsService := service.NewSettingsService(settingsRepository, blockService)
+	eventService := service.NewEventService(eventRepository, int64(getEnvInt("EVENT_REPLAY_LIMIT", 1000)))
+	accountService := service.NewAccountService(userRepository, tokenRepository, newMailer(), passwordPolicy, service.AccountConfig{
+		Secret:           os.Getenv("JWT_SECRET"),
+		AppURL:           getEnv("APP_URL", "http://localhost:8080"),
+		VerifyTokenTTL:   24 * time.Hour,
+		ResetTokenTTL:    time.Hour,
+		UnverifiedPolicy: service.UnverifiedPolicy(getEnv("UNVERIFIED_POLICY", string(service.UnverifiedAllow))),
+	})
 
-	userHandler := handler.NewUserHandler(userService)
-	conversationHandler := handler.NewConversationHandler(conversationService, userService, messageService)
-	messageHandler := handler.NewMessageHandler(messageService)
+	auditService := service.NewAuditService(auditRepository)
+	throttleService := service.NewThrottleService(newAttemptRepository(), auditService, map[string]service.ThrottlePolicy{
+		service.ThrottleScopeUsername: {
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+			Window:          time.Hour,
+		},
+		// Sending a verification link to an email is throttled like logging in to a username
+		service.ThrottleScopeEmail: {
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+			Window:          time.Hour,
+		},
+		// An ip can be shared by many users behind a NAT so it gets more room
+		service.ThrottleScopeIP: {
+			FreeAttempts:    20,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutAfter:    100,
+			LockoutDuration: 30 * time.Minute,
+			Window:          time.Hour,
+		},
+	})
+
+	// 1 user A see the users list B C D E
+	// 2 user A click on a user B
+	// 3 create a conversation between 2 users A - B at that time
+	// 4 user A send a message "hello" to user B
+	//		- frontend send a message to websocket server
+	//		- if user B is online, user B receive a message (websocket message and message to pulling new message)
+	//		- if user B is offline, user B receive a message (websocket message and message to pulling new message)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	broker, presence := newBroker(ctx)
+	hub, err := socket.NewHub(broker, presence, blockService, conversationService, eventService, messageService, accountService, receiptService, settingsService, socket.Config{
+		WriteWait:      getEnvDuration("WS_WRITE_WAIT", 10*time.Second),
+		PongWait:       getEnvDuration("WS_PONG_WAIT", 60*time.Second),
+		PingPeriod:     getEnvDuration("WS_PING_PERIOD", 54*time.Second),
+		MaxMessageSize: int64(getEnvInt("WS_MAX_MESSAGE_SIZE", 2000)),
+		Limits: socket.Limits{
+			Session: map[string]socket.Rate{
+				socket.AnyEvent: {PerSecond: 20, Burst: 40},
+				"sendMessage":   {PerSecond: 5, Burst: 10},
+				"typing":        {PerSecond: 2, Burst: 5},
+				"subscribe":     {PerSecond: 5, Burst: 20},
+				// Every addUser broadcasts to everyone
+				"addUser": {PerSecond: 0.2, Burst: 2},
+			},
+			User: map[string]socket.Rate{
+				"sendMessage": {PerSecond: 10, Burst: 20},
+				"addUser":     {PerSecond: 0.5, Burst: 3},
+			},
+			MaxConnections: getEnvInt("WS_MAX_CONNECTIONS_PER_USER", 10),
+			MaxViolations:  getEnvInt("WS_MAX_VIOLATIONS", 20),
+		},
+		Compression:       getEnv("WS_COMPRESSION", "true") == "true",
+		MessageBufferSize: getEnvInt("WS_MESSAGE_BUFFER_SIZE", 256),
+		MaxBatchWindow:    getEnvDuration("WS_MAX_BATCH_WINDOW", time.Second),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	userHandler := handler.NewUserHandler(userService, accountService, throttleService)
+	accountHandler := handler.NewAccountHandler(accountService, throttleService)
+	conversationHandler := handler.NewConversationHandler(conversationService, userService, messageService, blockService, contactService, settingsService, hub)
+	messageHandler := handler.NewMessageHandler(messageService, conversationService, blockService, receiptService, hub)
+	blockHandler := handler.NewBlockHandler(blockService)
+	contactHandler := handler.NewContactHandler(contactService, hub)
+	searchHandler := handler.NewSearchHandler(searchService)
+	syncHandler := handler.NewSyncHandler(eventService, conversationService, hub, getEnvDuration("SYNC_TIMEOUT", 30*time.Second))
 
 	userApi := api.Group("/users")
 	conversationRoute := api.Group("/conversations")
+	contactRoute := api.Group("/contacts", middleware.AuthMiddleware())
+	searchRoute := api.Group("/search", middleware.AuthMiddleware())
 
 	userApi.GET("", middleware.AuthMiddleware(), userHandler.GetAll)
 	userApi.GET("/me", middleware.AuthMiddleware(), userHandler.GetProfile)
 	userApi.POST("/register", userHandler.Register)
 	userApi.POST("/login", userHandler.Login)
+	userApi.PUT("/me/email", middleware.AuthMiddleware(), accountHandler.ChangeEmail)
+	userApi.POST("/me/email/verification", middleware.AuthMiddleware(), accountHandler.RequestEmailVerification)
+	userApi.POST("/email/verification", accountHandler.ResendEmailVerification)
+	userApi.POST("/verify-email", accountHandler.VerifyEmail)
+	userApi.POST("/password/forgot", accountHandler.ForgotPassword)
+	userApi.POST("/password/reset", accountHandler.ResetPassword)
 	userApi.GET("/conversations", middleware.AuthMiddleware(), conversationHandler.GetAllConversationsByUser)
+	userApi.GET("/me/mentions", middleware.AuthMiddleware(), messageHandler.ListMentions)
+	userApi.GET("/me/blocks", middleware.AuthMiddleware(), blockHandler.ListBlocked)
+	userApi.GET("/me/mutes", middleware.AuthMiddleware(), blockHandler.ListMuted)
+	userApi.POST("/:userId/block", middleware.AuthMiddleware(), blockHandler.Block)
+	userApi.DELETE("/:userId/block", middleware.AuthMiddleware(), blockHandler.Unblock)
+	userApi.POST("/:userId/mute", middleware.AuthMiddleware(), blockHandler.Mute)
+	userApi.DELETE("/:userId/mute", middleware.AuthMiddleware(), blockHandler.Unmute)
+
+	contactRoute.GET("", contactHandler.ListContacts)
+	contactRoute.DELETE("/:userId", contactHandler.RemoveContact)
+	contactRoute.PUT("/settings", contactHandler.UpdateSettings)
+	contactRoute.GET("/requests", contactHandler.ListRequests)
+	contactRoute.POST("/requests", contactHandler.SendRequest)
+	contactRoute.POST("/requests/:requestId/accept", contactHandler.Accept)
+	contactRoute.POST("/requests/:requestId/decline", contactHandler.Decline)
+	contactRoute.POST("/requests/:requestId/cancel", contactHandler.Cancel)
 
-	conversationRoute.POST("", middleware.AuthMiddleware(), conversationHandler.Create)
+	searchRoute.GET("/messages", searchHandler.SearchMessages)
+
+	conversationRoute.POST("", middleware.AuthMiddleware(), middleware.VerifiedMiddleware(accountService), conversationHandler.Create)
 	conversationRoute.POST("/:conversationId/join", middleware.AuthMiddleware(), conversationHandler.Join)
-	conversationRoute.POST("/:conversationId/messages", middleware.AuthMiddleware(), messageHandler.Create)
+	conversationRoute.POST("/:conversationId/messages", middleware.AuthMiddleware(), middleware.VerifiedMiddleware(accountService), messageHandler.Create)
 	conversationRoute.GET("/:conversationId/messages", middleware.AuthMiddleware(), messageHandler.ListMessagesByConversation)
 	conversationRoute.GET("/:conversationId/messages/pagination", middleware.AuthMiddleware(), messageHandler.ListMessagesByConversationPagination)
+	conversationRoute.GET("/:conversationId/messages/:messageId/receipts", middleware.AuthMiddleware(), messageHandler.ListReceipts)
+	conversationRoute.POST("/:conversationId/read", middleware.AuthMiddleware(), messageHandler.MarkRead)
+	conversationRoute.GET("/:conversationId/pins", middleware.AuthMiddleware(), messageHandler.ListPinnedMessages)
+	conversationRoute.POST("/:conversationId/messages/:messageId/pin", middleware.AuthMiddleware(), messageHandler.PinMessage)
+	conversationRoute.DELETE("/:conversationId/messages/:messageId/pin", middleware.AuthMiddleware(), messageHandler.UnpinMessage)
+	conversationRoute.POST("/:conversationId/pin", middleware.AuthMiddleware(), conversationHandler.Pin)
+	conversationRoute.DELETE("/:conversationId/pin", middleware.AuthMiddleware(), conversationHandler.Unpin)
+	conversationRoute.POST("/:conversationId/archive", middleware.AuthMiddleware(), conversationHandler.Archive)
+	conversationRoute.DELETE("/:conversationId/archive", middleware.AuthMiddleware(), conversationHandler.Unarchive)
+	conversationRoute.GET("/:conversationId/settings", middleware.AuthMiddleware(), conversationHandler.GetSettings)
+	conversationRoute.PUT("/:conversationId/settings", middleware.AuthMiddleware(), conversationHandler.UpdateSettings)
 
-	// 1 user A see the users list B C D E
-	// 2 user A click on a user B
-	// 3 create a conversation between 2 users A - B at that time
-	// 4 user A send a message "hello" to user B
-	//		- frontend send a message to websocket server
-	//		- if user B is online, user B receive a message (websocket message and message to pulling new message)
-	//		- if user B is offline, user B receive a message (websocket message and message to pulling new message)
-	m := melody.New()
-	m.Config.MaxMessageSize = 2000
-	m.Upgrader.CheckOrigin = func(r *http.Request) bool { return true } // origni check
-	r.GET("/ws", func(c *gin.Context) {
-		m.HandleRequest(c.Writer, c.Request)
-	})
-
-	m.HandleMessage(func(s *melody.Session, msg []byte) {
-		fmt.Println(s.Request.URL.Query().Get("userId"), string(msg))
-		var message SocketMessage
-		json.Unmarshal(msg, &message)
-
-		switch message.Event {
-		case "addUser":
-			socketUsers := []string{}
-			sessions, _ := m.Sessions()
-			for _, session := range sessions {
-				userID := session.Request.URL.Query().Get("userId")
-				if userID != "" {
-					socketUsers = append(socketUsers, userID)
-				}
-			}
+	r.GET("/ws", hub.HandleRequest)
+	r.GET("/ws/schema", hub.ServeSchema)
+	api.GET("/events", middleware.QueryAuthMiddleware(), hub.ServeEvents)
+	api.GET("/sync", middleware.AuthMiddleware(), syncHandler.Sync)
 
-			bmsg := SocketMessage{
-				Event:   "getUsers",
-				Message: socketUsers,
-			}
-
-			b, _ := json.Marshal(bmsg)
-			m.BroadcastFilter(b, func(q *melody.Session) bool {
-				return q != s
-			})
-		case "sendMessage":
-			var data SocketData
-			_ = mapstructure.Decode(message.Message, &data)
-
-			bmsg := SocketMessage{
-				Event: "getMessage",
-				Message: model.Message{
-					ID:             primitive.NewObjectID(),
-					ConversationID: data.ConversationID,
-					Sender:         data.SenderID,
-					Text:           data.Text,
-					CreateAt:       time.Now(),
-				},
-			}
-
-			b, _ := json.Marshal(bmsg)
-			m.BroadcastFilter(b, func(q *melody.Session) bool {
-				return q.Request.URL.Query().Get("userId") == data.RecipientID
-			})
+	server := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
 		}
-	})
+	}()
 
-	m.HandleDisconnect(func(s *melody.Session) {
-		fmt.Println("disconnect")
-		s.UnSet("data")
-	})
+	// The metrics are served on their own address, it is only reachable from the host unless DEBUG_ADDR says otherwise
+	debug := http.NewServeMux()
+	debug.Handle("/debug/vars", expvar.Handler())
+	debugServer := &http.Server{Addr: getEnv("DEBUG_ADDR", "localhost:6060"), Handler: debug}
+	go func() {
+		if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("debug:", err)
+		}
+	}()
 
-	r.Run(":8080")
-}
+	<-ctx.Done()
+	log.Println("shutting down")
 
-type SocketUser struct {
-	ID   string `json:"id"`
-	UUID string `json:"uuid"`
-}
-
-type SocketMessage struct {
-	Event   string      `json:"event"`
-	Message interface{} `json:"message"`
-}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("server:", err)
+	}
+	if err := debugServer.Shutdown(shutdownCtx); err != nil {
+		log.Println("debug:", err)
+	}
 
-type SocketData struct {
-	ConversationID string `json:"conversationId"`
-	SenderID       string `json:"senderId"`
-	RecipientID    string `json:"recipientId"`
-	Text           string `json:"text"`
+	// The users of this node go offline for the other nodes
+	if err := presence.Close(); err != nil {
+		log.Println("presence:", err)
+	}
+	if err := broker.Close(); err != nil {
+		log.Println("broker:", err)
+	}
 }
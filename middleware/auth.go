@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"os"
 	"strings"
@@ -9,46 +10,36 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
+var ErrInvalidToken = errors.New("invalid token")
+
 func AuthMiddleware() gin.HandlerFunc {
+	return authenticate(false)
+}
+
+// QueryAuthMiddleware authenticates like AuthMiddleware and also accepts the token query parameter,
+// for clients such as EventSource that cannot set the Authorization header
+func QueryAuthMiddleware() gin.HandlerFunc {
+	return authenticate(true)
+}
+
+func authenticate(query bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get the Authorization header from the request
 		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			c.Abort()
-			return
-		}
 
 		// Extract the JWT token from the Authorization header
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-
-		// Parse the JWT token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Provide the secret key used for signing the token
-			return []byte(os.Getenv("JWT_SECRET")), nil // Replace with your own secret key
-		})
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
+		if tokenString == "" && query {
+			tokenString = c.Query("token")
 		}
-
-		// Verify the token's signature and expiration
-		if !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if tokenString == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
-		// Set the user ID in the context for further processing
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
-		userID, ok := claims["userId"].(string)
-		if !ok {
+		userID, err := ParseToken(tokenString)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
@@ -59,3 +50,36 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// ParseToken verifies a JWT token and returns the user ID it was issued for
+func ParseToken(tokenString string) (string, error) {
+	// Parse the JWT token
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+
+		// Provide the secret key used for signing the token
+		return []byte(os.Getenv("JWT_SECRET")), nil // Replace with your own secret key
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Verify the token's signature and expiration
+	if !token.Valid {
+		return "", ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", ErrInvalidToken
+	}
+
+	userID, ok := claims["userId"].(string)
+	if !ok {
+		return "", ErrInvalidToken
+	}
+
+	return userID, nil
+}
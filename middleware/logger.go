@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedParams are query parameters that carry credentials, their values are not logged
+var redactedParams = []string{"token"}
+
+// LoggerMiddleware logs requests like gin.Logger but without the credentials in their query,
+// the websocket and the event stream take the token as a query parameter
+func LoggerMiddleware() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		param.Path = redactPath(param.Path)
+
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			param.Path,
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactPath replaces the values of the redacted parameters in the query of a path
+func redactPath(path string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return path
+	}
+
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		// A query that cannot be parsed could hide a token anywhere
+		return path[:i] + "?REDACTED"
+	}
+
+	redacted := false
+	for _, param := range redactedParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return path
+	}
+	return path[:i] + "?" + query.Encode()
+}
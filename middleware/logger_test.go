@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoggerMiddlewareRedactsToken(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	var out bytes.Buffer
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = &out
+	defer func() { gin.DefaultWriter = defaultWriter }()
+
+	r := gin.New()
+	r.Use(LoggerMiddleware())
+	r.GET("/ws", func(c *gin.Context) {})
+	r.GET("/api/events", func(c *gin.Context) {})
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "/ws?token=secret.jwt.value&version=2", want: `"/ws?token=REDACTED&version=2"`},
+		{url: "/ws?version=2", want: `"/ws?version=2"`},
+		{url: "/ws?version=2&token=secret.jwt.value&token=other", want: `"/ws?token=REDACTED&version=2"`},
+		{url: "/ws?token=secret.jwt.value;%zz", want: `"/ws?REDACTED"`},
+		{url: "/api/events?token=secret.jwt.value", want: `"/api/events?token=REDACTED"`},
+		{url: "/api/events?lastEventId=7&token=secret.jwt.value", want: `"/api/events?lastEventId=7&token=REDACTED"`},
+	}
+
+	for _, test := range tests {
+		out.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.url, nil))
+
+		logged := out.String()
+		if strings.Contains(logged, "secret") || !strings.Contains(logged, test.want) {
+			t.Errorf("%s: logged %q, want %s", test.url, logged, test.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+)
+
+// VerifiedMiddleware rejects users that the unverified account policy does not allow to send messages.
+// It must run after AuthMiddleware.
+func VerifiedMiddleware(accountService service.IAccountService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, err := accountService.CanSendMessages(c, c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Email not verified"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
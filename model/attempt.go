@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// LoginAttempt tracks the failed attempts of a throttling key such as a username or an ip.
+// An attempt counts as a failure from the moment it starts until it is forgiven.
+type LoginAttempt struct {
+	Key         string    `bson:"_id" json:"key"`
+	Failures    int       `bson:"failures" json:"failures"`
+	LastFailure time.Time `bson:"lastFailure" json:"lastFailure"`
+	ExpireAt    time.Time `bson:"expireAt" json:"expireAt"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AuditLockout = "lockout"
+)
+
+// AuditEvent is a security relevant event kept for later review
+type AuditEvent struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type     string             `bson:"type" json:"type"`
+	Subject  string             `bson:"subject" json:"subject"`
+	Detail   map[string]string  `bson:"detail,omitempty" json:"detail,omitempty"`
+	CreateAt time.Time          `bson:"createAt" json:"createAt"`
+}
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ContactRequestPending   = "pending"
+	ContactRequestAccepted  = "accepted"
+	ContactRequestDeclined  = "declined"
+	ContactRequestCancelled = "cancelled"
+)
+
+type ContactRequest struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	From     string             `bson:"from" json:"from"`
+	To       string             `bson:"to" json:"to"`
+	Status   string             `bson:"status" json:"status"`
+	CreateAt time.Time          `bson:"createAt" json:"createAt"`
+	UpdateAt time.Time          `bson:"updateAt" json:"updateAt"`
+}
@@ -10,4 +10,77 @@ type Conversation struct {
 	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	Members  []User             `bson:"members" json:"members"`
 	CreateAt *time.Time         `bson:"createAt" json:"createAt"`
+
+	// Sequence number of the latest message, messages are numbered from 1 and a write that fails or a retry that loses to a concurrent one leaves a gap
+	LastSeq int64 `bson:"lastSeq" json:"lastSeq"`
+
+	// Copy of the latest message and its creation time, kept up to date when messages are written so lists take one query
+	LastMessage    *Message   `bson:"lastMessage,omitempty" json:"lastMessage,omitempty"`
+	LastActivityAt *time.Time `bson:"lastActivityAt,omitempty" json:"lastActivityAt,omitempty"`
+
+	// Messages pinned for every member, oldest pin first
+	PinnedMessages []PinnedMessage `bson:"pinnedMessages,omitempty" json:"pinnedMessages,omitempty"`
+
+	// Members who pinned or archived the conversation in their own list, the others must not see it
+	PinnedBy   []string `bson:"pinnedBy,omitempty" json:"-"`
+	ArchivedBy []string `bson:"archivedBy,omitempty" json:"-"`
+}
+
+// PinnedMessage is a message pinned in a conversation
+type PinnedMessage struct {
+	MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+	PinnedBy  string             `bson:"pinnedBy" json:"pinnedBy"`
+	PinnedAt  time.Time          `bson:"pinnedAt" json:"pinnedAt"`
+}
+
+// HasMember checks whether a user is a member of the conversation
+func (c *Conversation) HasMember(userID string) bool {
+	for _, member := range c.Members {
+		if member.ID.Hex() == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Recipient returns the other member of a direct conversation, or nil for group conversations
+func (c *Conversation) Recipient(userID string) *User {
+	if len(c.Members) != 2 {
+		return nil
+	}
+
+	if c.Members[0].ID.Hex() == userID {
+		return &c.Members[1]
+	}
+	return &c.Members[0]
+}
+
+// IsPinnedBy checks whether a member pinned the conversation in their list
+func (c *Conversation) IsPinnedBy(userID string) bool {
+	return containsString(c.PinnedBy, userID)
+}
+
+// IsArchivedBy checks whether a member archived the conversation
+func (c *Conversation) IsArchivedBy(userID string) bool {
+	return containsString(c.ArchivedBy, userID)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ActivityAt returns the time of the latest message, or the creation time of a conversation without messages
+func (c *Conversation) ActivityAt() time.Time {
+	if c.LastActivityAt != nil {
+		return *c.LastActivityAt
+	}
+	if c.CreateAt != nil {
+		return *c.CreateAt
+	}
+	return time.Time{}
 }
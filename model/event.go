@@ -0,0 +1,30 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserEvent is a socket event kept in the log of a user so it can be replayed after a reconnect
+type UserEvent struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID   string             `bson:"userId" json:"userId"`
+	Seq      int64              `bson:"seq" json:"seq"`
+	Event    string             `bson:"event" json:"event"`
+	Message  json.RawMessage    `bson:"message" json:"message"`
+	CreateAt time.Time          `bson:"createAt" json:"createAt"`
+	ExpireAt time.Time          `bson:"expireAt" json:"-"`
+}
+
+// EventCursor is the position of a user in their event log
+type EventCursor struct {
+	UserID string `bson:"_id" json:"userId"`
+
+	// Sequence number of the latest event of the user
+	Seq int64 `bson:"seq" json:"seq"`
+
+	// Sequence number of the latest event acknowledged by a client of the user
+	Acked int64 `bson:"acked" json:"acked"`
+}
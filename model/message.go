@@ -11,5 +11,17 @@ type Message struct {
 	ConversationID string             `bson:"conversationId" json:"conversationId"`
 	Sender         string             `bson:"sender" json:"sender"`
 	Text           string             `bson:"text" json:"text"`
+	Seq            int64              `bson:"seq" json:"seq"`
 	CreateAt       time.Time          `bson:"createAt" json:"createAt"`
+
+	// Id chosen by the sending client so a retried send returns the stored message instead of a duplicate
+	ClientMessageID string `bson:"clientMessageId,omitempty" json:"clientMessageId,omitempty"`
+
+	// Ids of the members mentioned with @username in the text, resolved when the message is written
+	Mentions []string `bson:"mentions,omitempty" json:"mentions,omitempty"`
+}
+
+// IsMentioned checks whether the message mentions a user
+func (m *Message) IsMentioned(userID string) bool {
+	return containsString(m.Mentions, userID)
 }
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// Receipt tracks the delivery of a message to one of its recipients
+type Receipt struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MessageID      primitive.ObjectID `bson:"messageId" json:"messageId"`
+	ConversationID string             `bson:"conversationId" json:"conversationId"`
+	Sender         string             `bson:"sender" json:"sender"`
+	UserID         string             `bson:"userId" json:"userId"`
+	Seq            int64              `bson:"seq" json:"seq"`
+	DeliveredAt    *time.Time         `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+	ReadAt         *time.Time         `bson:"readAt,omitempty" json:"readAt,omitempty"`
+	CreateAt       time.Time          `bson:"createAt" json:"createAt"`
+}
+
+// Status returns how far the message got with the recipient
+func (r *Receipt) Status() string {
+	switch {
+	case r.ReadAt != nil:
+		return MessageStatusRead
+	case r.DeliveredAt != nil:
+		return MessageStatusDelivered
+	default:
+		return MessageStatusSent
+	}
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyNone     = "none"
+)
+
+// ConversationSettings are the settings of one member for a conversation, the other members do not see them
+type ConversationSettings struct {
+	UserID         string `bson:"userId" json:"-"`
+	ConversationID string `bson:"conversationId" json:"conversationId"`
+
+	// A muted conversation sends no notifications until MutedUntil, or until it is unmuted when MutedUntil is nil
+	Muted      bool       `bson:"muted" json:"muted"`
+	MutedUntil *time.Time `bson:"mutedUntil,omitempty" json:"mutedUntil,omitempty"`
+
+	// Which messages notify the member, one of all, mentions or none
+	NotifyLevel string `bson:"notifyLevel" json:"notifyLevel"`
+
+	// Name of the conversation in the list of the member, empty keeps the default
+	Nickname string `bson:"nickname,omitempty" json:"nickname"`
+
+	UpdateAt *time.Time `bson:"updateAt,omitempty" json:"updateAt,omitempty"`
+}
+
+// DefaultConversationSettings returns the settings of a member who never changed them
+func DefaultConversationSettings(userID string, conversationID string) *ConversationSettings {
+	return &ConversationSettings{
+		UserID:         userID,
+		ConversationID: conversationID,
+		NotifyLevel:    NotifyAll,
+	}
+}
+
+// IsMuted checks whether the conversation is muted at a given time
+func (s *ConversationSettings) IsMuted(at time.Time) bool {
+	return s.Muted && (s.MutedUntil == nil || at.Before(*s.MutedUntil))
+}
+
+// Notifies checks whether a message notifies the member at a given time.
+// Mentions notify the member even while the conversation is muted, unless they turned notifications off entirely.
+func (s *ConversationSettings) Notifies(at time.Time, mentioned bool) bool {
+	switch s.NotifyLevel {
+	case NotifyNone:
+		return false
+	case NotifyMentions:
+		return mentioned
+	default:
+		return mentioned || !s.IsMuted(at)
+	}
+}
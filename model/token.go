@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is the server side record of a single-use account token.
+// The token handed to the user is signed and only carries the record id.
+type UserToken struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID   primitive.ObjectID `bson:"userId" json:"userId"`
+	Purpose  string             `bson:"purpose" json:"purpose"`
+	Email    string             `bson:"email" json:"email"`
+	ExpireAt time.Time          `bson:"expireAt" json:"expireAt"`
+	CreateAt time.Time          `bson:"createAt" json:"createAt"`
+}
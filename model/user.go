@@ -9,8 +9,26 @@ import (
 type User struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	Username       string             `bson:"username" json:"username"`
+	DisplayName    string             `bson:"displayName" json:"displayName"`
 	Password       string             `bson:"password" json:"-"`
+	Email          string             `bson:"email,omitempty" json:"email,omitempty"`
+	EmailVerified  bool               `bson:"emailVerified" json:"emailVerified"`
 	ProfilePicture string             `bson:"profilePicture" json:"profilePicture"`
 	CreateAt       *time.Time         `bson:"createAt" json:"createAt"`
 	UpdateAt       *time.Time         `bson:"updateAt" json:"updateAt"`
+	SearchTerms    []string           `bson:"searchTerms,omitempty" json:"-"`
+	BlockedUsers   []string           `bson:"blockedUsers,omitempty" json:"-"`
+	MutedUsers     []string           `bson:"mutedUsers,omitempty" json:"-"`
+	Contacts       []string           `bson:"contacts,omitempty" json:"-"`
+	DMContactsOnly bool               `bson:"dmContactsOnly" json:"dmContactsOnly"`
+}
+
+// HasContact checks whether a user is a contact of the user
+func (u *User) HasContact(userID string) bool {
+	for _, contact := range u.Contacts {
+		if contact == userID {
+			return true
+		}
+	}
+	return false
 }
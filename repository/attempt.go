@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IAttemptRepository interface {
+	// Find the attempts of a key, it returns nil when the key has no failed attempts
+	Find(ctx context.Context, key string) (*model.LoginAttempt, error)
+
+	// Claim an attempt of a key that still has the given number of failures, the attempt counts as a failure.
+	// It returns nil when another attempt of the key was recorded first. The attempts are forgotten after ttl.
+	Claim(ctx context.Context, key string, failures int, ttl time.Duration) (*model.LoginAttempt, error)
+
+	// Forgive the last attempt of a key, it no longer counts as a failure
+	Forgive(ctx context.Context, key string) error
+
+	// Reset the attempts of a key
+	Reset(ctx context.Context, key string) error
+}
+
+// AttemptRepository is a repository for login attempts
+type AttemptRepository struct {
+	collection *mongo.Collection
+}
+
+// NewAttemptRepository creates a new login attempt repository
+func NewAttemptRepository(db *mongo.Database) *AttemptRepository {
+	return &AttemptRepository{
+		collection: db.Collection("login_attempts"),
+	}
+}
+
+// Find the attempts of a key, it returns nil when the key has no failed attempts
+func (r *AttemptRepository) Find(ctx context.Context, key string) (*model.LoginAttempt, error) {
+	var attempt model.LoginAttempt
+	filter := bson.M{"_id": key, "expireAt": bson.M{"$gt": time.Now()}}
+	if err := r.collection.FindOne(ctx, filter).Decode(&attempt); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// Claim an attempt of a key that still has the given number of failures, the attempt counts as a failure.
+// It returns nil when another attempt of the key was recorded first. The attempts are forgotten after ttl.
+func (r *AttemptRepository) Claim(ctx context.Context, key string, failures int, ttl time.Duration) (*model.LoginAttempt, error) {
+	now := time.Now()
+
+	// Attempts past their expiry may still be waiting for the TTL monitor
+	if _, err := r.collection.DeleteOne(ctx, bson.M{"_id": key, "expireAt": bson.M{"$lte": now}}); err != nil {
+		return nil, err
+	}
+
+	// The failures in the filter make checking and counting the attempt a single operation,
+	// a key without failures is inserted and a concurrent insert fails on the _id
+	var attempt model.LoginAttempt
+	filter := bson.M{"_id": key, "failures": failures}
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"lastFailure": now, "expireAt": now.Add(ttl)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(failures == 0).SetReturnDocument(options.After)
+	if err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&attempt); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) || mongo.IsDuplicateKeyError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// Forgive the last attempt of a key, it no longer counts as a failure
+func (r *AttemptRepository) Forgive(ctx context.Context, key string) error {
+	filter := bson.M{"_id": key, "failures": bson.M{"$gt": 0}}
+	_, err := r.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"failures": -1}})
+	return err
+}
+
+// Reset the attempts of a key
+func (r *AttemptRepository) Reset(ctx context.Context, key string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// Ensure the indexes of the collection
+func (r *AttemptRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// MemoryAttemptRepository is an in-memory repository for login attempts, it is not shared between instances
+type MemoryAttemptRepository struct {
+	mu        sync.Mutex
+	attempts  map[string]*model.LoginAttempt
+	lastSweep time.Time
+}
+
+// NewMemoryAttemptRepository creates a new in-memory login attempt repository
+func NewMemoryAttemptRepository() *MemoryAttemptRepository {
+	return &MemoryAttemptRepository{
+		attempts: map[string]*model.LoginAttempt{},
+	}
+}
+
+// Find the attempts of a key, it returns nil when the key has no failed attempts
+func (r *MemoryAttemptRepository) Find(ctx context.Context, key string) (*model.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt := r.find(key, time.Now())
+	if attempt == nil {
+		return nil, nil
+	}
+
+	found := *attempt
+	return &found, nil
+}
+
+// Claim an attempt of a key that still has the given number of failures, the attempt counts as a failure.
+// It returns nil when another attempt of the key was recorded first. The attempts are forgotten after ttl.
+func (r *MemoryAttemptRepository) Claim(ctx context.Context, key string, failures int, ttl time.Duration) (*model.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	attempt := r.find(key, now)
+	if attempt == nil {
+		attempt = &model.LoginAttempt{Key: key}
+	}
+	if attempt.Failures != failures {
+		return nil, nil
+	}
+
+	attempt.Failures++
+	attempt.LastFailure = now
+	attempt.ExpireAt = now.Add(ttl)
+	r.attempts[key] = attempt
+
+	claimed := *attempt
+	return &claimed, nil
+}
+
+// Forgive the last attempt of a key, it no longer counts as a failure
+func (r *MemoryAttemptRepository) Forgive(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if attempt := r.find(key, time.Now()); attempt != nil && attempt.Failures > 0 {
+		attempt.Failures--
+	}
+	return nil
+}
+
+// Reset the attempts of a key
+func (r *MemoryAttemptRepository) Reset(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, key)
+	return nil
+}
+
+func (r *MemoryAttemptRepository) find(key string, now time.Time) *model.LoginAttempt {
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return nil
+	}
+
+	if !attempt.ExpireAt.After(now) {
+		delete(r.attempts, key)
+		return nil
+	}
+	return attempt
+}
+
+// sweep drops expired attempts at most once a minute so keys that are never seen again do not pile up
+func (r *MemoryAttemptRepository) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+
+	r.lastSweep = now
+	for key, attempt := range r.attempts {
+		if !attempt.ExpireAt.After(now) {
+			delete(r.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testAttemptRepository runs the behaviour every attempt repository shares
+func testAttemptRepository(t *testing.T, r IAttemptRepository) {
+	ctx := context.Background()
+
+	attempt, err := r.Find(ctx, "username:alice")
+	if err != nil || attempt != nil {
+		t.Fatalf("Find of an unknown key = %v, %v, want nil", attempt, err)
+	}
+
+	// A claim on a stale count is refused
+	if attempt, err := r.Claim(ctx, "username:alice", 1, time.Hour); err != nil || attempt != nil {
+		t.Fatalf("Claim with a stale count = %v, %v, want nil", attempt, err)
+	}
+
+	for want := 1; want <= 3; want++ {
+		attempt, err := r.Claim(ctx, "username:alice", want-1, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt == nil || attempt.Failures != want {
+			t.Fatalf("Claim %d = %+v, want %d failures", want, attempt, want)
+		}
+	}
+
+	if err := r.Forgive(ctx, "username:alice"); err != nil {
+		t.Fatal(err)
+	}
+	attempt, err = r.Find(ctx, "username:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt == nil || attempt.Failures != 2 {
+		t.Fatalf("Find after Forgive = %+v, want 2 failures", attempt)
+	}
+
+	if err := r.Reset(ctx, "username:alice"); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, err := r.Find(ctx, "username:alice"); err != nil || attempt != nil {
+		t.Fatalf("Find after Reset = %v, %v, want nil", attempt, err)
+	}
+
+	// Expired attempts are forgotten
+	if _, err := r.Claim(ctx, "ip:10.0.0.1", 0, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, err := r.Find(ctx, "ip:10.0.0.1"); err != nil || attempt != nil {
+		t.Fatalf("Find of an expired key = %v, %v, want nil", attempt, err)
+	}
+	attempt, err = r.Claim(ctx, "ip:10.0.0.1", 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt == nil || attempt.Failures != 1 {
+		t.Fatalf("Claim of an expired key = %+v, want 1 failure", attempt)
+	}
+
+	// Only one of concurrent claims on the same count is recorded
+	var claimed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, err := r.Claim(ctx, "username:bob", 0, time.Hour)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if attempt != nil {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Fatalf("%d concurrent claims were recorded, want 1", claimed)
+	}
+}
+
+func TestMemoryAttemptRepository(t *testing.T) {
+	testAttemptRepository(t, NewMemoryAttemptRepository())
+}
+
+// TestAttemptRepository needs a MongoDB server, it is skipped unless MONGODB_TEST_URI is set
+func TestAttemptRepository(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database("chat_app_test")
+	r := NewAttemptRepository(db)
+	if _, err := r.collection.DeleteMany(ctx, bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.collection.Drop(ctx)
+
+	testAttemptRepository(t, r)
+}
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type IAuditRepository interface {
+	// Create a new audit event
+	Create(ctx context.Context, event *model.AuditEvent) error
+}
+
+// AuditRepository is a repository for audit events
+type AuditRepository struct {
+	collection *mongo.Collection
+}
+
+// NewAuditRepository creates a new audit repository
+func NewAuditRepository(db *mongo.Database) *AuditRepository {
+	return &AuditRepository{
+		collection: db.Collection("audit_logs"),
+	}
+}
+
+// Create a new audit event
+func (r *AuditRepository) Create(ctx context.Context, event *model.AuditEvent) error {
+	event.CreateAt = time.Now()
+	_, err := r.collection.InsertOne(ctx, event)
+	return err
+}
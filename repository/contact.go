@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrDuplicateContactRequest = errors.New("duplicate contact request")
+
+type IContactRepository interface {
+	// Create a new contact request
+	Create(ctx context.Context, request *model.ContactRequest) error
+
+	// Find a contact request by id
+	FindByID(ctx context.Context, id string) (*model.ContactRequest, error)
+
+	// Find the pending request from a user to another user
+	FindPending(ctx context.Context, from string, to string) (*model.ContactRequest, error)
+
+	// Find the pending requests sent to a user, or sent by a user when outgoing is true
+	FindPendingByUser(ctx context.Context, userID string, outgoing bool) ([]*model.ContactRequest, error)
+
+	// Move a pending request to a new status, it fails with mongo.ErrNoDocuments when the request is not pending
+	Resolve(ctx context.Context, id string, status string) (*model.ContactRequest, error)
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// ContactRepository is a repository for contact requests
+type ContactRepository struct {
+	collection *mongo.Collection
+}
+
+// NewContactRepository creates a new contact request repository
+func NewContactRepository(db *mongo.Database) *ContactRepository {
+	return &ContactRepository{
+		collection: db.Collection("contact_requests"),
+	}
+}
+
+// Create a new contact request
+func (r *ContactRepository) Create(ctx context.Context, request *model.ContactRequest) error {
+	now := time.Now()
+	request.Status = model.ContactRequestPending
+	request.CreateAt = now
+	request.UpdateAt = now
+
+	res, err := r.collection.InsertOne(ctx, request)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateContactRequest
+		}
+		return err
+	}
+
+	if newID, ok := res.InsertedID.(primitive.ObjectID); ok {
+		request.ID = newID
+	}
+	return nil
+}
+
+// Find a contact request by id
+func (r *ContactRepository) FindByID(ctx context.Context, id string) (*model.ContactRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var request model.ContactRequest
+	if err := r.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// Find the pending request from a user to another user
+func (r *ContactRepository) FindPending(ctx context.Context, from string, to string) (*model.ContactRequest, error) {
+	var request model.ContactRequest
+	filter := bson.M{"from": from, "to": to, "status": model.ContactRequestPending}
+	if err := r.collection.FindOne(ctx, filter).Decode(&request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// Find the pending requests sent to a user, or sent by a user when outgoing is true
+func (r *ContactRepository) FindPendingByUser(ctx context.Context, userID string, outgoing bool) ([]*model.ContactRequest, error) {
+	field := "to"
+	if outgoing {
+		field = "from"
+	}
+
+	filter := bson.M{field: userID, "status": model.ContactRequestPending}
+	opts := options.Find().SetSort(bson.D{{Key: "createAt", Value: -1}})
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := []*model.ContactRequest{}
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// Move a pending request to a new status, it fails with mongo.ErrNoDocuments when the request is not pending
+func (r *ContactRepository) Resolve(ctx context.Context, id string, status string) (*model.ContactRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var request model.ContactRequest
+	filter := bson.M{"_id": objectID, "status": model.ContactRequestPending}
+	update := bson.M{"$set": bson.M{"status": status, "updateAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// Ensure the indexes of the collection
+func (r *ContactRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// Only one pending request per direction
+			Keys: bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": model.ContactRequestPending}),
+		},
+		{
+			Keys: bson.D{{Key: "to", Value: 1}, {Key: "status", Value: 1}, {Key: "createAt", Value: -1}},
+		},
+	})
+	return err
+}
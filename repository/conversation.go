@@ -20,19 +20,54 @@ type IConversationRepository interface {
 	// Find a conversation by user id
 	FindByUserID(ctx context.Context, userID string) ([]*model.Conversation, error)
 
-	// Find a conversation by user id pagination
-	FindByUserIDPagination(ctx context.Context, userID string, page int64, limit int64) ([]*model.Conversation, error)
+	// Find a page of the conversations of a user, the ones they pinned first and then by latest activity
+	FindByUserIDPagination(ctx context.Context, userID string, archived bool, after *ConversationCursor, limit int64) ([]*model.Conversation, error)
 
 	// Find a conversation by id
 	FindByID(ctx context.Context, id string) (*model.Conversation, error)
 
-	// Join a conversation
-	Join(ctx context.Context, conversationID string, userID string) error
+	// Add a member to a conversation, it returns false when the user was already a member
+	Join(ctx context.Context, conversationID string, member *model.User) (bool, error)
 
 	// Find a conversation by pair of user id
 	FindByPair(ctx context.Context, userID string, recipientID string) (*model.Conversation, error)
+
+	// Reserve the next message sequence number of a conversation
+	NextSeq(ctx context.Context, conversationID string) (int64, error)
+
+	// Pin or unpin a conversation in the list of a member
+	SetPinned(ctx context.Context, conversationID string, userID string, pinned bool) error
+
+	// Archive or unarchive a conversation for a member
+	SetArchived(ctx context.Context, conversationID string, userID string, archived bool) error
+
+	// Pin a message unless the conversation already has limit pinned messages, it returns false when the message was already pinned
+	PinMessage(ctx context.Context, conversationID string, pin model.PinnedMessage, limit int) (bool, error)
+
+	// Unpin a message, it returns false when the message was not pinned
+	UnpinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID) (bool, error)
+
+	// Set the latest message of a conversation unless a later one is already set
+	SetLastMessage(ctx context.Context, message *model.Message) error
+
+	// Set the latest message of the conversations written before it was kept on them
+	BackfillLastMessages(ctx context.Context) error
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// ConversationCursor is the position of the last conversation of a page in the list of a user
+type ConversationCursor struct {
+	Pinned     bool               `json:"p"`
+	ActivityAt time.Time          `json:"a"`
+	ID         primitive.ObjectID `json:"i"`
 }
 
+var (
+	ErrPinLimit = errors.New("pinned message limit reached")
+)
+
 // ConversationRepository is a repository for conversation
 type ConversationRepository struct {
 	collection *mongo.Collection
@@ -49,6 +84,7 @@ func NewConversationRepository(db *mongo.Database) *ConversationRepository {
 func (r *ConversationRepository) Create(ctx context.Context, conversation *model.Conversation) (*model.Conversation, error) {
 	now := time.Now()
 	conversation.CreateAt = &now
+	conversation.LastActivityAt = &now
 
 	res, err := r.collection.InsertOne(ctx, conversation)
 	if err != nil {
@@ -89,28 +125,59 @@ func (r *ConversationRepository) FindByUserID(ctx context.Context, userID string
 	return conversations, nil
 }
 
-// Find a conversation by user id pagination
-func (r *ConversationRepository) FindByUserIDPagination(ctx context.Context, userID string, page int64, limit int64) ([]*model.Conversation, error) {
-	var conversations []*model.Conversation
-	id, _ := primitive.ObjectIDFromHex(userID)
-	filter := bson.M{
-		"members": bson.M{
-			"$elemMatch": bson.M{
-				"_id": bson.M{
-					"$in": []primitive.ObjectID{id},
-				},
-			},
-		},
+// Find a page of the conversations of a user, the ones they pinned first and then by latest activity.
+// Archived conversations are listed on their own, a page starts after the cursor when it is set.
+// Pinned and other conversations are read by separate queries sorted on the stored activity so the indexes serve the sort.
+func (r *ConversationRepository) FindByUserIDPagination(ctx context.Context, userID string, archived bool, after *ConversationCursor, limit int64) ([]*model.Conversation, error) {
+	conversations := []*model.Conversation{}
+
+	// Past the pinned conversations only the others are left
+	if after == nil || after.Pinned {
+		pinned, err := r.findPage(ctx, userID, archived, true, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, pinned...)
+		after = nil
 	}
 
-	opts := &options.FindOptions{
-		Skip:  &page,
-		Limit: &limit,
-		Sort: bson.M{
-			"created_at": -1,
-		},
+	if rest := limit - int64(len(conversations)); rest > 0 {
+		others, err := r.findPage(ctx, userID, archived, false, after, rest)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, others...)
+	}
+
+	return conversations, nil
+}
+
+// findPage finds the pinned or other conversations of a user by latest activity, after the cursor when it is set
+func (r *ConversationRepository) findPage(ctx context.Context, userID string, archived bool, pinned bool, after *ConversationCursor, limit int64) ([]*model.Conversation, error) {
+	conversations := []*model.Conversation{}
+	id, _ := primitive.ObjectIDFromHex(userID)
+
+	filter := bson.M{"members._id": id}
+	if archived {
+		filter["archivedBy"] = userID
+	} else {
+		filter["archivedBy"] = bson.M{"$ne": userID}
+	}
+	if pinned {
+		filter["pinnedBy"] = userID
+	} else {
+		filter["pinnedBy"] = bson.M{"$ne": userID}
+	}
+	if after != nil {
+		filter["$or"] = bson.A{
+			bson.M{"lastActivityAt": bson.M{"$lt": after.ActivityAt}},
+			bson.M{"lastActivityAt": after.ActivityAt, "_id": bson.M{"$lt": after.ID}},
+		}
 	}
 
+	opts := options.Find().
+		SetSort(bson.D{{Key: "lastActivityAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(limit)
 	cursor, err := r.collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
@@ -126,8 +193,13 @@ func (r *ConversationRepository) FindByUserIDPagination(ctx context.Context, use
 // Find a conversation by id
 func (r *ConversationRepository) FindByID(ctx context.Context, id string) (*model.Conversation, error) {
 	var conversation *model.Conversation
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
 	filter := bson.M{
-		"_id": id,
+		"_id": objectID,
 	}
 	if err := r.collection.FindOne(ctx, filter).Decode(&conversation); err != nil {
 		return nil, err
@@ -136,18 +208,28 @@ func (r *ConversationRepository) FindByID(ctx context.Context, id string) (*mode
 	return conversation, nil
 }
 
-// Join a conversation
-func (r *ConversationRepository) Join(ctx context.Context, conversationID string, userID string) error {
+// Add a member to a conversation, it returns false when the user was already a member
+func (r *ConversationRepository) Join(ctx context.Context, conversationID string, member *model.User) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return false, err
+	}
+
 	filter := bson.M{
-		"_id": conversationID,
+		"_id":         objectID,
+		"members._id": bson.M{"$ne": member.ID},
 	}
 	update := bson.M{
-		"$addToSet": bson.M{
-			"members": userID,
+		"$push": bson.M{
+			"members": member,
 		},
 	}
-	_, err := r.collection.UpdateOne(ctx, filter, update)
-	return err
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount > 0, nil
 }
 
 // Find a conversation by pair of user id
@@ -178,3 +260,181 @@ func (r *ConversationRepository) FindByPair(ctx context.Context, userID string,
 
 	return conversation, nil
 }
+
+// Reserve the next message sequence number of a conversation
+func (r *ConversationRepository) NextSeq(ctx context.Context, conversationID string) (int64, error) {
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return 0, err
+	}
+
+	var conversation model.Conversation
+	filter := bson.M{"_id": objectID}
+	update := bson.M{"$inc": bson.M{"lastSeq": 1}}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"lastSeq": 1})
+	if err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&conversation); err != nil {
+		return 0, err
+	}
+
+	return conversation.LastSeq, nil
+}
+
+// Pin or unpin a conversation in the list of a member
+func (r *ConversationRepository) SetPinned(ctx context.Context, conversationID string, userID string, pinned bool) error {
+	return r.setMemberFlag(ctx, conversationID, "pinnedBy", userID, pinned)
+}
+
+// Archive or unarchive a conversation for a member
+func (r *ConversationRepository) SetArchived(ctx context.Context, conversationID string, userID string, archived bool) error {
+	return r.setMemberFlag(ctx, conversationID, "archivedBy", userID, archived)
+}
+
+func (r *ConversationRepository) setMemberFlag(ctx context.Context, conversationID string, field string, userID string, set bool) error {
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return err
+	}
+
+	operator := "$pull"
+	if set {
+		operator = "$addToSet"
+	}
+
+	_, err = r.collection.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{operator: bson.M{field: userID}})
+	return err
+}
+
+// Pin a message unless the conversation already has limit pinned messages, pinning a pinned message changes nothing.
+// The limit is checked in the update filter so concurrent pins cannot go over it.
+func (r *ConversationRepository) PinMessage(ctx context.Context, conversationID string, pin model.PinnedMessage, limit int) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return false, err
+	}
+	if limit <= 0 {
+		return false, ErrPinLimit
+	}
+
+	filter := bson.M{
+		"_id":                      objectID,
+		"pinnedMessages.messageId": bson.M{"$ne": pin.MessageID},
+		fmt.Sprintf("pinnedMessages.%d", limit-1): bson.M{"$exists": false},
+	}
+	update := bson.M{"$push": bson.M{"pinnedMessages": pin}}
+	res, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount > 0 {
+		return true, nil
+	}
+
+	pinned, err := r.collection.CountDocuments(ctx, bson.M{"_id": objectID, "pinnedMessages.messageId": pin.MessageID})
+	if err != nil {
+		return false, err
+	}
+	if pinned > 0 {
+		return false, nil
+	}
+	return false, ErrPinLimit
+}
+
+// Unpin a message, it returns false when the message was not pinned
+func (r *ConversationRepository) UnpinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return false, err
+	}
+
+	update := bson.M{"$pull": bson.M{"pinnedMessages": bson.M{"messageId": messageID}}}
+	res, err := r.collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount > 0, nil
+}
+
+// Set the latest message of a conversation unless a later one is already set
+func (r *ConversationRepository) SetLastMessage(ctx context.Context, message *model.Message) error {
+	objectID, err := primitive.ObjectIDFromHex(message.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	// Concurrent writes can finish out of order, the sequence number decides which message is the latest
+	filter := bson.M{
+		"_id": objectID,
+		"$or": bson.A{
+			bson.M{"lastMessage": bson.M{"$exists": false}},
+			bson.M{"lastMessage.seq": bson.M{"$lt": message.Seq}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"lastMessage":    message,
+		"lastActivityAt": message.CreateAt,
+	}}
+	_, err = r.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Set the latest message of the conversations written before it was kept on them
+func (r *ConversationRepository) BackfillLastMessages(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"lastActivityAt": bson.M{"$exists": false}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "messages",
+			"let":  bson.M{"conversationId": bson.M{"$toString": "$_id"}},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$conversationId", "$$conversationId"}}}},
+				bson.M{"$sort": bson.D{{Key: "seq", Value: -1}, {Key: "createAt", Value: -1}}},
+				bson.M{"$limit": 1},
+			},
+			"as": "lastMessages",
+		}}},
+	}
+
+	cur, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var conversation struct {
+			ID           primitive.ObjectID `bson:"_id"`
+			CreateAt     *time.Time         `bson:"createAt"`
+			LastMessages []model.Message    `bson:"lastMessages"`
+		}
+		if err := cur.Decode(&conversation); err != nil {
+			return err
+		}
+
+		set := bson.M{"lastActivityAt": conversation.CreateAt}
+		if len(conversation.LastMessages) > 0 {
+			set["lastMessage"] = conversation.LastMessages[0]
+			set["lastActivityAt"] = conversation.LastMessages[0].CreateAt
+		}
+		if _, err := r.collection.UpdateByID(ctx, conversation.ID, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// Ensure the indexes of the collection
+func (r *ConversationRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "members._id", Value: 1}, {Key: "lastActivityAt", Value: -1}, {Key: "_id", Value: -1}},
+		},
+		{
+			// The pinned conversations of a user are read on their own
+			Keys: bson.D{{Key: "pinnedBy", Value: 1}, {Key: "lastActivityAt", Value: -1}, {Key: "_id", Value: -1}},
+		},
+	})
+	return err
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IEventRepository interface {
+	// Append an event to the log of a user, the event gets the next sequence number of the user
+	Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error)
+
+	// Find the events of a user after a sequence number, oldest first
+	FindAfter(ctx context.Context, userID string, seq int64, limit int64) ([]*model.UserEvent, error)
+
+	// Find the cursor of a user, a user without events has a zero cursor
+	FindCursor(ctx context.Context, userID string) (*model.EventCursor, error)
+
+	// Acknowledge the events of a user up to a sequence number, it returns the sequence number acknowledged before
+	Ack(ctx context.Context, userID string, seq int64) (int64, error)
+
+	// Ensure the indexes of the collections
+	EnsureIndexes(ctx context.Context) error
+}
+
+// EventRepository is a repository for the event logs of users
+type EventRepository struct {
+	collection *mongo.Collection
+	cursors    *mongo.Collection
+	ttl        time.Duration
+}
+
+// NewEventRepository creates a new event repository, events are kept for ttl
+func NewEventRepository(db *mongo.Database, ttl time.Duration) *EventRepository {
+	return &EventRepository{
+		collection: db.Collection("user_events"),
+		cursors:    db.Collection("event_cursors"),
+		ttl:        ttl,
+	}
+}
+
+// Append an event to the log of a user, the event gets the next sequence number of the user.
+// The event is inserted before the cursor moves and the unique index on the sequence numbers turns concurrent appends away,
+// so a sequence number is only taken by an event in the log and the log has no holes but the expired events.
+func (r *EventRepository) Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error) {
+	cursor, err := r.FindCursor(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	userEvent := &model.UserEvent{
+		UserID:   userID,
+		Seq:      cursor.Seq + 1,
+		Event:    event,
+		Message:  message,
+		CreateAt: now,
+		ExpireAt: now.Add(r.ttl),
+	}
+
+	for {
+		res, err := r.collection.InsertOne(ctx, userEvent)
+		if err == nil {
+			if newID, ok := res.InsertedID.(primitive.ObjectID); ok {
+				userEvent.ID = newID
+			}
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		// A concurrent append took the number, the cursor may not have caught up with it yet
+		latest, err := r.latestSeq(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if latest >= userEvent.Seq {
+			userEvent.Seq = latest + 1
+		} else {
+			userEvent.Seq++
+		}
+	}
+
+	filter := bson.M{"_id": userID}
+	update := bson.M{"$max": bson.M{"seq": userEvent.Seq}}
+	if _, err := r.cursors.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		return nil, err
+	}
+	return userEvent, nil
+}
+
+// latestSeq returns the sequence number of the latest event in the log of a user
+func (r *EventRepository) latestSeq(ctx context.Context, userID string) (int64, error) {
+	var latest model.UserEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(bson.M{"seq": 1})
+	if err := r.collection.FindOne(ctx, bson.M{"userId": userID}, opts).Decode(&latest); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return latest.Seq, nil
+}
+
+// Find the events of a user after a sequence number, oldest first
+func (r *EventRepository) FindAfter(ctx context.Context, userID string, seq int64, limit int64) ([]*model.UserEvent, error) {
+	events := []*model.UserEvent{}
+
+	filter := bson.M{"userId": userID, "seq": bson.M{"$gt": seq}}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Find the cursor of a user, a user without events has a zero cursor
+func (r *EventRepository) FindCursor(ctx context.Context, userID string) (*model.EventCursor, error) {
+	cursor := model.EventCursor{UserID: userID}
+	if err := r.cursors.FindOne(ctx, bson.M{"_id": userID}).Decode(&cursor); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &cursor, nil
+		}
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+// Acknowledge the events of a user up to a sequence number, it returns the sequence number acknowledged before.
+// Acks past the latest event are ignored.
+func (r *EventRepository) Ack(ctx context.Context, userID string, seq int64) (int64, error) {
+	var cursor model.EventCursor
+	filter := bson.M{"_id": userID, "seq": bson.M{"$gte": seq}}
+	update := bson.M{"$max": bson.M{"acked": seq}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	if err := r.cursors.FindOneAndUpdate(ctx, filter, update, opts).Decode(&cursor); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return seq, nil
+		}
+		return 0, err
+	}
+
+	return cursor.Acked, nil
+}
+
+// Ensure the indexes of the collections
+func (r *EventRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// The log is bounded, events are dropped once they expire
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
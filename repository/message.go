@@ -2,25 +2,52 @@ package repository
 
 import (
 	"context"
+	"errors"
 
 	"github.com/guutong/chat-backend/model"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrDuplicateMessage = errors.New("duplicate message")
+)
+
 type IMessageRepository interface {
 	// Create a new message
 	Create(ctx context.Context, message *model.Message) error
 
+	// Find a message by id
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.Message, error)
+
+	// Find messages by their ids
+	FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*model.Message, error)
+
+	// Find a message by the id its sender chose for it
+	FindByClientMessageID(ctx context.Context, conversationID string, sender string, clientMessageID string) (*model.Message, error)
+
 	// Find a message by conversation id
 	FindByConversationID(ctx context.Context, conversationID string) ([]*model.Message, error)
 
-	// Find a message by conversation id pagination
+	// Find the messages of a conversation after a sequence number, oldest first
+	FindByConversationIDAfterSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error)
+
+	// Find the messages of a conversation before a sequence number, newest first
+	FindByConversationIDBeforeSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error)
+
+	// Find the messages of a conversation newest first, skipping the given number of newest messages
 	FindByConversationIDPagination(ctx context.Context, conversationID string, page int64, limit int64) ([]*model.Message, error)
 
 	// Find last message by conversation id
 	FindLastMessageByConversationID(ctx context.Context, conversationID string) (*model.Message, error)
+
+	// Find the messages mentioning a user, newest first, before a message id when it is not nil
+	FindByMention(ctx context.Context, userID string, before *primitive.ObjectID, limit int64) ([]*model.Message, error)
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
 }
 
 // MessageRepository is a repository for message
@@ -35,18 +62,61 @@ func NewMessageRepository(db *mongo.Database) *MessageRepository {
 	}
 }
 
+// Messages written before sequence numbers existed all have seq 0 and fall back to their creation time
+var bySeq = bson.D{{Key: "seq", Value: 1}, {Key: "createAt", Value: 1}}
+var bySeqDesc = bson.D{{Key: "seq", Value: -1}, {Key: "createAt", Value: -1}}
+
 // Create a new message
 func (r *MessageRepository) Create(ctx context.Context, message *model.Message) error {
 	_, err := r.collection.InsertOne(ctx, message)
+	if mongo.IsDuplicateKeyError(err) && message.ClientMessageID != "" {
+		return ErrDuplicateMessage
+	}
 	return err
 }
 
+// Find a message by id
+func (r *MessageRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Message, error) {
+	var message model.Message
+	if err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// Find messages by their ids, in no particular order
+func (r *MessageRepository) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*model.Message, error) {
+	messages := []*model.Message{}
+	cursor, err := r.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Find a message by the id its sender chose for it
+func (r *MessageRepository) FindByClientMessageID(ctx context.Context, conversationID string, sender string, clientMessageID string) (*model.Message, error) {
+	var message model.Message
+	filter := bson.M{"conversationId": conversationID, "sender": sender, "clientMessageId": clientMessageID}
+	if err := r.collection.FindOne(ctx, filter).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
 // Find a message by conversation id
 func (r *MessageRepository) FindByConversationID(ctx context.Context, conversationID string) ([]*model.Message, error) {
 	var messages []*model.Message
 
 	filter := bson.M{"conversationId": conversationID}
-	cursor, err := r.collection.Find(ctx, filter)
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bySeq))
 	if err != nil {
 		return nil, err
 	}
@@ -58,16 +128,27 @@ func (r *MessageRepository) FindByConversationID(ctx context.Context, conversati
 	return messages, nil
 }
 
-// Find a message by conversation id pagination
-func (r *MessageRepository) FindByConversationIDPagination(ctx context.Context, conversationID string, page int64, limit int64) ([]*model.Message, error) {
-	var messages []*model.Message
+// Find the messages of a conversation after a sequence number, oldest first
+func (r *MessageRepository) FindByConversationIDAfterSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error) {
+	filter := bson.M{"conversationId": conversationID, "seq": bson.M{"$gt": seq}}
+	return r.find(ctx, filter, options.Find().SetSort(bySeq).SetLimit(limit))
+}
 
+// Find the messages of a conversation before a sequence number, newest first
+func (r *MessageRepository) FindByConversationIDBeforeSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error) {
+	filter := bson.M{"conversationId": conversationID, "seq": bson.M{"$lt": seq}}
+	return r.find(ctx, filter, options.Find().SetSort(bySeqDesc).SetLimit(limit))
+}
+
+// Find the messages of a conversation newest first, skipping the given number of newest messages.
+// It counts stored messages so it also pages the messages written before they were numbered.
+func (r *MessageRepository) FindByConversationIDPagination(ctx context.Context, conversationID string, page int64, limit int64) ([]*model.Message, error) {
 	filter := bson.M{"conversationId": conversationID}
-	opts := &options.FindOptions{
-		Skip:  &page,
-		Limit: &limit,
-		Sort:  map[string]int{"createAt": -1},
-	}
+	return r.find(ctx, filter, options.Find().SetSort(bySeqDesc).SetSkip(page).SetLimit(limit))
+}
+
+func (r *MessageRepository) find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*model.Message, error) {
+	messages := []*model.Message{}
 
 	cursor, err := r.collection.Find(ctx, filter, opts)
 	if err != nil {
@@ -83,21 +164,51 @@ func (r *MessageRepository) FindByConversationIDPagination(ctx context.Context,
 
 // Find latest message by conversation id
 func (r *MessageRepository) FindLastMessageByConversationID(ctx context.Context, conversationID string) (*model.Message, error) {
-	var message *model.Message
+	var message model.Message
 
 	filter := bson.M{"conversationId": conversationID}
-	opts := &options.FindOptions{
-		Sort: map[string]int{"createAt": -1},
-	}
-
-	cursor, err := r.collection.Find(ctx, filter, opts)
-	if err != nil {
+	opts := options.FindOne().SetSort(bySeqDesc)
+	if err := r.collection.FindOne(ctx, filter, opts).Decode(&message); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	if err = cursor.All(ctx, &message); err != nil {
-		return nil, err
+	return &message, nil
+}
+
+// Find the messages mentioning a user, newest first, before a message id when it is not nil.
+// Message ids grow with time so they order the feed across conversations.
+func (r *MessageRepository) FindByMention(ctx context.Context, userID string, before *primitive.ObjectID, limit int64) ([]*model.Message, error) {
+	filter := bson.M{"mentions": userID}
+	if before != nil {
+		filter["_id"] = bson.M{"$lt": *before}
 	}
+	return r.find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit))
+}
 
-	return message, nil
+// Ensure the indexes of the collection
+func (r *MessageRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// A sequence number is used once per conversation, older messages without one are left out
+			Keys: bson.D{{Key: "conversationId", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"seq": bson.M{"$gt": 0}}),
+		},
+		{
+			// A client message id is used once per sender and conversation
+			Keys: bson.D{{Key: "conversationId", Value: 1}, {Key: "sender", Value: 1}, {Key: "clientMessageId", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"clientMessageId": bson.M{"$type": "string"}}),
+		},
+		{
+			// The mentions feed of a user, newest first
+			Keys: bson.D{{Key: "mentions", Value: 1}, {Key: "_id", Value: -1}},
+		},
+	})
+	return err
 }
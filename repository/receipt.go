@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IReceiptRepository interface {
+	// Create the receipts of a message
+	CreateMany(ctx context.Context, receipts []*model.Receipt) error
+
+	// Find the receipts of a message
+	FindByMessageID(ctx context.Context, messageID primitive.ObjectID) ([]*model.Receipt, error)
+
+	// Mark messages as delivered to a user, it returns the receipts that changed
+	MarkDelivered(ctx context.Context, userID string, messageIDs []primitive.ObjectID, at time.Time) ([]*model.Receipt, error)
+
+	// Mark the messages of a conversation up to a sequence number as read by a user, it returns the receipts that changed
+	MarkRead(ctx context.Context, userID string, conversationID string, seq int64, at time.Time) ([]*model.Receipt, error)
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// ReceiptRepository is a repository for message receipts
+type ReceiptRepository struct {
+	collection *mongo.Collection
+}
+
+// NewReceiptRepository creates a new receipt repository
+func NewReceiptRepository(db *mongo.Database) *ReceiptRepository {
+	return &ReceiptRepository{
+		collection: db.Collection("receipts"),
+	}
+}
+
+// Create the receipts of a message
+func (r *ReceiptRepository) CreateMany(ctx context.Context, receipts []*model.Receipt) error {
+	if len(receipts) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	documents := make([]interface{}, len(receipts))
+	for i, receipt := range receipts {
+		receipt.ID = primitive.NewObjectID()
+		receipt.CreateAt = now
+		documents[i] = receipt
+	}
+
+	_, err := r.collection.InsertMany(ctx, documents)
+	return err
+}
+
+// Find the receipts of a message
+func (r *ReceiptRepository) FindByMessageID(ctx context.Context, messageID primitive.ObjectID) ([]*model.Receipt, error) {
+	return r.find(ctx, bson.M{"messageId": messageID})
+}
+
+// Mark messages as delivered to a user, it returns the receipts that changed
+func (r *ReceiptRepository) MarkDelivered(ctx context.Context, userID string, messageIDs []primitive.ObjectID, at time.Time) ([]*model.Receipt, error) {
+	filter := bson.M{
+		"userId":      userID,
+		"messageId":   bson.M{"$in": messageIDs},
+		"deliveredAt": bson.M{"$exists": false},
+	}
+	return r.mark(ctx, filter, bson.M{"deliveredAt": at})
+}
+
+// Mark the messages of a conversation up to a sequence number as read by a user, it returns the receipts that changed.
+// A read message counts as delivered as well.
+func (r *ReceiptRepository) MarkRead(ctx context.Context, userID string, conversationID string, seq int64, at time.Time) ([]*model.Receipt, error) {
+	base := bson.M{
+		"userId":         userID,
+		"conversationId": conversationID,
+		"seq":            bson.M{"$lte": seq},
+	}
+
+	delivered := bson.M{"deliveredAt": bson.M{"$exists": false}}
+	for key, value := range base {
+		delivered[key] = value
+	}
+	if _, err := r.collection.UpdateMany(ctx, delivered, bson.M{"$set": bson.M{"deliveredAt": at}}); err != nil {
+		return nil, err
+	}
+
+	base["readAt"] = bson.M{"$exists": false}
+	return r.mark(ctx, base, bson.M{"readAt": at})
+}
+
+// mark sets fields on the receipts matching a filter and returns the ones it changed as they are after the update.
+// Each receipt is updated on its own with the filter, so a receipt changed by a concurrent update is left out.
+func (r *ReceiptRepository) mark(ctx context.Context, filter bson.M, set bson.M) ([]*model.Receipt, error) {
+	receipts, err := r.find(ctx, filter)
+	if err != nil || len(receipts) == 0 {
+		return receipts, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(receipts))
+	for _, receipt := range receipts {
+		filter["_id"] = receipt.ID
+		result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			return nil, err
+		}
+		if result.ModifiedCount > 0 {
+			ids = append(ids, receipt.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return []*model.Receipt{}, nil
+	}
+	return r.find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (r *ReceiptRepository) find(ctx context.Context, filter bson.M) ([]*model.Receipt, error) {
+	receipts := []*model.Receipt{}
+
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(ctx, &receipts); err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+// Ensure the indexes of the collection
+func (r *ReceiptRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "messageId", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "conversationId", Value: 1}, {Key: "seq", Value: 1}},
+		},
+	})
+	return err
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestReceiptRepository needs a MongoDB server, it is skipped unless MONGODB_TEST_URI is set
+func TestReceiptRepository(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	r := NewReceiptRepository(client.Database("chat_app_test"))
+	if _, err := r.collection.DeleteMany(ctx, bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.collection.Drop(ctx)
+	if err := r.EnsureIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three messages from alice to bob in one conversation
+	ids := make([]primitive.ObjectID, 3)
+	receipts := make([]*model.Receipt, 3)
+	for i := range receipts {
+		ids[i] = primitive.NewObjectID()
+		receipts[i] = &model.Receipt{MessageID: ids[i], ConversationID: "c1", Sender: "alice", UserID: "bob", Seq: int64(i + 1)}
+	}
+	if err := r.CreateMany(ctx, receipts); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	delivered, err := r.MarkDelivered(ctx, "bob", ids[:1], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0].MessageID != ids[0] || delivered[0].Status() != model.MessageStatusDelivered {
+		t.Fatalf("MarkDelivered = %+v, want the first receipt delivered", delivered)
+	}
+
+	// Receipts that are already delivered are not returned again
+	delivered, err = r.MarkDelivered(ctx, "bob", ids, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 2 || delivered[0].MessageID != ids[1] || delivered[1].MessageID != ids[2] {
+		t.Fatalf("MarkDelivered = %+v, want the other two receipts", delivered)
+	}
+
+	// Only the receipts of the user change
+	if read, err := r.MarkRead(ctx, "alice", "c1", 3, now); err != nil || len(read) != 0 {
+		t.Fatalf("MarkRead by the sender = %+v, %v, want nothing", read, err)
+	}
+
+	read, err := r.MarkRead(ctx, "bob", "c1", 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0].Seq != 1 || read[1].Seq != 2 || read[1].Status() != model.MessageStatusRead {
+		t.Fatalf("MarkRead up to 2 = %+v, want the first two receipts read", read)
+	}
+
+	// Concurrent reads report each receipt once between them
+	var mu sync.Mutex
+	reported := map[primitive.ObjectID]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, err := r.MarkRead(ctx, "bob", "c1", 3, time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, receipt := range read {
+				reported[receipt.MessageID]++
+			}
+		}()
+	}
+	wg.Wait()
+	if len(reported) != 1 || reported[ids[2]] != 1 {
+		t.Fatalf("concurrent reads reported %v, want the last receipt once", reported)
+	}
+}
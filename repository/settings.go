@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ISettingsRepository interface {
+	// Find the settings of a user for a conversation, the defaults when the user never changed them
+	Find(ctx context.Context, userID string, conversationID string) (*model.ConversationSettings, error)
+
+	// Find the settings a user changed for some of their conversations, by conversation id
+	FindByUserID(ctx context.Context, userID string, conversationIDs []string) (map[string]*model.ConversationSettings, error)
+
+	// Find the settings some members changed for a conversation, by user id
+	FindByConversationID(ctx context.Context, conversationID string, userIDs []string) (map[string]*model.ConversationSettings, error)
+
+	// Save the settings of a user for a conversation
+	Save(ctx context.Context, settings *model.ConversationSettings) error
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// SettingsRepository is a repository for the conversation settings of users.
+// They are kept apart from the conversations so changing them never touches the document every member shares.
+type SettingsRepository struct {
+	collection *mongo.Collection
+}
+
+// NewSettingsRepository creates a new settings repository
+func NewSettingsRepository(db *mongo.Database) *SettingsRepository {
+	return &SettingsRepository{
+		collection: db.Collection("conversation_settings"),
+	}
+}
+
+// Find the settings of a user for a conversation, the defaults when the user never changed them
+func (r *SettingsRepository) Find(ctx context.Context, userID string, conversationID string) (*model.ConversationSettings, error) {
+	var settings model.ConversationSettings
+	filter := bson.M{"userId": userID, "conversationId": conversationID}
+	if err := r.collection.FindOne(ctx, filter).Decode(&settings); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return model.DefaultConversationSettings(userID, conversationID), nil
+		}
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// Find the settings a user changed for some of their conversations, by conversation id
+func (r *SettingsRepository) FindByUserID(ctx context.Context, userID string, conversationIDs []string) (map[string]*model.ConversationSettings, error) {
+	settings, err := r.find(ctx, bson.M{"userId": userID, "conversationId": bson.M{"$in": conversationIDs}})
+	if err != nil {
+		return nil, err
+	}
+
+	byConversation := make(map[string]*model.ConversationSettings, len(settings))
+	for _, s := range settings {
+		byConversation[s.ConversationID] = s
+	}
+	return byConversation, nil
+}
+
+// Find the settings some members changed for a conversation, by user id
+func (r *SettingsRepository) FindByConversationID(ctx context.Context, conversationID string, userIDs []string) (map[string]*model.ConversationSettings, error) {
+	settings, err := r.find(ctx, bson.M{"conversationId": conversationID, "userId": bson.M{"$in": userIDs}})
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string]*model.ConversationSettings, len(settings))
+	for _, s := range settings {
+		byUser[s.UserID] = s
+	}
+	return byUser, nil
+}
+
+func (r *SettingsRepository) find(ctx context.Context, filter bson.M) ([]*model.ConversationSettings, error) {
+	settings := []*model.ConversationSettings{}
+
+	cursor, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(ctx, &settings); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Save the settings of a user for a conversation
+func (r *SettingsRepository) Save(ctx context.Context, settings *model.ConversationSettings) error {
+	now := time.Now()
+	settings.UpdateAt = &now
+
+	filter := bson.M{"userId": settings.UserID, "conversationId": settings.ConversationID}
+	_, err := r.collection.ReplaceOne(ctx, filter, settings, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Ensure the indexes of the collection
+func (r *SettingsRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "conversationId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "conversationId", Value: 1}},
+		},
+	})
+	return err
+}
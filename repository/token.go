@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ITokenRepository interface {
+	// Create a new token
+	Create(ctx context.Context, token *model.UserToken) error
+
+	// Find an unexpired token by id without consuming it
+	FindByID(ctx context.Context, id string) (*model.UserToken, error)
+
+	// Consume a token, a token can only be consumed once
+	Consume(ctx context.Context, id string, purpose string) (*model.UserToken, error)
+
+	// Delete all tokens of a user for a purpose
+	DeleteByUserID(ctx context.Context, userID string, purpose string) error
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// TokenRepository is a repository for user tokens
+type TokenRepository struct {
+	collection *mongo.Collection
+}
+
+// NewTokenRepository creates a new token repository
+func NewTokenRepository(db *mongo.Database) *TokenRepository {
+	return &TokenRepository{
+		collection: db.Collection("user_tokens"),
+	}
+}
+
+// Create a new token
+func (r *TokenRepository) Create(ctx context.Context, token *model.UserToken) error {
+	token.CreateAt = time.Now()
+	res, err := r.collection.InsertOne(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if newID, ok := res.InsertedID.(primitive.ObjectID); ok {
+		token.ID = newID
+	}
+	return nil
+}
+
+// Find an unexpired token by id without consuming it
+func (r *TokenRepository) FindByID(ctx context.Context, id string) (*model.UserToken, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var token model.UserToken
+	filter := bson.M{"_id": objectID, "expireAt": bson.M{"$gt": time.Now()}}
+	if err := r.collection.FindOne(ctx, filter).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Consume a token, a token can only be consumed once
+func (r *TokenRepository) Consume(ctx context.Context, id string, purpose string) (*model.UserToken, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var token model.UserToken
+	filter := bson.M{
+		"_id":      objectID,
+		"purpose":  purpose,
+		"expireAt": bson.M{"$gt": time.Now()},
+	}
+	if err := r.collection.FindOneAndDelete(ctx, filter).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Delete all tokens of a user for a purpose
+func (r *TokenRepository) DeleteByUserID(ctx context.Context, userID string, purpose string) error {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"userId": objectID, "purpose": purpose}
+	_, err = r.collection.DeleteMany(ctx, filter)
+	return err
+}
+
+// Ensure the indexes of the collection
+func (r *TokenRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}},
+		},
+	})
+	return err
+}
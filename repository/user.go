@@ -2,14 +2,26 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/guutong/chat-backend/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrDuplicateUsername = errors.New("duplicate username")
+	ErrDuplicateEmail    = errors.New("duplicate email")
+)
+
+// usernameCollation compares usernames case-insensitively, queries on username must use it to hit the unique index
+var usernameCollation = &options.Collation{Locale: "en", Strength: 2}
+
 type IUserRepository interface {
 	// Create a new user
 	Create(ctx context.Context, user *model.User) error
@@ -25,6 +37,55 @@ type IUserRepository interface {
 
 	// Find all users
 	FindAll(ctx context.Context) ([]*model.User, error)
+
+	// Find a user by email
+	FindByEmail(ctx context.Context, email string) (*model.User, error)
+
+	// Update the password of a user
+	UpdatePassword(ctx context.Context, id string, password string) error
+
+	// Update the email of a user, the new email is unverified
+	UpdateEmail(ctx context.Context, id string, email string) error
+
+	// Mark the email of a user as verified if it is still the given email
+	VerifyEmail(ctx context.Context, id string, email string) error
+
+	// Search users by a prefix or substring of their username or display name, a limit of 0 returns every match.
+	// Results are ordered by id and start after the cursor id when it is not empty.
+	Search(ctx context.Context, query string, exclude []primitive.ObjectID, cursor string, limit int64) ([]*model.User, error)
+
+	// Add a user to the block list of a user
+	Block(ctx context.Context, id string, targetID string) error
+
+	// Remove a user from the block list of a user
+	Unblock(ctx context.Context, id string, targetID string) error
+
+	// Add a user to the mute list of a user
+	Mute(ctx context.Context, id string, targetID string) error
+
+	// Remove a user from the mute list of a user
+	Unmute(ctx context.Context, id string, targetID string) error
+
+	// Check whether either of two users blocked the other
+	IsBlocked(ctx context.Context, id string, otherID string) (bool, error)
+
+	// Find the ids of the users who blocked a user
+	FindBlockerIDs(ctx context.Context, id string) ([]string, error)
+
+	// Find users by ids
+	FindByIDs(ctx context.Context, ids []string) ([]*model.User, error)
+
+	// Add a user to the contacts of a user
+	AddContact(ctx context.Context, id string, contactID string) error
+
+	// Remove a user from the contacts of a user
+	RemoveContact(ctx context.Context, id string, contactID string) error
+
+	// Set whether a user only accepts direct messages from contacts
+	SetDMContactsOnly(ctx context.Context, id string, contactsOnly bool) error
+
+	// Ensure the indexes of the collection
+	EnsureIndexes(ctx context.Context) error
 }
 
 // UserRepository is a repository for user
@@ -44,15 +105,24 @@ func (r *UserRepository) Create(ctx context.Context, user *model.User) error {
 	now := time.Now()
 	user.CreateAt = &now
 	user.UpdateAt = &now
-	_, err := r.collection.InsertOne(ctx, user)
-	return err
+	user.SearchTerms = searchTerms(user.Username, user.DisplayName)
+	res, err := r.collection.InsertOne(ctx, user)
+	if err != nil {
+		return duplicateError(err)
+	}
+
+	if newID, ok := res.InsertedID.(primitive.ObjectID); ok {
+		user.ID = newID
+	}
+	return nil
 }
 
 // Find a user by username
 func (r *UserRepository) FindByUsername(ctx context.Context, username string) (*model.User, error) {
 	var user model.User
 	filter := bson.M{"username": username}
-	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	opts := options.FindOne().SetCollation(usernameCollation)
+	err := r.collection.FindOne(ctx, filter, opts).Decode(&user)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +145,11 @@ func (r *UserRepository) FindByID(ctx context.Context, id string) (*model.User,
 // Update a user
 func (r *UserRepository) Update(ctx context.Context, user *model.User) error {
 	filter := bson.M{"_id": user.ID}
-	update := bson.M{"$set": bson.M{"profilePicture": user.ProfilePicture}}
+	update := bson.M{"$set": bson.M{
+		"profilePicture": user.ProfilePicture,
+		"displayName":    user.DisplayName,
+		"searchTerms":    searchTerms(user.Username, user.DisplayName),
+	}}
 	_, err := r.collection.UpdateOne(ctx, filter, update)
 	return err
 }
@@ -96,3 +170,318 @@ func (r *UserRepository) FindAll(ctx context.Context) ([]*model.User, error) {
 
 	return users, nil
 }
+
+// Find a user by email
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (*model.User, error) {
+	var user model.User
+	filter := bson.M{"email": email}
+	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Update the password of a user
+func (r *UserRepository) UpdatePassword(ctx context.Context, id string, password string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": objectID}
+	update := bson.M{"$set": bson.M{"password": password, "updateAt": time.Now()}}
+	_, err = r.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Update the email of a user, the new email is unverified
+func (r *UserRepository) UpdateEmail(ctx context.Context, id string, email string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": objectID}
+	update := bson.M{"$set": bson.M{"email": email, "emailVerified": false, "updateAt": time.Now()}}
+	_, err = r.collection.UpdateOne(ctx, filter, update)
+	return duplicateError(err)
+}
+
+// Mark the email of a user as verified if it is still the given email
+func (r *UserRepository) VerifyEmail(ctx context.Context, id string, email string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": objectID, "email": email}
+	update := bson.M{"$set": bson.M{"emailVerified": true, "updateAt": time.Now()}}
+	res, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Search users by a prefix or substring of their username or display name, a limit of 0 returns every match.
+// Results are ordered by id and start after the cursor id when it is not empty.
+func (r *UserRepository) Search(ctx context.Context, query string, exclude []primitive.ObjectID, cursor string, limit int64) ([]*model.User, error) {
+	idFilter := bson.M{"$nin": exclude}
+	if cursor != "" {
+		cursorID, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, err
+		}
+		idFilter["$gt"] = cursorID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"password": 0, "searchTerms": 0})
+
+	filter := bson.M{"_id": idFilter}
+	if query = strings.ToLower(strings.TrimSpace(query)); query != "" {
+		// Every suffix is a search term so an anchored regex also finds substrings and can use the index.
+		// Without the hint the planner may walk the _id index for the sort and read every user to find a rare match.
+		filter["searchTerms"] = bson.M{"$regex": "^" + regexp.QuoteMeta(query)}
+		opts.SetHint(bson.D{{Key: "searchTerms", Value: 1}})
+	}
+
+	cur, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	users := []*model.User{}
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Add a user to the block list of a user
+func (r *UserRepository) Block(ctx context.Context, id string, targetID string) error {
+	return r.updateList(ctx, id, "$addToSet", "blockedUsers", targetID)
+}
+
+// Remove a user from the block list of a user
+func (r *UserRepository) Unblock(ctx context.Context, id string, targetID string) error {
+	return r.updateList(ctx, id, "$pull", "blockedUsers", targetID)
+}
+
+// Add a user to the mute list of a user
+func (r *UserRepository) Mute(ctx context.Context, id string, targetID string) error {
+	return r.updateList(ctx, id, "$addToSet", "mutedUsers", targetID)
+}
+
+// Remove a user from the mute list of a user
+func (r *UserRepository) Unmute(ctx context.Context, id string, targetID string) error {
+	return r.updateList(ctx, id, "$pull", "mutedUsers", targetID)
+}
+
+// Check whether either of two users blocked the other
+func (r *UserRepository) IsBlocked(ctx context.Context, id string, otherID string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	otherObjectID, err := primitive.ObjectIDFromHex(otherID)
+	if err != nil {
+		return false, err
+	}
+
+	filter := bson.M{"$or": []bson.M{
+		{"_id": objectID, "blockedUsers": otherID},
+		{"_id": otherObjectID, "blockedUsers": id},
+	}}
+	count, err := r.collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Find the ids of the users who blocked a user
+func (r *UserRepository) FindBlockerIDs(ctx context.Context, id string) ([]string, error) {
+	filter := bson.M{"blockedUsers": id}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cur, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	ids := []string{}
+	for cur.Next(ctx) {
+		var user model.User
+		if err := cur.Decode(&user); err != nil {
+			return nil, err
+		}
+		ids = append(ids, user.ID.Hex())
+	}
+
+	return ids, cur.Err()
+}
+
+// Find users by ids
+func (r *UserRepository) FindByIDs(ctx context.Context, ids []string) ([]*model.User, error) {
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": objectIDs}}
+	opts := options.Find().SetProjection(bson.M{"password": 0, "searchTerms": 0})
+	cur, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	users := []*model.User{}
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Add a user to the contacts of a user
+func (r *UserRepository) AddContact(ctx context.Context, id string, contactID string) error {
+	return r.updateList(ctx, id, "$addToSet", "contacts", contactID)
+}
+
+// Remove a user from the contacts of a user
+func (r *UserRepository) RemoveContact(ctx context.Context, id string, contactID string) error {
+	return r.updateList(ctx, id, "$pull", "contacts", contactID)
+}
+
+// Set whether a user only accepts direct messages from contacts
+func (r *UserRepository) SetDMContactsOnly(ctx context.Context, id string, contactsOnly bool) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": objectID}
+	update := bson.M{"$set": bson.M{"dmContactsOnly": contactsOnly, "updateAt": time.Now()}}
+	_, err = r.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (r *UserRepository) updateList(ctx context.Context, id string, operator string, field string, targetID string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": objectID}
+	update := bson.M{operator: bson.M{field: targetID}}
+	_, err = r.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Backfill the search terms of users created before search existed
+func (r *UserRepository) BackfillSearchTerms(ctx context.Context) error {
+	filter := bson.M{"searchTerms": bson.M{"$exists": false}}
+	cur, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user model.User
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+
+		update := bson.M{"$set": bson.M{"searchTerms": searchTerms(user.Username, user.DisplayName)}}
+		if _, err := r.collection.UpdateByID(ctx, user.ID, update); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// Ensure the indexes of the collection
+func (r *UserRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().
+				SetName("username_unique").
+				SetUnique(true).
+				SetCollation(usernameCollation),
+		},
+		{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().
+				SetName("email_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+		},
+		{
+			// The prefix regex is a range on searchTerms so the sort on _id cannot come from this index,
+			// the matching users are sorted in memory and the limit keeps only the top of the page
+			Keys: bson.D{{Key: "searchTerms", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "blockedUsers", Value: 1}},
+		},
+	})
+	return err
+}
+
+// duplicateError maps a duplicate key error to the field that is not unique
+func duplicateError(err error) error {
+	if err == nil || !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	switch {
+	case strings.Contains(err.Error(), "username_unique"):
+		return ErrDuplicateUsername
+	case strings.Contains(err.Error(), "email_unique"):
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// searchTerms returns every suffix of the words of the username and the display name, in lower case
+func searchTerms(username string, displayName string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	add := func(term string) {
+		if term != "" && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	// The whole display name lets queries span words, e.g. "john sm"
+	add(strings.ToLower(strings.TrimSpace(displayName)))
+
+	words := append([]string{username}, strings.Fields(displayName)...)
+	for _, word := range words {
+		runes := []rune(strings.ToLower(word))
+		for i := range runes {
+			add(string(runes[i:]))
+		}
+	}
+
+	return terms
+}
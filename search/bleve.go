@@ -0,0 +1,209 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/mapping"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// backfilledKey marks an index that holds every message written before it was enabled
+var backfilledKey = []byte("backfilled")
+
+// Messages indexed at once by a backfill
+const backfillBatchSize = 1000
+
+// bleveMessage is the document of a message in the Bleve index
+type bleveMessage struct {
+	ConversationID string    `json:"conversationId"`
+	Sender         string    `json:"sender"`
+	Text           string    `json:"text"`
+	Seq            int64     `json:"seq"`
+	CreateAt       time.Time `json:"createAt"`
+}
+
+// BleveIndex is an embedded Bleve index stored on the local disk.
+// Every node keeps its own index, so it suits single node deployments, Backfill indexes the messages written before it was enabled.
+type BleveIndex struct {
+	index bleve.Index
+}
+
+// NewBleveIndex opens the Bleve index at path, it is created when it does not exist
+func NewBleveIndex(path string) (*BleveIndex, error) {
+	index, err := bleve.Open(path)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		index, err = bleve.New(path, newMessageMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &BleveIndex{index: index}, nil
+}
+
+func newMessageMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	textField := bleve.NewTextFieldMapping()
+	textField.IncludeTermVectors = true
+
+	message := bleve.NewDocumentStaticMapping()
+	message.AddFieldMappingsAt("conversationId", keywordField)
+	message.AddFieldMappingsAt("sender", keywordField)
+	message.AddFieldMappingsAt("text", textField)
+	message.AddFieldMappingsAt("seq", bleve.NewNumericFieldMapping())
+	message.AddFieldMappingsAt("createAt", bleve.NewDateTimeFieldMapping())
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.DefaultMapping = message
+	return indexMapping
+}
+
+// Index a new message
+func (i *BleveIndex) Index(ctx context.Context, message *model.Message) error {
+	return i.index.Index(message.ID.Hex(), newBleveMessage(message))
+}
+
+func newBleveMessage(message *model.Message) bleveMessage {
+	return bleveMessage{
+		ConversationID: message.ConversationID,
+		Sender:         message.Sender,
+		Text:           message.Text,
+		Seq:            message.Seq,
+		CreateAt:       message.CreateAt,
+	}
+}
+
+// Backfill indexes the messages of the messages collection unless an earlier backfill finished, it returns how many it indexed.
+// Messages written meanwhile are indexed twice at worst, an interrupted backfill starts over on the next run.
+func (i *BleveIndex) Backfill(ctx context.Context, db *mongo.Database) (int, error) {
+	done, err := i.index.GetInternal(backfilledKey)
+	if err != nil || done != nil {
+		return 0, err
+	}
+
+	cursor, err := db.Collection("messages").Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	indexed := 0
+	batch := i.index.NewBatch()
+	for cursor.Next(ctx) {
+		var message model.Message
+		if err := cursor.Decode(&message); err != nil {
+			return indexed, err
+		}
+		if err := batch.Index(message.ID.Hex(), newBleveMessage(&message)); err != nil {
+			return indexed, err
+		}
+
+		if batch.Size() >= backfillBatchSize {
+			if err := i.index.Batch(batch); err != nil {
+				return indexed, err
+			}
+			indexed += batch.Size()
+			batch.Reset()
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return indexed, err
+	}
+
+	if err := i.index.Batch(batch); err != nil {
+		return indexed, err
+	}
+	indexed += batch.Size()
+
+	return indexed, i.index.SetInternal(backfilledKey, []byte(time.Now().Format(time.RFC3339)))
+}
+
+// Search messages, best matches first
+func (i *BleveIndex) Search(ctx context.Context, query Query) ([]Hit, error) {
+	if len(query.ConversationIDs) == 0 {
+		return []Hit{}, nil
+	}
+
+	text := bleve.NewMatchQuery(query.Text)
+	text.SetField("text")
+
+	conversations := make([]bleveQuery.Query, len(query.ConversationIDs))
+	for n, conversationID := range query.ConversationIDs {
+		term := bleve.NewTermQuery(conversationID)
+		term.SetField("conversationId")
+		conversations[n] = term
+	}
+
+	conjuncts := []bleveQuery.Query{text, bleve.NewDisjunctionQuery(conversations...)}
+	if query.SenderID != "" {
+		sender := bleve.NewTermQuery(query.SenderID)
+		sender.SetField("sender")
+		conjuncts = append(conjuncts, sender)
+	}
+	if query.From != nil || query.To != nil {
+		var from, to time.Time
+		if query.From != nil {
+			from = *query.From
+		}
+		if query.To != nil {
+			to = *query.To
+		}
+		inclusive := true
+		createAt := bleve.NewDateRangeInclusiveQuery(from, to, &inclusive, &inclusive)
+		createAt.SetField("createAt")
+		conjuncts = append(conjuncts, createAt)
+	}
+
+	request := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(conjuncts...), int(query.Limit), int(query.Offset), false)
+	request.Fields = []string{"conversationId", "sender", "text", "seq", "createAt"}
+	request.Highlight = bleve.NewHighlightWithStyle("html")
+	request.Highlight.AddField("text")
+
+	result, err := i.index.SearchInContext(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	words := terms(query.Text)
+	hits := make([]Hit, 0, len(result.Hits))
+	for _, match := range result.Hits {
+		id, err := primitive.ObjectIDFromHex(match.ID)
+		if err != nil {
+			continue
+		}
+
+		message := &model.Message{ID: id}
+		message.ConversationID, _ = match.Fields["conversationId"].(string)
+		message.Sender, _ = match.Fields["sender"].(string)
+		message.Text, _ = match.Fields["text"].(string)
+		if seq, ok := match.Fields["seq"].(float64); ok {
+			message.Seq = int64(seq)
+		}
+		if createAt, ok := match.Fields["createAt"].(string); ok {
+			message.CreateAt, _ = time.Parse(time.RFC3339, createAt)
+		}
+
+		snippet := strings.Join(match.Fragments["text"], " … ")
+		if snippet == "" {
+			snippet = highlight(message.Text, words)
+		}
+		hits = append(hits, Hit{Message: message, Snippet: snippet})
+	}
+	return hits, nil
+}
+
+// Close the index
+func (i *BleveIndex) Close() error {
+	return i.index.Close()
+}
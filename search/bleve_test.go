@@ -0,0 +1,193 @@
+package search
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	general = "64b7f0c2a1b2c3d4e5f60718"
+	private = "64b7f0c2a1b2c3d4e5f60719"
+	alice   = "64b7f0c2a1b2c3d4e5f60720"
+	bob     = "64b7f0c2a1b2c3d4e5f60721"
+)
+
+// newTestIndex opens an index in a temporary directory holding the messages
+func newTestIndex(t *testing.T, messages []*model.Message) *BleveIndex {
+	t.Helper()
+
+	index, err := NewBleveIndex(filepath.Join(t.TempDir(), "messages.bleve"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+
+	for _, message := range messages {
+		if err := index.Index(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return index
+}
+
+func TestBleveSearch(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	messages := []*model.Message{
+		{ID: primitive.NewObjectID(), ConversationID: general, Sender: alice, Text: "the deploy is done", Seq: 1, CreateAt: day},
+		{ID: primitive.NewObjectID(), ConversationID: general, Sender: bob, Text: "deploy failed again", Seq: 2, CreateAt: day.Add(24 * time.Hour)},
+		{ID: primitive.NewObjectID(), ConversationID: private, Sender: alice, Text: "secret deploy plans", Seq: 1, CreateAt: day},
+		{ID: primitive.NewObjectID(), ConversationID: general, Sender: alice, Text: "lunch anyone?", Seq: 3, CreateAt: day.Add(48 * time.Hour)},
+	}
+	index := newTestIndex(t, messages)
+
+	from, to := day.Add(12*time.Hour), day.Add(36*time.Hour)
+	tests := []struct {
+		name  string
+		query Query
+		want  []*model.Message
+	}{
+		{name: "member of one conversation", query: Query{Text: "deploy", ConversationIDs: []string{general}}, want: messages[:2]},
+		{name: "member of both conversations", query: Query{Text: "deploy", ConversationIDs: []string{general, private}}, want: messages[:3]},
+		{name: "no conversations", query: Query{Text: "deploy"}},
+		{name: "sender", query: Query{Text: "deploy", ConversationIDs: []string{general, private}, SenderID: alice}, want: []*model.Message{messages[0], messages[2]}},
+		{name: "dates", query: Query{Text: "deploy", ConversationIDs: []string{general}, From: &from, To: &to}, want: messages[1:2]},
+		{name: "from a date", query: Query{Text: "deploy", ConversationIDs: []string{general}, From: &from}, want: messages[1:2]},
+		{name: "up to a date", query: Query{Text: "deploy", ConversationIDs: []string{general}, To: &from}, want: messages[:1]},
+		{name: "no match", query: Query{Text: "holiday", ConversationIDs: []string{general, private}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.query.Limit = 10
+			hits, err := index.Search(context.Background(), test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[primitive.ObjectID]*model.Message{}
+			for _, hit := range hits {
+				got[hit.Message.ID] = hit.Message
+			}
+			if len(hits) != len(test.want) || len(got) != len(test.want) {
+				t.Fatalf("got %d hits, want %d", len(hits), len(test.want))
+			}
+			for _, want := range test.want {
+				message, ok := got[want.ID]
+				if !ok {
+					t.Fatalf("%q is missing from the hits", want.Text)
+				}
+				if message.ConversationID != want.ConversationID || message.Sender != want.Sender || message.Text != want.Text || message.Seq != want.Seq || !message.CreateAt.Equal(want.CreateAt) {
+					t.Fatalf("hit %+v, want %+v", message, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBleveSnippet(t *testing.T) {
+	long := strings.Repeat("filler words ", 40) + "the release is out " + strings.Repeat("more filler ", 40)
+	message := &model.Message{ID: primitive.NewObjectID(), ConversationID: general, Sender: alice, Text: long, CreateAt: time.Now()}
+	index := newTestIndex(t, []*model.Message{message})
+
+	hits, err := index.Search(context.Background(), Query{Text: "release", ConversationIDs: []string{general}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(hits))
+	}
+
+	snippet := hits[0].Snippet
+	if !strings.Contains(snippet, "<mark>release</mark>") {
+		t.Fatalf("snippet %q does not mark the match", snippet)
+	}
+	if len(snippet) >= len(long) {
+		t.Fatalf("snippet is %d bytes, want an excerpt of the %d byte text", len(snippet), len(long))
+	}
+}
+
+func TestBleveIndexReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.bleve")
+	index, err := NewBleveIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &model.Message{ID: primitive.NewObjectID(), ConversationID: general, Sender: alice, Text: "kept on disk", CreateAt: time.Now()}
+	if err := index.Index(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = NewBleveIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	hits, err := index.Search(context.Background(), Query{Text: "disk", ConversationIDs: []string{general}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Message.ID != message.ID {
+		t.Fatalf("hits %+v after reopening, want the indexed message", hits)
+	}
+}
+
+// TestBleveBackfill needs a MongoDB server, it is skipped unless MONGODB_TEST_URI is set
+func TestBleveBackfill(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database("chat_app_test")
+	messages := db.Collection("messages")
+	if _, err := messages.DeleteMany(ctx, bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	defer messages.Drop(ctx)
+
+	for _, text := range []string{"written before the index", "also before the index"} {
+		message := &model.Message{ID: primitive.NewObjectID(), ConversationID: general, Sender: alice, Text: text, CreateAt: time.Now()}
+		if _, err := messages.InsertOne(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := newTestIndex(t, nil)
+	if indexed, err := index.Backfill(ctx, db); err != nil || indexed != 2 {
+		t.Fatalf("Backfill = %d, %v, want 2 messages", indexed, err)
+	}
+
+	hits, err := index.Search(ctx, Query{Text: "before", ConversationIDs: []string{general}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("got %d hits after the backfill, want 2", len(hits))
+	}
+
+	// A finished backfill is not run again
+	if indexed, err := index.Backfill(ctx, db); err != nil || indexed != 0 {
+		t.Fatalf("second Backfill = %d, %v, want nothing indexed", indexed, err)
+	}
+}
@@ -0,0 +1,85 @@
+package search
+
+import (
+	"context"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoIndex searches the messages collection with a text index, messages are indexed by Mongo when they are inserted
+type MongoIndex struct {
+	collection *mongo.Collection
+}
+
+// NewMongoIndex creates a new Mongo text search index
+func NewMongoIndex(db *mongo.Database) *MongoIndex {
+	return &MongoIndex{
+		collection: db.Collection("messages"),
+	}
+}
+
+// Index a new message, the text index is kept up to date by Mongo
+func (i *MongoIndex) Index(ctx context.Context, message *model.Message) error {
+	return nil
+}
+
+// Search messages, best matches first
+func (i *MongoIndex) Search(ctx context.Context, query Query) ([]Hit, error) {
+	if len(query.ConversationIDs) == 0 {
+		return []Hit{}, nil
+	}
+
+	filter := bson.M{
+		"$text":          bson.M{"$search": query.Text},
+		"conversationId": bson.M{"$in": query.ConversationIDs},
+	}
+	if query.SenderID != "" {
+		filter["sender"] = query.SenderID
+	}
+
+	createAt := bson.M{}
+	if query.From != nil {
+		createAt["$gte"] = *query.From
+	}
+	if query.To != nil {
+		createAt["$lte"] = *query.To
+	}
+	if len(createAt) > 0 {
+		filter["createAt"] = createAt
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "createAt", Value: -1}}).
+		SetSkip(query.Offset).
+		SetLimit(query.Limit)
+
+	cursor, err := i.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*model.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	words := terms(query.Text)
+	hits := make([]Hit, len(messages))
+	for n, message := range messages {
+		hits[n] = Hit{Message: message, Snippet: highlight(message.Text, words)}
+	}
+	return hits, nil
+}
+
+// Ensure the text index of the collection, a collection can only have one
+func (i *MongoIndex) EnsureIndexes(ctx context.Context) error {
+	_, err := i.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "text", Value: "text"}},
+	})
+	return err
+}
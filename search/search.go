@@ -0,0 +1,34 @@
+package search
+
+import (
+	"context"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+)
+
+// Query filters a message search, only the messages of the given conversations are searched
+type Query struct {
+	Text            string
+	ConversationIDs []string
+	SenderID        string
+	From            *time.Time
+	To              *time.Time
+	Offset          int64
+	Limit           int64
+}
+
+// Hit is a message matching a search, the snippet is an excerpt of its text with the matches in <mark> tags
+type Hit struct {
+	Message *model.Message `json:"message"`
+	Snippet string         `json:"snippet"`
+}
+
+// SearchIndex finds messages by the words of their text
+type SearchIndex interface {
+	// Index a new message
+	Index(ctx context.Context, message *model.Message) error
+
+	// Search messages, best matches first
+	Search(ctx context.Context, query Query) ([]Hit, error)
+}
@@ -0,0 +1,88 @@
+package search
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bytes of context kept around the first match of a snippet
+const (
+	snippetBefore = 60
+	snippetAfter  = 140
+)
+
+// terms returns the words of a text query without the operators of a Mongo text search
+func terms(text string) []string {
+	words := []string{}
+	for _, word := range strings.Fields(text) {
+		word = strings.Trim(word, `"`)
+		if word == "" || strings.HasPrefix(word, "-") {
+			continue
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// highlight cuts a snippet of text around the first match of the words and wraps every match in <mark> tags
+func highlight(text string, words []string) string {
+	if len(words) == 0 {
+		return snippet(text, 0, len(text), nil)
+	}
+
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	pattern := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+
+	matches := pattern.FindAllStringIndex(text, -1)
+	if len(matches) == 0 {
+		return snippet(text, 0, snippetBefore+snippetAfter, nil)
+	}
+
+	start := matches[0][0] - snippetBefore
+	end := matches[0][0] + snippetAfter
+	return snippet(text, start, end, matches)
+}
+
+// snippet escapes text[start:end] and marks the matches inside it
+func snippet(text string, start int, end int, matches [][]int) string {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+
+	at := start
+	for _, match := range matches {
+		if match[0] < at || match[1] > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[at:match[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[match[0]:match[1]]))
+		b.WriteString("</mark>")
+		at = match[1]
+	}
+	b.WriteString(html.EscapeString(text[at:end]))
+
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/guutong/chat-backend/mailer"
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrInvalidToken     = errors.New("invalid or expired token")
+	ErrEmailNotVerified = errors.New("email not verified")
+	ErrEmailTaken       = errors.New("email already exists")
+	ErrNoEmail          = errors.New("user has no email")
+)
+
+// UnverifiedPolicy controls what accounts without a verified email are allowed to do
+type UnverifiedPolicy string
+
+const (
+	// UnverifiedAllow does not restrict unverified accounts
+	UnverifiedAllow UnverifiedPolicy = "allow"
+
+	// UnverifiedReadOnly lets unverified accounts log in but not start conversations or send messages
+	UnverifiedReadOnly UnverifiedPolicy = "read-only"
+
+	// UnverifiedDeny does not let unverified accounts log in, accounts without an email included.
+	// New accounts must give an email, older accounts without one need the read-only policy to add it.
+	UnverifiedDeny UnverifiedPolicy = "deny"
+)
+
+// AccountConfig is the configuration of the account service
+type AccountConfig struct {
+	Secret           string
+	AppURL           string
+	VerifyTokenTTL   time.Duration
+	ResetTokenTTL    time.Duration
+	UnverifiedPolicy UnverifiedPolicy
+}
+
+type IAccountService interface {
+	// Send an email verification link to the user
+	RequestEmailVerification(ctx context.Context, userID string) error
+
+	// Send an email verification link to the owner of an unverified email
+	ResendEmailVerification(ctx context.Context, email string) error
+
+	// Change the email of a user and send a verification link
+	ChangeEmail(ctx context.Context, userID string, email string) error
+
+	// Verify an email with a verification token
+	VerifyEmail(ctx context.Context, token string) error
+
+	// Send a password reset link to the owner of the email
+	RequestPasswordReset(ctx context.Context, email string) error
+
+	// Reset a password with a reset token, the password is given in plain text
+	ResetPassword(ctx context.Context, token string, password string) error
+
+	// Check whether a user may log in
+	CanLogin(user *model.User) bool
+
+	// Check whether new accounts must give an email
+	RequiresEmail() bool
+
+	// Check whether a user may start conversations and send messages
+	CanSendMessages(ctx context.Context, userID string) (bool, error)
+}
+
+// AccountService is a service for email verification and password reset
+type AccountService struct {
+	userRepository  repository.IUserRepository
+	tokenRepository repository.ITokenRepository
+	mailer          mailer.Mailer
+	passwordPolicy  PasswordPolicy
+	config          AccountConfig
+}
+
+// NewAccountService creates a new account service
+func NewAccountService(
+	userRepository repository.IUserRepository,
+	tokenRepository repository.ITokenRepository,
+	mailer mailer.Mailer,
+	passwordPolicy PasswordPolicy,
+	config AccountConfig,
+) *AccountService {
+	return &AccountService{
+		userRepository:  userRepository,
+		tokenRepository: tokenRepository,
+		mailer:          mailer,
+		passwordPolicy:  passwordPolicy,
+		config:          config,
+	}
+}
+
+// Send an email verification link to the user
+func (s *AccountService) RequestEmailVerification(ctx context.Context, userID string) error {
+	user, err := s.userRepository.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+
+	if user.EmailVerified {
+		return nil
+	}
+
+	token, err := s.issueToken(ctx, user, model.TokenPurposeVerifyEmail, s.config.VerifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mailer.Mail{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease verify your email by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.Username, s.link("/verify-email", token), s.config.VerifyTokenTTL,
+		),
+	})
+}
+
+// Send an email verification link to the owner of an unverified email.
+// It does not report whether the email exists.
+func (s *AccountService) ResendEmailVerification(ctx context.Context, email string) error {
+	user, err := s.userRepository.FindByEmail(ctx, strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+
+	return s.RequestEmailVerification(ctx, user.ID.Hex())
+}
+
+// Change the email of a user and send a verification link
+func (s *AccountService) ChangeEmail(ctx context.Context, userID string, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if err := s.userRepository.UpdateEmail(ctx, userID, email); err != nil {
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			return ErrEmailTaken
+		}
+		return err
+	}
+
+	// Tokens issued for the previous email must not verify the new one
+	if err := s.tokenRepository.DeleteByUserID(ctx, userID, model.TokenPurposeVerifyEmail); err != nil {
+		return err
+	}
+
+	return s.RequestEmailVerification(ctx, userID)
+}
+
+// Verify an email with a verification token
+func (s *AccountService) VerifyEmail(ctx context.Context, token string) error {
+	record, err := s.consumeToken(ctx, token, model.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	if err := s.userRepository.VerifyEmail(ctx, record.UserID.Hex(), record.Email); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Send a password reset link to the owner of the email.
+// It does not report whether the email exists.
+func (s *AccountService) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := s.userRepository.FindByEmail(ctx, strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+
+	// Only the latest reset link is valid
+	if err := s.tokenRepository.DeleteByUserID(ctx, user.ID.Hex(), model.TokenPurposeResetPassword); err != nil {
+		return err
+	}
+
+	token, err := s.issueToken(ctx, user, model.TokenPurposeResetPassword, s.config.ResetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mailer.Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone requested a password reset for your account. Open the link below to choose a new password:\n\n%s\n\nThe link expires in %s. If you did not request it you can ignore this email.\n",
+			user.Username, s.link("/reset-password", token), s.config.ResetTokenTTL,
+		),
+	})
+}
+
+// Reset a password with a reset token, the password is given in plain text
+func (s *AccountService) ResetPassword(ctx context.Context, token string, password string) error {
+	tokenID, err := s.parseToken(token, model.TokenPurposeResetPassword)
+	if err != nil {
+		return err
+	}
+
+	// Check the policy before the token is consumed so a rejected password does not burn the link
+	record, err := s.tokenRepository.FindByID(ctx, tokenID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	user, err := s.userRepository.FindByID(ctx, record.UserID.Hex())
+	if err != nil {
+		return err
+	}
+
+	if err := s.passwordPolicy.Validate(password, user.Username); err != nil {
+		return err
+	}
+
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.consumeToken(ctx, token, model.TokenPurposeResetPassword); err != nil {
+		return err
+	}
+
+	if err := s.userRepository.UpdatePassword(ctx, user.ID.Hex(), hashed); err != nil {
+		return err
+	}
+
+	// Receiving the reset link proves the ownership of the email
+	if err := s.userRepository.VerifyEmail(ctx, record.UserID.Hex(), record.Email); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	return nil
+}
+
+// Check whether a user may log in
+func (s *AccountService) CanLogin(user *model.User) bool {
+	return s.config.UnverifiedPolicy != UnverifiedDeny || user.EmailVerified
+}
+
+// Check whether new accounts must give an email, they could not log in without verifying one
+func (s *AccountService) RequiresEmail() bool {
+	return s.config.UnverifiedPolicy == UnverifiedDeny
+}
+
+// Check whether a user may start conversations and send messages
+func (s *AccountService) CanSendMessages(ctx context.Context, userID string) (bool, error) {
+	if s.config.UnverifiedPolicy == UnverifiedAllow || s.config.UnverifiedPolicy == "" {
+		return true, nil
+	}
+
+	user, err := s.userRepository.FindByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return user.EmailVerified, nil
+}
+
+func (s *AccountService) issueToken(ctx context.Context, user *model.User, purpose string, ttl time.Duration) (string, error) {
+	expireAt := time.Now().Add(ttl)
+	record := &model.UserToken{
+		UserID:   user.ID,
+		Purpose:  purpose,
+		Email:    user.Email,
+		ExpireAt: expireAt,
+	}
+	if err := s.tokenRepository.Create(ctx, record); err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"tokenId": record.ID.Hex(),
+		"purpose": purpose,
+		"exp":     expireAt.Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s.config.Secret))
+}
+
+func (s *AccountService) consumeToken(ctx context.Context, tokenString string, purpose string) (*model.UserToken, error) {
+	tokenID, err := s.parseToken(tokenString, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := s.tokenRepository.Consume(ctx, tokenID, purpose)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// parseToken verifies a signed token and returns the id of its record
+func (s *AccountService) parseToken(tokenString string, purpose string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+		return []byte(s.config.Secret), nil
+	})
+	if err != nil || !token.Valid {
+		return "", ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return "", ErrInvalidToken
+	}
+
+	tokenID, ok := claims["tokenId"].(string)
+	if !ok || !primitive.IsValidObjectID(tokenID) {
+		return "", ErrInvalidToken
+	}
+
+	return tokenID, nil
+}
+
+func (s *AccountService) link(path string, token string) string {
+	return s.config.AppURL + path + "?token=" + url.QueryEscape(token)
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/mailer"
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// accountUsers keeps users in memory by id
+type accountUsers struct {
+	repository.IUserRepository
+	users map[string]*model.User
+}
+
+func (r *accountUsers) FindByID(ctx context.Context, id string) (*model.User, error) {
+	if user, ok := r.users[id]; ok {
+		return user, nil
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (r *accountUsers) FindByEmail(ctx context.Context, email string) (*model.User, error) {
+	for _, user := range r.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (r *accountUsers) UpdatePassword(ctx context.Context, id string, password string) error {
+	r.users[id].Password = password
+	return nil
+}
+
+func (r *accountUsers) VerifyEmail(ctx context.Context, id string, email string) error {
+	user, ok := r.users[id]
+	if !ok || user.Email != email {
+		return mongo.ErrNoDocuments
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+// accountTokens keeps token records in memory the way the repository stores them
+type accountTokens struct {
+	tokens map[primitive.ObjectID]*model.UserToken
+}
+
+func (r *accountTokens) Create(ctx context.Context, token *model.UserToken) error {
+	token.ID = primitive.NewObjectID()
+	r.tokens[token.ID] = token
+	return nil
+}
+
+func (r *accountTokens) FindByID(ctx context.Context, id string) (*model.UserToken, error) {
+	objectID, _ := primitive.ObjectIDFromHex(id)
+	if token, ok := r.tokens[objectID]; ok && token.ExpireAt.After(time.Now()) {
+		return token, nil
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (r *accountTokens) Consume(ctx context.Context, id string, purpose string) (*model.UserToken, error) {
+	token, err := r.FindByID(ctx, id)
+	if err != nil || token.Purpose != purpose {
+		return nil, mongo.ErrNoDocuments
+	}
+	delete(r.tokens, token.ID)
+	return token, nil
+}
+
+func (r *accountTokens) DeleteByUserID(ctx context.Context, userID string, purpose string) error {
+	for id, token := range r.tokens {
+		if token.UserID.Hex() == userID && token.Purpose == purpose {
+			delete(r.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (r *accountTokens) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// newAccountService returns an account service with one unverified user, alice
+func newAccountService(t *testing.T, config AccountConfig) (*AccountService, *model.User, *mailer.MemoryMailer) {
+	t.Helper()
+
+	alice := &model.User{ID: primitive.NewObjectID(), Username: "alice", Email: "alice@example.com"}
+	users := &accountUsers{users: map[string]*model.User{alice.ID.Hex(): alice}}
+	tokens := &accountTokens{tokens: map[primitive.ObjectID]*model.UserToken{}}
+	sent := mailer.NewMemoryMailer()
+
+	config.Secret = "secret"
+	config.AppURL = "http://localhost"
+	if config.VerifyTokenTTL == 0 {
+		config.VerifyTokenTTL = time.Hour
+	}
+	if config.ResetTokenTTL == 0 {
+		config.ResetTokenTTL = time.Hour
+	}
+	return NewAccountService(users, tokens, sent, PasswordPolicy{MinLength: 8}, config), alice, sent
+}
+
+// mailedToken returns the token of the last link sent to an email
+func mailedToken(t *testing.T, sent *mailer.MemoryMailer, to string) string {
+	t.Helper()
+
+	mail, ok := sent.Last(to)
+	if !ok {
+		t.Fatalf("no email was sent to %s", to)
+	}
+	start := strings.Index(mail.Body, "http://")
+	if start < 0 {
+		t.Fatalf("no link in %q", mail.Body)
+	}
+	link, err := url.Parse(strings.Fields(mail.Body[start:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestVerifyEmailTokenIsSingleUse(t *testing.T) {
+	s, alice, sent := newAccountService(t, AccountConfig{})
+	ctx := context.Background()
+
+	if err := s.RequestEmailVerification(ctx, alice.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	token := mailedToken(t, sent, alice.Email)
+
+	if err := s.VerifyEmail(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.EmailVerified {
+		t.Fatal("the email was not verified")
+	}
+	if err := s.VerifyEmail(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("second use: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestVerifyEmailTokenExpires(t *testing.T) {
+	s, alice, sent := newAccountService(t, AccountConfig{VerifyTokenTTL: -time.Minute})
+	ctx := context.Background()
+
+	if err := s.RequestEmailVerification(ctx, alice.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyEmail(ctx, mailedToken(t, sent, alice.Email)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("err = %v, want ErrInvalidToken", err)
+	}
+	if alice.EmailVerified {
+		t.Fatal("an expired token verified the email")
+	}
+}
+
+func TestTokenPurposeMismatch(t *testing.T) {
+	s, alice, sent := newAccountService(t, AccountConfig{})
+	ctx := context.Background()
+
+	if err := s.RequestPasswordReset(ctx, alice.Email); err != nil {
+		t.Fatal(err)
+	}
+	reset := mailedToken(t, sent, alice.Email)
+	if err := s.VerifyEmail(ctx, reset); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("reset token verified an email: err = %v, want ErrInvalidToken", err)
+	}
+
+	if err := s.RequestEmailVerification(ctx, alice.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	verify := mailedToken(t, sent, alice.Email)
+	if err := s.ResetPassword(ctx, verify, "correct horse battery"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("verification token reset a password: err = %v, want ErrInvalidToken", err)
+	}
+
+	// The rejected reset token is still valid for its own purpose
+	if err := s.ResetPassword(ctx, reset, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.EmailVerified {
+		t.Fatal("a password reset did not verify the email")
+	}
+}
+
+func TestResendEmailVerification(t *testing.T) {
+	s, alice, sent := newAccountService(t, AccountConfig{UnverifiedPolicy: UnverifiedDeny})
+	ctx := context.Background()
+
+	if err := s.ResendEmailVerification(ctx, "nobody@example.com"); err != nil {
+		t.Fatalf("an unknown email: err = %v, want nil", err)
+	}
+	if len(sent.Sent()) != 0 {
+		t.Fatal("an email was sent for an unknown address")
+	}
+
+	if err := s.ResendEmailVerification(ctx, "  Alice@Example.com "); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyEmail(ctx, mailedToken(t, sent, alice.Email)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A verified email gets no more links
+	if err := s.ResendEmailVerification(ctx, alice.Email); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Sent()) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent.Sent()))
+	}
+}
+
+func TestUnverifiedPolicy(t *testing.T) {
+	tests := []struct {
+		policy        UnverifiedPolicy
+		verified      bool
+		email         string
+		login         bool
+		send          bool
+		requiresEmail bool
+	}{
+		{policy: "", email: "alice@example.com", login: true, send: true},
+		{policy: UnverifiedAllow, email: "alice@example.com", login: true, send: true},
+		{policy: UnverifiedAllow, login: true, send: true},
+		{policy: UnverifiedReadOnly, email: "alice@example.com", login: true},
+		{policy: UnverifiedReadOnly, login: true},
+		{policy: UnverifiedReadOnly, verified: true, email: "alice@example.com", login: true, send: true},
+		{policy: UnverifiedDeny, email: "alice@example.com", requiresEmail: true},
+		{policy: UnverifiedDeny, requiresEmail: true},
+		{policy: UnverifiedDeny, verified: true, email: "alice@example.com", login: true, send: true, requiresEmail: true},
+	}
+
+	for _, test := range tests {
+		s, alice, _ := newAccountService(t, AccountConfig{UnverifiedPolicy: test.policy})
+		alice.Email = test.email
+		alice.EmailVerified = test.verified
+
+		if login := s.CanLogin(alice); login != test.login {
+			t.Errorf("%q verified %v email %q: CanLogin = %v, want %v", test.policy, test.verified, test.email, login, test.login)
+		}
+
+		send, err := s.CanSendMessages(context.Background(), alice.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if send != test.send {
+			t.Errorf("%q verified %v email %q: CanSendMessages = %v, want %v", test.policy, test.verified, test.email, send, test.send)
+		}
+
+		if requires := s.RequiresEmail(); requires != test.requiresEmail {
+			t.Errorf("%q: RequiresEmail = %v, want %v", test.policy, requires, test.requiresEmail)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+type IAuditService interface {
+	// Record an audit event
+	Record(ctx context.Context, eventType string, subject string, detail map[string]string)
+}
+
+// AuditService is a service for audit events
+type AuditService struct {
+	repository repository.IAuditRepository
+}
+
+// NewAuditService creates a new audit service
+func NewAuditService(repository repository.IAuditRepository) *AuditService {
+	return &AuditService{
+		repository: repository,
+	}
+}
+
+// Record an audit event, the event is always written to the log even if it cannot be stored
+func (s *AuditService) Record(ctx context.Context, eventType string, subject string, detail map[string]string) {
+	log.Printf("audit: %s %s %v", eventType, subject, detail)
+
+	event := &model.AuditEvent{
+		Type:    eventType,
+		Subject: subject,
+		Detail:  detail,
+	}
+	if err := s.repository.Create(ctx, event); err != nil {
+		log.Println("audit:", err)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+var (
+	ErrBlocked       = errors.New("user is blocked")
+	ErrInvalidTarget = errors.New("invalid user")
+)
+
+type IBlockService interface {
+	// Block a user, blocked users cannot message each other or find each other
+	Block(ctx context.Context, userID string, targetID string) error
+
+	// Unblock a user
+	Unblock(ctx context.Context, userID string, targetID string) error
+
+	// Mute a user, messages from muted users are delivered without notifications
+	Mute(ctx context.Context, userID string, targetID string) error
+
+	// Unmute a user
+	Unmute(ctx context.Context, userID string, targetID string) error
+
+	// Check whether either of two users blocked the other
+	IsBlocked(ctx context.Context, userID string, otherID string) (bool, error)
+
+	// Check whether a user muted another user
+	IsMuted(ctx context.Context, userID string, targetID string) (bool, error)
+
+	// Find the users among the given ones that blocked each other, each of them is mapped to the users hidden from them
+	FindBlockedAmong(ctx context.Context, userIDs []string) (map[string]map[string]bool, error)
+
+	// List the users blocked by a user
+	ListBlocked(ctx context.Context, userID string) ([]*model.User, error)
+
+	// List the users muted by a user
+	ListMuted(ctx context.Context, userID string) ([]*model.User, error)
+}
+
+// BlockService is a service for blocking and muting users
+type BlockService struct {
+	repository repository.IUserRepository
+}
+
+// NewBlockService creates a new block service
+func NewBlockService(repository repository.IUserRepository) *BlockService {
+	return &BlockService{
+		repository: repository,
+	}
+}
+
+// Block a user, blocked users cannot message each other or find each other
+func (s *BlockService) Block(ctx context.Context, userID string, targetID string) error {
+	if err := s.checkTarget(ctx, userID, targetID); err != nil {
+		return err
+	}
+
+	return s.repository.Block(ctx, userID, targetID)
+}
+
+// Unblock a user
+func (s *BlockService) Unblock(ctx context.Context, userID string, targetID string) error {
+	return s.repository.Unblock(ctx, userID, targetID)
+}
+
+// Mute a user, messages from muted users are delivered without notifications
+func (s *BlockService) Mute(ctx context.Context, userID string, targetID string) error {
+	if err := s.checkTarget(ctx, userID, targetID); err != nil {
+		return err
+	}
+
+	return s.repository.Mute(ctx, userID, targetID)
+}
+
+// Unmute a user
+func (s *BlockService) Unmute(ctx context.Context, userID string, targetID string) error {
+	return s.repository.Unmute(ctx, userID, targetID)
+}
+
+// Check whether either of two users blocked the other
+func (s *BlockService) IsBlocked(ctx context.Context, userID string, otherID string) (bool, error) {
+	return s.repository.IsBlocked(ctx, userID, otherID)
+}
+
+// Find the users among the given ones that blocked each other, each of them is mapped to the users hidden from them
+func (s *BlockService) FindBlockedAmong(ctx context.Context, userIDs []string) (map[string]map[string]bool, error) {
+	users, err := s.repository.FindByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	among := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		among[userID] = true
+	}
+
+	// A block hides the users from each other whichever of them blocked
+	hidden := map[string]map[string]bool{}
+	hide := func(userID string, otherID string) {
+		if hidden[userID] == nil {
+			hidden[userID] = map[string]bool{}
+		}
+		hidden[userID][otherID] = true
+	}
+	for _, user := range users {
+		for _, blockedID := range user.BlockedUsers {
+			if among[blockedID] {
+				hide(user.ID.Hex(), blockedID)
+				hide(blockedID, user.ID.Hex())
+			}
+		}
+	}
+
+	return hidden, nil
+}
+
+// Check whether a user muted another user
+func (s *BlockService) IsMuted(ctx context.Context, userID string, targetID string) (bool, error) {
+	user, err := s.repository.FindByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return contains(user.MutedUsers, targetID), nil
+}
+
+// List the users blocked by a user
+func (s *BlockService) ListBlocked(ctx context.Context, userID string) ([]*model.User, error) {
+	user, err := s.repository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repository.FindByIDs(ctx, user.BlockedUsers)
+}
+
+// List the users muted by a user
+func (s *BlockService) ListMuted(ctx context.Context, userID string) ([]*model.User, error) {
+	user, err := s.repository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repository.FindByIDs(ctx, user.MutedUsers)
+}
+
+func (s *BlockService) checkTarget(ctx context.Context, userID string, targetID string) error {
+	if userID == targetID {
+		return ErrInvalidTarget
+	}
+
+	if _, err := s.repository.FindByID(ctx, targetID); err != nil {
+		return ErrInvalidTarget
+	}
+
+	return nil
+}
+
+func contains(ids []string, id string) bool {
+	for _, item := range ids {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrAlreadyContact          = errors.New("user is already a contact")
+	ErrContactRequestExists    = errors.New("contact request already sent")
+	ErrContactRequestNotFound  = errors.New("contact request not found")
+	ErrContactsOnly            = errors.New("user only accepts messages from contacts")
+	ErrContactRequestForbidden = errors.New("contact request belongs to another user")
+)
+
+type IContactService interface {
+	// Send a contact request, a pending request in the other direction is accepted instead
+	SendRequest(ctx context.Context, userID string, targetID string) (*model.ContactRequest, error)
+
+	// Accept a contact request sent to the user
+	Accept(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error)
+
+	// Decline a contact request sent to the user
+	Decline(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error)
+
+	// Cancel a contact request sent by the user
+	Cancel(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error)
+
+	// List the pending requests sent to the user, or sent by the user when outgoing is true
+	ListRequests(ctx context.Context, userID string, outgoing bool) ([]*model.ContactRequest, error)
+
+	// List the contacts of the user
+	ListContacts(ctx context.Context, userID string) ([]*model.User, error)
+
+	// Remove a contact in both directions
+	RemoveContact(ctx context.Context, userID string, contactID string) error
+
+	// Set whether the user only accepts direct messages from contacts
+	SetDMContactsOnly(ctx context.Context, userID string, contactsOnly bool) error
+
+	// Check whether a user may start a direct conversation with a recipient
+	CanMessage(ctx context.Context, userID string, recipient *model.User) error
+}
+
+// ContactService is a service for contacts and contact requests
+type ContactService struct {
+	repository     repository.IContactRepository
+	userRepository repository.IUserRepository
+}
+
+// NewContactService creates a new contact service
+func NewContactService(repository repository.IContactRepository, userRepository repository.IUserRepository) *ContactService {
+	return &ContactService{
+		repository:     repository,
+		userRepository: userRepository,
+	}
+}
+
+// Send a contact request, a pending request in the other direction is accepted instead
+func (s *ContactService) SendRequest(ctx context.Context, userID string, targetID string) (*model.ContactRequest, error) {
+	if userID == targetID {
+		return nil, ErrInvalidTarget
+	}
+
+	target, err := s.userRepository.FindByID(ctx, targetID)
+	if err != nil {
+		return nil, ErrInvalidTarget
+	}
+
+	if target.HasContact(userID) {
+		return nil, ErrAlreadyContact
+	}
+
+	blocked, err := s.userRepository.IsBlocked(ctx, userID, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if blocked {
+		return nil, ErrBlocked
+	}
+
+	if reverse, err := s.repository.FindPending(ctx, targetID, userID); err == nil {
+		return s.Accept(ctx, userID, reverse.ID.Hex())
+	}
+
+	request := &model.ContactRequest{
+		From: userID,
+		To:   targetID,
+	}
+	if err := s.repository.Create(ctx, request); err != nil {
+		if errors.Is(err, repository.ErrDuplicateContactRequest) {
+			return nil, ErrContactRequestExists
+		}
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// Accept a contact request sent to the user
+func (s *ContactService) Accept(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error) {
+	request, err := s.resolve(ctx, requestID, model.ContactRequestAccepted, func(request *model.ContactRequest) bool {
+		return request.To == userID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepository.AddContact(ctx, request.From, request.To); err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepository.AddContact(ctx, request.To, request.From); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// Decline a contact request sent to the user
+func (s *ContactService) Decline(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error) {
+	return s.resolve(ctx, requestID, model.ContactRequestDeclined, func(request *model.ContactRequest) bool {
+		return request.To == userID
+	})
+}
+
+// Cancel a contact request sent by the user
+func (s *ContactService) Cancel(ctx context.Context, userID string, requestID string) (*model.ContactRequest, error) {
+	return s.resolve(ctx, requestID, model.ContactRequestCancelled, func(request *model.ContactRequest) bool {
+		return request.From == userID
+	})
+}
+
+// List the pending requests sent to the user, or sent by the user when outgoing is true
+func (s *ContactService) ListRequests(ctx context.Context, userID string, outgoing bool) ([]*model.ContactRequest, error) {
+	return s.repository.FindPendingByUser(ctx, userID, outgoing)
+}
+
+// List the contacts of the user
+func (s *ContactService) ListContacts(ctx context.Context, userID string) ([]*model.User, error) {
+	user, err := s.userRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.userRepository.FindByIDs(ctx, user.Contacts)
+}
+
+// Remove a contact in both directions
+func (s *ContactService) RemoveContact(ctx context.Context, userID string, contactID string) error {
+	if err := s.userRepository.RemoveContact(ctx, userID, contactID); err != nil {
+		return err
+	}
+
+	return s.userRepository.RemoveContact(ctx, contactID, userID)
+}
+
+// Set whether the user only accepts direct messages from contacts
+func (s *ContactService) SetDMContactsOnly(ctx context.Context, userID string, contactsOnly bool) error {
+	return s.userRepository.SetDMContactsOnly(ctx, userID, contactsOnly)
+}
+
+// Check whether a user may start a direct conversation with a recipient
+func (s *ContactService) CanMessage(ctx context.Context, userID string, recipient *model.User) error {
+	if recipient.DMContactsOnly && !recipient.HasContact(userID) {
+		return ErrContactsOnly
+	}
+
+	return nil
+}
+
+func (s *ContactService) resolve(ctx context.Context, requestID string, status string, allowed func(*model.ContactRequest) bool) (*model.ContactRequest, error) {
+	request, err := s.repository.FindByID(ctx, requestID)
+	if err != nil {
+		return nil, ErrContactRequestNotFound
+	}
+
+	if !allowed(request) {
+		return nil, ErrContactRequestForbidden
+	}
+
+	resolved, err := s.repository.Resolve(ctx, requestID, status)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrContactRequestNotFound
+		}
+		return nil, err
+	}
+
+	return resolved, nil
+}
@@ -2,9 +2,14 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type IConversationService interface {
@@ -14,28 +19,50 @@ type IConversationService interface {
 	// Find a conversation by user id
 	FindByUserID(ctx context.Context, userID string) ([]*model.Conversation, error)
 
-	// Find a conversation by user id pagination
-	FindByUserIDPagination(ctx context.Context, userID string, page int64, limit int64) ([]*model.Conversation, error)
+	// Find a page of the conversations of a user, the ones they pinned first and then by latest activity
+	FindByUserIDPagination(ctx context.Context, userID string, archived bool, cursor string, limit int64) ([]*model.Conversation, string, error)
 
 	// Find a conversation by id
 	FindByID(ctx context.Context, id string) (*model.Conversation, error)
 
-	// Join a conversation
-	Join(ctx context.Context, conversationID string, userID string) error
+	// Add a member to a conversation, it returns false when the user was already a member
+	Join(ctx context.Context, conversationID string, member *model.User) (bool, error)
 
 	// Find a conversation by pair of user id
 	FindByPair(ctx context.Context, userID string, recipientID string) (*model.Conversation, error)
+
+	// Pin or unpin a conversation in the list of a member
+	SetPinned(ctx context.Context, conversationID string, userID string, pinned bool) error
+
+	// Archive or unarchive a conversation for a member
+	SetArchived(ctx context.Context, conversationID string, userID string, archived bool) error
+
+	// Pin a message of a conversation for every member, it returns false when the message was already pinned
+	PinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID, userID string) (bool, error)
+
+	// Unpin a message of a conversation, it returns false when the message was not pinned
+	UnpinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID) (bool, error)
 }
 
+var (
+	// ErrPinLimit means the conversation has as many pinned messages as it can have
+	ErrPinLimit = errors.New("pinned message limit reached")
+
+	// ErrInvalidCursor means a page cursor was not returned by a previous page
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
 // ConversationService is a Service for conversation
 type ConversationService struct {
-	repository repository.IConversationRepository
+	repository        repository.IConversationRepository
+	maxPinnedMessages int
 }
 
-// NewConversationService creates a new conversation Service
-func NewConversationService(repository repository.IConversationRepository) *ConversationService {
+// NewConversationService creates a new conversation Service, a conversation has at most maxPinnedMessages pinned messages, it must be positive
+func NewConversationService(repository repository.IConversationRepository, maxPinnedMessages int) *ConversationService {
 	return &ConversationService{
-		repository: repository,
+		repository:        repository,
+		maxPinnedMessages: maxPinnedMessages,
 	}
 }
 
@@ -49,9 +76,44 @@ func (s *ConversationService) FindByUserID(ctx context.Context, userID string) (
 	return s.repository.FindByUserID(ctx, userID)
 }
 
-// Find a conversation by user id pagination
-func (s *ConversationService) FindByUserIDPagination(ctx context.Context, userID string, page int64, limit int64) ([]*model.Conversation, error) {
-	return s.repository.FindByUserIDPagination(ctx, userID, page, limit)
+// Find a page of the conversations of a user, the ones they pinned first and then by latest activity.
+// It returns the cursor of the next page, empty on the last page.
+func (s *ConversationService) FindByUserIDPagination(ctx context.Context, userID string, archived bool, cursor string, limit int64) ([]*model.Conversation, string, error) {
+	var after *repository.ConversationCursor
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+
+		after = &repository.ConversationCursor{}
+		if err := json.Unmarshal(b, after); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	// One more conversation than asked tells whether there is a next page
+	conversations, err := s.repository.FindByUserIDPagination(ctx, userID, archived, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(conversations)) <= limit {
+		return conversations, "", nil
+	}
+
+	conversations = conversations[:limit]
+	last := conversations[limit-1]
+	b, err := json.Marshal(repository.ConversationCursor{
+		Pinned:     last.IsPinnedBy(userID),
+		ActivityAt: last.ActivityAt(),
+		ID:         last.ID,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return conversations, base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // Find a conversation by id
@@ -59,12 +121,42 @@ func (s *ConversationService) FindByID(ctx context.Context, id string) (*model.C
 	return s.repository.FindByID(ctx, id)
 }
 
-// Join a conversation
-func (s *ConversationService) Join(ctx context.Context, conversationID string, userID string) error {
-	return s.repository.Join(ctx, conversationID, userID)
+// Add a member to a conversation, it returns false when the user was already a member
+func (s *ConversationService) Join(ctx context.Context, conversationID string, member *model.User) (bool, error) {
+	return s.repository.Join(ctx, conversationID, member)
 }
 
 // Find a conversation by pair of user id
 func (s *ConversationService) FindByPair(ctx context.Context, userID string, recipientID string) (*model.Conversation, error) {
 	return s.repository.FindByPair(ctx, userID, recipientID)
 }
+
+// Pin or unpin a conversation in the list of a member
+func (s *ConversationService) SetPinned(ctx context.Context, conversationID string, userID string, pinned bool) error {
+	return s.repository.SetPinned(ctx, conversationID, userID, pinned)
+}
+
+// Archive or unarchive a conversation for a member
+func (s *ConversationService) SetArchived(ctx context.Context, conversationID string, userID string, archived bool) error {
+	return s.repository.SetArchived(ctx, conversationID, userID, archived)
+}
+
+// Pin a message of a conversation for every member, it returns false when the message was already pinned
+func (s *ConversationService) PinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID, userID string) (bool, error) {
+	pin := model.PinnedMessage{
+		MessageID: messageID,
+		PinnedBy:  userID,
+		PinnedAt:  time.Now(),
+	}
+
+	pinned, err := s.repository.PinMessage(ctx, conversationID, pin, s.maxPinnedMessages)
+	if errors.Is(err, repository.ErrPinLimit) {
+		return false, ErrPinLimit
+	}
+	return pinned, err
+}
+
+// Unpin a message of a conversation, it returns false when the message was not pinned
+func (s *ConversationService) UnpinMessage(ctx context.Context, conversationID string, messageID primitive.ObjectID) (bool, error) {
+	return s.repository.UnpinMessage(ctx, conversationID, messageID)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+var (
+	// ErrEventsExpired means the missed events are no longer in the log and the client has to reload its state
+	ErrEventsExpired = errors.New("events expired")
+)
+
+type IEventService interface {
+	// Append an event to the log of a user
+	Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error)
+
+	// Replay the events of a user after a sequence number, it also returns the latest sequence number of the user
+	Replay(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, int64, error)
+
+	// Find the cursor of a user
+	FindCursor(ctx context.Context, userID string) (*model.EventCursor, error)
+
+	// Acknowledge the events of a user up to a sequence number, it returns the events that were not acknowledged before
+	Ack(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, error)
+}
+
+// EventService is a service for the event logs of users
+type EventService struct {
+	repository  repository.IEventRepository
+	replayLimit int64
+}
+
+// NewEventService creates a new event service, a replay returns at most replayLimit events
+func NewEventService(repository repository.IEventRepository, replayLimit int64) *EventService {
+	return &EventService{
+		repository:  repository,
+		replayLimit: replayLimit,
+	}
+}
+
+// Append an event to the log of a user
+func (s *EventService) Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error) {
+	return s.repository.Append(ctx, userID, event, message)
+}
+
+// Replay the events of a user after a sequence number, it also returns the latest sequence number of the user.
+// It fails with ErrEventsExpired when the log cannot fill the whole gap.
+func (s *EventService) Replay(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, int64, error) {
+	cursor, err := s.repository.FindCursor(ctx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A client ahead of the server did not get its sequence numbers from this log
+	if seq > cursor.Seq {
+		return nil, cursor.Seq, ErrEventsExpired
+	}
+
+	missed := cursor.Seq - seq
+	if missed == 0 {
+		return []*model.UserEvent{}, cursor.Seq, nil
+	}
+	if missed > s.replayLimit {
+		return nil, cursor.Seq, ErrEventsExpired
+	}
+
+	events, err := s.repository.FindAfter(ctx, userID, seq, missed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Expired events leave a hole in the log, the replay must cover every missed number
+	if int64(len(events)) != missed {
+		return nil, cursor.Seq, ErrEventsExpired
+	}
+	for i, event := range events {
+		if event.Seq != seq+int64(i)+1 {
+			return nil, cursor.Seq, ErrEventsExpired
+		}
+	}
+
+	return events, cursor.Seq, nil
+}
+
+// Find the cursor of a user
+func (s *EventService) FindCursor(ctx context.Context, userID string) (*model.EventCursor, error) {
+	return s.repository.FindCursor(ctx, userID)
+}
+
+// Acknowledge the events of a user up to a sequence number, it returns the events that were not acknowledged before.
+// At most the replay limit of events is returned, the oldest ones are left out.
+func (s *EventService) Ack(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, error) {
+	acked, err := s.repository.Ack(ctx, userID, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	if acked >= seq {
+		return []*model.UserEvent{}, nil
+	}
+
+	if seq-acked > s.replayLimit {
+		acked = seq - s.replayLimit
+	}
+	return s.repository.FindAfter(ctx, userID, acked, seq-acked)
+}
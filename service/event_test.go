@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/guutong/chat-backend/model"
+)
+
+// eventLog is an in-memory event repository holding the events left in the log
+type eventLog struct {
+	seq    int64
+	events []*model.UserEvent
+}
+
+func (l *eventLog) Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error) {
+	l.seq++
+	userEvent := &model.UserEvent{UserID: userID, Seq: l.seq, Event: event, Message: message}
+	l.events = append(l.events, userEvent)
+	return userEvent, nil
+}
+
+func (l *eventLog) FindAfter(ctx context.Context, userID string, seq int64, limit int64) ([]*model.UserEvent, error) {
+	events := []*model.UserEvent{}
+	for _, event := range l.events {
+		if event.Seq > seq && int64(len(events)) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (l *eventLog) FindCursor(ctx context.Context, userID string) (*model.EventCursor, error) {
+	return &model.EventCursor{UserID: userID, Seq: l.seq}, nil
+}
+
+func (l *eventLog) Ack(ctx context.Context, userID string, seq int64) (int64, error) {
+	return 0, nil
+}
+
+func (l *eventLog) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// drop removes events from the log, as expiry or a failed insert would
+func (l *eventLog) drop(seqs ...int64) {
+	dropped := map[int64]bool{}
+	for _, seq := range seqs {
+		dropped[seq] = true
+	}
+
+	events := []*model.UserEvent{}
+	for _, event := range l.events {
+		if !dropped[event.Seq] {
+			events = append(events, event)
+		}
+	}
+	l.events = events
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		dropped []int64
+		after   int64
+		want    []int64
+		expired bool
+	}{
+		{name: "whole log", after: 0, want: []int64{1, 2, 3, 4, 5}},
+		{name: "missed events", after: 3, want: []int64{4, 5}},
+		{name: "up to date", after: 5, want: []int64{}},
+		{name: "ahead of the log", after: 6, expired: true},
+		{name: "hole at the start", dropped: []int64{1}, after: 0, expired: true},
+		{name: "hole in the middle", dropped: []int64{3}, after: 1, expired: true},
+		{name: "hole at the end", dropped: []int64{5}, after: 2, expired: true},
+		{name: "hole before the replay", dropped: []int64{2}, after: 3, want: []int64{4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &eventLog{}
+			for i := 0; i < 5; i++ {
+				log.Append(context.Background(), "user", "getMessage", json.RawMessage(`{}`))
+			}
+			log.drop(test.dropped...)
+
+			events, latest, err := NewEventService(log, 10).Replay(context.Background(), "user", test.after)
+			if latest != 5 {
+				t.Errorf("latest = %d, want 5", latest)
+			}
+			if test.expired {
+				if !errors.Is(err, ErrEventsExpired) {
+					t.Fatalf("err = %v, want ErrEventsExpired", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(events) != len(test.want) {
+				t.Fatalf("replayed %d events, want %v", len(events), test.want)
+			}
+			for i, event := range events {
+				if event.Seq != test.want[i] {
+					t.Errorf("event %d has seq %d, want %d", i, event.Seq, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplayLimit(t *testing.T) {
+	log := &eventLog{}
+	for i := 0; i < 5; i++ {
+		log.Append(context.Background(), "user", "getMessage", json.RawMessage(`{}`))
+	}
+
+	if _, _, err := NewEventService(log, 4).Replay(context.Background(), "user", 0); !errors.Is(err, ErrEventsExpired) {
+		t.Fatalf("err = %v, want ErrEventsExpired", err)
+	}
+}
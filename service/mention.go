@@ -0,0 +1,61 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/guutong/chat-backend/model"
+)
+
+// mentionPattern matches @username where the @ does not follow a letter, digit or another @, so email addresses are left out
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([a-zA-Z0-9][a-zA-Z0-9._-]*)`)
+
+// parseMentions returns the usernames mentioned in a text, lowercased and without duplicates.
+// A mention at the end of a sentence also yields the username without the trailing punctuation.
+func parseMentions(text string) []string {
+	usernames := []string{}
+	seen := map[string]bool{}
+	add := func(username string) {
+		if username != "" && !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		username := strings.ToLower(match[1])
+		add(username)
+		add(strings.TrimRight(username, "._-"))
+	}
+	return usernames
+}
+
+// resolveMentions returns the ids of the members mentioned in a text, the sender never mentions themself
+func resolveMentions(text string, senderID string, members []*model.User) []string {
+	usernames := parseMentions(text)
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	byUsername := make(map[string]string, len(members))
+	for _, member := range members {
+		byUsername[strings.ToLower(member.Username)] = member.ID.Hex()
+	}
+
+	mentions := []string{}
+	seen := map[string]bool{}
+	for _, username := range usernames {
+		userID, ok := byUsername[username]
+		if !ok || userID == senderID || seen[userID] {
+			continue
+		}
+
+		seen[userID] = true
+		mentions = append(mentions, userID)
+	}
+
+	if len(mentions) == 0 {
+		return nil
+	}
+	return mentions
+}
@@ -2,40 +2,158 @@ package service
 
 import (
 	"context"
+	"errors"
+	"log"
 
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/repository"
+	"github.com/guutong/chat-backend/search"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrDuplicateMessage means the message was already sent, the stored message is returned in its place
+	ErrDuplicateMessage = errors.New("duplicate message")
 )
 
 type IMessageService interface {
-	// Create a new message
+	// Create a new message, it gets the next sequence number of its conversation
 	Create(ctx context.Context, message *model.Message) error
 
+	// Find a message by id
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.Message, error)
+
+	// Find messages by their ids
+	FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*model.Message, error)
+
 	// Find a message by conversation id
 	FindByConversationID(ctx context.Context, conversationID string) ([]*model.Message, error)
 
-	// Find a message by conversation id pagination
+	// Find the messages of a conversation after a sequence number, oldest first
+	FindByConversationIDAfterSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error)
+
+	// Find the messages of a conversation before a sequence number, newest first
+	FindByConversationIDBeforeSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error)
+
+	// Find the messages of a conversation newest first, skipping the given number of newest messages
 	FindByConversationIDPagination(ctx context.Context, conversationID string, page int64, limit int64) ([]*model.Message, error)
 
 	// Find last message by conversation id
 	FindLastMessageByConversationID(ctx context.Context, conversationID string) (*model.Message, error)
+
+	// Find the messages mentioning a user, newest first, before a message id when it is not nil
+	FindByMention(ctx context.Context, userID string, before *primitive.ObjectID, limit int64) ([]*model.Message, error)
 }
 
 // MessageService is a service for message
 type MessageService struct {
-	repository repository.IMessageRepository
+	repository             repository.IMessageRepository
+	conversationRepository repository.IConversationRepository
+	userRepository         repository.IUserRepository
+	searchIndex            search.SearchIndex
 }
 
-// NewMessageService creates a new message service
-func NewMessageService(repository repository.IMessageRepository) *MessageService {
+// NewMessageService creates a new message service, new messages are added to the search index
+func NewMessageService(
+	repository repository.IMessageRepository,
+	conversationRepository repository.IConversationRepository,
+	userRepository repository.IUserRepository,
+	searchIndex search.SearchIndex,
+) *MessageService {
 	return &MessageService{
-		repository: repository,
+		repository:             repository,
+		conversationRepository: conversationRepository,
+		userRepository:         userRepository,
+		searchIndex:            searchIndex,
 	}
 }
 
-// Create a new message
+// Create a new message, it gets the next sequence number of its conversation before it is inserted.
+// When the client message id was already used the stored message is copied into message and ErrDuplicateMessage is returned.
+// A write that fails after taking a number leaves the number unused, so does a retry that loses the insert to a concurrent one.
+// The @username mentions in the text are resolved to the ids of the members they name.
 func (s *MessageService) Create(ctx context.Context, message *model.Message) error {
-	return s.repository.Create(ctx, message)
+	if message.ClientMessageID != "" && s.replay(ctx, message) {
+		return ErrDuplicateMessage
+	}
+
+	mentions, err := s.mentions(ctx, message)
+	if err != nil {
+		return err
+	}
+	message.Mentions = mentions
+
+	seq, err := s.conversationRepository.NextSeq(ctx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
+
+	err = s.repository.Create(ctx, message)
+
+	// A concurrent retry won the insert
+	if errors.Is(err, repository.ErrDuplicateMessage) && s.replay(ctx, message) {
+		return ErrDuplicateMessage
+	}
+	if err != nil {
+		return err
+	}
+
+	// The message is stored, a failed update only leaves an older preview in the conversation list
+	if err := s.conversationRepository.SetLastMessage(ctx, message); err != nil {
+		log.Println("conversation:", err)
+	}
+
+	// The message is stored, it only goes missing from search results when indexing fails
+	if err := s.searchIndex.Index(ctx, message); err != nil {
+		log.Println("search:", err)
+	}
+	return nil
+}
+
+// mentions resolves the mentions in the text of a message against the current usernames of the members of its conversation.
+// Names that are not members of the conversation are plain text.
+func (s *MessageService) mentions(ctx context.Context, message *model.Message) ([]string, error) {
+	if len(parseMentions(message.Text)) == 0 {
+		return nil, nil
+	}
+
+	conversation, err := s.conversationRepository.FindByID(ctx, message.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberIDs := make([]string, len(conversation.Members))
+	for i, member := range conversation.Members {
+		memberIDs[i] = member.ID.Hex()
+	}
+	members, err := s.userRepository.FindByIDs(ctx, memberIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveMentions(message.Text, message.Sender, members), nil
+}
+
+// replay copies the stored message with the same client message id into message
+func (s *MessageService) replay(ctx context.Context, message *model.Message) bool {
+	stored, err := s.repository.FindByClientMessageID(ctx, message.ConversationID, message.Sender, message.ClientMessageID)
+	if err != nil {
+		return false
+	}
+
+	*message = *stored
+	return true
+}
+
+// Find a message by id
+func (s *MessageService) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Message, error) {
+	return s.repository.FindByID(ctx, id)
+}
+
+// Find messages by their ids
+func (s *MessageService) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*model.Message, error) {
+	return s.repository.FindByIDs(ctx, ids)
 }
 
 // Find a message by conversation id
@@ -43,7 +161,17 @@ func (s *MessageService) FindByConversationID(ctx context.Context, conversationI
 	return s.repository.FindByConversationID(ctx, conversationID)
 }
 
-// Find a message by conversation id pagination
+// Find the messages of a conversation after a sequence number, oldest first
+func (s *MessageService) FindByConversationIDAfterSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error) {
+	return s.repository.FindByConversationIDAfterSeq(ctx, conversationID, seq, limit)
+}
+
+// Find the messages of a conversation before a sequence number, newest first
+func (s *MessageService) FindByConversationIDBeforeSeq(ctx context.Context, conversationID string, seq int64, limit int64) ([]*model.Message, error) {
+	return s.repository.FindByConversationIDBeforeSeq(ctx, conversationID, seq, limit)
+}
+
+// Find the messages of a conversation newest first, skipping the given number of newest messages
 func (s *MessageService) FindByConversationIDPagination(ctx context.Context, conversationID string, page int64, limit int64) ([]*model.Message, error) {
 	return s.repository.FindByConversationIDPagination(ctx, conversationID, page, limit)
 }
@@ -52,3 +180,8 @@ func (s *MessageService) FindByConversationIDPagination(ctx context.Context, con
 func (s *MessageService) FindLastMessageByConversationID(ctx context.Context, conversationID string) (*model.Message, error) {
 	return s.repository.FindLastMessageByConversationID(ctx, conversationID)
 }
+
+// Find the messages mentioning a user, newest first, before a message id when it is not nil
+func (s *MessageService) FindByMention(ctx context.Context, userID string, before *primitive.ObjectID, limit int64) ([]*model.Message, error) {
+	return s.repository.FindByMention(ctx, userID, before, limit)
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// PolicyError is returned when a username or a password does not satisfy its policy
+type PolicyError struct {
+	Field  string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Field + " " + e.Reason
+}
+
+// UsernamePolicy is the format policy of usernames
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+	Pattern   *regexp.Regexp
+
+	// Usernames that cannot be registered, lower case
+	Reserved map[string]struct{}
+}
+
+// NormalizeUsername trims a username and brings it to Unicode NFKC form,
+// so names that only differ in how their characters are encoded are the same name
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// Validate a normalized username against the policy
+func (p UsernamePolicy) Validate(username string) error {
+	length := utf8.RuneCountInString(username)
+	if length < p.MinLength || (p.MaxLength > 0 && length > p.MaxLength) {
+		return &PolicyError{Field: "username", Reason: fmt.Sprintf("must be between %d and %d characters", p.MinLength, p.MaxLength)}
+	}
+
+	if p.Pattern != nil && !p.Pattern.MatchString(username) {
+		return &PolicyError{Field: "username", Reason: "contains characters that are not allowed"}
+	}
+
+	if _, ok := p.Reserved[strings.ToLower(username)]; ok {
+		return &PolicyError{Field: "username", Reason: "is reserved"}
+	}
+
+	return nil
+}
+
+// PasswordPolicy is the strength policy of passwords
+type PasswordPolicy struct {
+	MinLength int
+
+	// bcrypt ignores everything past 72 bytes
+	MaxLength int
+
+	// Known breached passwords, lower case
+	Breached map[string]struct{}
+
+	// Passwords at least this similar to the username are rejected, zero disables the check
+	MaxSimilarity float64
+}
+
+// Validate a password of a user against the policy
+func (p PasswordPolicy) Validate(password string, username string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return &PolicyError{Field: "password", Reason: fmt.Sprintf("must be at least %d characters", p.MinLength)}
+	}
+
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return &PolicyError{Field: "password", Reason: fmt.Sprintf("must be at most %d bytes", p.MaxLength)}
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := p.Breached[lower]; ok {
+		return &PolicyError{Field: "password", Reason: "is too common, it appears in a list of breached passwords"}
+	}
+
+	if p.MaxSimilarity > 0 && username != "" {
+		name := strings.ToLower(username)
+		if strings.Contains(lower, name) || strings.Contains(name, lower) || similarity(lower, name) >= p.MaxSimilarity {
+			return &PolicyError{Field: "password", Reason: "is too similar to the username"}
+		}
+	}
+
+	return nil
+}
+
+// LoadBreachedPasswords reads a list of breached passwords, one per line
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	passwords := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		password := strings.TrimSpace(scanner.Text())
+		if password != "" {
+			passwords[strings.ToLower(password)] = struct{}{}
+		}
+	}
+
+	return passwords, scanner.Err()
+}
+
+// HashPassword hashes a password for storage
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+// similarity is one minus the levenshtein distance of a and b relative to the longer one
+func similarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
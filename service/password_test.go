@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUsernamePolicy(t *testing.T) {
+	policy := UsernamePolicy{
+		MinLength: 3,
+		MaxLength: 32,
+		Pattern:   regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`),
+		Reserved:  map[string]struct{}{"admin": {}, "me": {}},
+	}
+	unicode := UsernamePolicy{
+		MinLength: 3,
+		MaxLength: 4,
+		Pattern:   regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}._-]*$`),
+		Reserved:  map[string]struct{}{"caf\u00e9": {}},
+	}
+
+	tests := []struct {
+		name     string
+		policy   UsernamePolicy
+		username string
+		valid    bool
+	}{
+		{name: "plain", policy: policy, username: "bob", valid: true},
+		{name: "punctuation", policy: policy, username: "bob.smith_1-x", valid: true},
+		{name: "too short", policy: policy, username: "bo"},
+		{name: "longest", policy: policy, username: strings.Repeat("b", 32), valid: true},
+		{name: "too long", policy: policy, username: strings.Repeat("b", 33)},
+		{name: "space", policy: policy, username: "bob smith"},
+		{name: "leading dot", policy: policy, username: ".bob"},
+		{name: "at sign", policy: policy, username: "bob@example"},
+		{name: "accent outside the pattern", policy: policy, username: "bób"},
+		{name: "emoji", policy: policy, username: "bob😀"},
+		{name: "reserved", policy: policy, username: "admin"},
+		{name: "reserved in another case", policy: policy, username: "AdMin"},
+		{name: "reserved prefix", policy: policy, username: "admin2", valid: true},
+		{name: "reserved in full width", policy: policy, username: "ａｄｍｉｎ"},
+		{name: "full width digits", policy: policy, username: "bob１２", valid: true},
+		{name: "surrounding spaces", policy: policy, username: "  bob  ", valid: true},
+		{name: "unicode letters", policy: unicode, username: "ñam", valid: true},
+		// A combining accent is composed with its letter before the name is checked
+		{name: "combining accent", policy: unicode, username: "Jose\u0301", valid: true},
+		{name: "reserved with a combining accent", policy: unicode, username: "Cafe\u0301"},
+		{name: "ligature", policy: unicode, username: "ﬁne", valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate(NormalizeUsername(test.username))
+			if test.valid && err != nil {
+				t.Fatalf("%q: %v", test.username, err)
+			}
+			var policyErr *PolicyError
+			if !test.valid && (!errors.As(err, &policyErr) || policyErr.Field != "username") {
+				t.Fatalf("%q: err = %v, want a username policy error", test.username, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{username: " bob ", want: "bob"},
+		{username: "Cafe\u0301", want: "Caf\u00e9"},
+		{username: "Caf\u00e9", want: "Caf\u00e9"},
+		{username: "ｂｏｂ", want: "bob"},
+		{username: "ﬁne", want: "fine"},
+	}
+
+	for _, test := range tests {
+		if got := NormalizeUsername(test.username); got != test.want {
+			t.Errorf("NormalizeUsername(%q) = %q, want %q", test.username, got, test.want)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     72,
+		Breached:      map[string]struct{}{"password1": {}},
+		MaxSimilarity: 0.7,
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		username string
+		valid    bool
+	}{
+		{name: "passphrase", password: "correct horse battery", username: "alice", valid: true},
+		{name: "shortest", password: "x7#kQ2!m", username: "alice", valid: true},
+		{name: "too short", password: "x7#kQ2!", username: "alice"},
+		{name: "only letters", password: "qwertzuiop", username: "alice", valid: true},
+		{name: "only digits", password: "80615273", username: "alice", valid: true},
+		{name: "symbols and spaces", password: "  !?#&  ", username: "alice", valid: true},
+		// Length is counted in characters, the limit of bcrypt in bytes
+		{name: "multi-byte characters", password: "éééééééé", username: "alice", valid: true},
+		{name: "too few characters in many bytes", password: "ééééééé", username: "alice"},
+		{name: "longest", password: strings.Repeat("x", 72), username: "alice", valid: true},
+		{name: "too many bytes", password: strings.Repeat("x", 73), username: "alice"},
+		{name: "too many bytes in fewer characters", password: strings.Repeat("é", 37), username: "alice"},
+		{name: "breached", password: "password1", username: "alice"},
+		{name: "breached in another case", password: "PassWord1", username: "alice"},
+		{name: "contains the username", password: "alice2024!", username: "alice"},
+		{name: "contains the username in another case", password: "xxALICExx", username: "alice"},
+		{name: "close to the username", password: "jonathon", username: "jonathan"},
+		{name: "without a username", password: "jonathon", valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Validate(test.password, test.username)
+			if test.valid && err != nil {
+				t.Fatalf("%q: %v", test.password, err)
+			}
+			var policyErr *PolicyError
+			if !test.valid && (!errors.As(err, &policyErr) || policyErr.Field != "password") {
+				t.Fatalf("%q: err = %v, want a password policy error", test.password, err)
+			}
+		})
+	}
+}
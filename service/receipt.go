@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type IReceiptService interface {
+	// Create the receipts of a new message for its recipients
+	Create(ctx context.Context, message *model.Message, recipients []string) error
+
+	// Find the receipts of a message
+	FindByMessageID(ctx context.Context, messageID primitive.ObjectID) ([]*model.Receipt, error)
+
+	// Mark messages as delivered to a user, it returns the receipts that changed
+	MarkDelivered(ctx context.Context, userID string, messageIDs []primitive.ObjectID) ([]*model.Receipt, error)
+
+	// Mark the messages of a conversation up to a sequence number as read by a user, it returns the receipts that changed
+	MarkRead(ctx context.Context, userID string, conversationID string, seq int64) ([]*model.Receipt, error)
+}
+
+// ReceiptService is a service for message receipts
+type ReceiptService struct {
+	repository repository.IReceiptRepository
+}
+
+// NewReceiptService creates a new receipt service
+func NewReceiptService(repository repository.IReceiptRepository) *ReceiptService {
+	return &ReceiptService{
+		repository: repository,
+	}
+}
+
+// Create the receipts of a new message for its recipients
+func (s *ReceiptService) Create(ctx context.Context, message *model.Message, recipients []string) error {
+	receipts := make([]*model.Receipt, 0, len(recipients))
+	for _, recipientID := range recipients {
+		if recipientID == message.Sender {
+			continue
+		}
+
+		receipts = append(receipts, &model.Receipt{
+			MessageID:      message.ID,
+			ConversationID: message.ConversationID,
+			Sender:         message.Sender,
+			UserID:         recipientID,
+			Seq:            message.Seq,
+		})
+	}
+	return s.repository.CreateMany(ctx, receipts)
+}
+
+// Find the receipts of a message
+func (s *ReceiptService) FindByMessageID(ctx context.Context, messageID primitive.ObjectID) ([]*model.Receipt, error) {
+	return s.repository.FindByMessageID(ctx, messageID)
+}
+
+// Mark messages as delivered to a user, it returns the receipts that changed
+func (s *ReceiptService) MarkDelivered(ctx context.Context, userID string, messageIDs []primitive.ObjectID) ([]*model.Receipt, error) {
+	if len(messageIDs) == 0 {
+		return []*model.Receipt{}, nil
+	}
+	return s.repository.MarkDelivered(ctx, userID, messageIDs, time.Now())
+}
+
+// Mark the messages of a conversation up to a sequence number as read by a user, it returns the receipts that changed
+func (s *ReceiptService) MarkRead(ctx context.Context, userID string, conversationID string, seq int64) ([]*model.Receipt, error) {
+	return s.repository.MarkRead(ctx, userID, conversationID, seq, time.Now())
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// receipts records the receipts it is asked to create and the marks it is asked to make
+type receipts struct {
+	repository.IReceiptRepository
+	created []*model.Receipt
+	marks   int
+}
+
+func (r *receipts) CreateMany(ctx context.Context, receipts []*model.Receipt) error {
+	r.created = append(r.created, receipts...)
+	return nil
+}
+
+func (r *receipts) MarkDelivered(ctx context.Context, userID string, messageIDs []primitive.ObjectID, at time.Time) ([]*model.Receipt, error) {
+	r.marks++
+	return []*model.Receipt{}, nil
+}
+
+func TestReceiptCreateSkipsTheSender(t *testing.T) {
+	r := &receipts{}
+	s := NewReceiptService(r)
+	message := &model.Message{ID: primitive.NewObjectID(), ConversationID: "c1", Sender: "alice", Seq: 7}
+
+	if err := s.Create(context.Background(), message, []string{"alice", "bob", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.created) != 2 {
+		t.Fatalf("created %d receipts, want 2", len(r.created))
+	}
+	for i, userID := range []string{"bob", "carol"} {
+		receipt := r.created[i]
+		if receipt.UserID != userID || receipt.MessageID != message.ID || receipt.Seq != 7 || receipt.Status() != model.MessageStatusSent {
+			t.Fatalf("receipt %d = %+v, want a sent receipt of the message for %s", i, receipt, userID)
+		}
+	}
+}
+
+func TestReceiptMarkDeliveredWithoutMessages(t *testing.T) {
+	r := &receipts{}
+	s := NewReceiptService(r)
+
+	delivered, err := s.MarkDelivered(context.Background(), "bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 0 || r.marks != 0 {
+		t.Fatalf("MarkDelivered = %+v with %d marks, want nothing marked", delivered, r.marks)
+	}
+}
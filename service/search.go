@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+
+	"github.com/guutong/chat-backend/repository"
+	"github.com/guutong/chat-backend/search"
+)
+
+type ISearchService interface {
+	// Search the messages of the conversations a user belongs to
+	SearchMessages(ctx context.Context, userID string, query search.Query) ([]search.Hit, error)
+}
+
+// SearchService is a service for searching messages
+type SearchService struct {
+	index                  search.SearchIndex
+	conversationRepository repository.IConversationRepository
+}
+
+// NewSearchService creates a new search service
+func NewSearchService(index search.SearchIndex, conversationRepository repository.IConversationRepository) *SearchService {
+	return &SearchService{
+		index:                  index,
+		conversationRepository: conversationRepository,
+	}
+}
+
+// Search the messages of the conversations a user belongs to.
+// The conversation ids of the query narrow the search down, the ones the user is not a member of are ignored.
+func (s *SearchService) SearchMessages(ctx context.Context, userID string, query search.Query) ([]search.Hit, error) {
+	conversations, err := s.conversationRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	requested := map[string]bool{}
+	for _, conversationID := range query.ConversationIDs {
+		requested[conversationID] = true
+	}
+
+	conversationIDs := []string{}
+	for _, conversation := range conversations {
+		id := conversation.ID.Hex()
+		if len(requested) == 0 || requested[id] {
+			conversationIDs = append(conversationIDs, id)
+		}
+	}
+
+	query.ConversationIDs = conversationIDs
+	return s.index.Search(ctx, query)
+}
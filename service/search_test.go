@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+	"github.com/guutong/chat-backend/search"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memberConversations returns the same conversations for every user
+type memberConversations struct {
+	repository.IConversationRepository
+	conversations []*model.Conversation
+}
+
+func (r *memberConversations) FindByUserID(ctx context.Context, userID string) ([]*model.Conversation, error) {
+	return r.conversations, nil
+}
+
+// queries records the queries it is asked to search
+type queries struct {
+	search.SearchIndex
+	last *search.Query
+}
+
+func (i *queries) Search(ctx context.Context, query search.Query) ([]search.Hit, error) {
+	i.last = &query
+	return []search.Hit{}, nil
+}
+
+func TestSearchMessagesOnlyInMemberConversations(t *testing.T) {
+	general, private := primitive.NewObjectID(), primitive.NewObjectID()
+	conversations := &memberConversations{conversations: []*model.Conversation{{ID: general}, {ID: private}}}
+	other := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name      string
+		requested []string
+		want      []string
+	}{
+		{name: "every conversation", want: []string{general.Hex(), private.Hex()}},
+		{name: "one conversation", requested: []string{private.Hex()}, want: []string{private.Hex()}},
+		{name: "not a member", requested: []string{other}, want: []string{}},
+		{name: "member and not a member", requested: []string{other, general.Hex()}, want: []string{general.Hex()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := &queries{}
+			s := NewSearchService(index, conversations)
+
+			if _, err := s.SearchMessages(context.Background(), "alice", search.Query{Text: "deploy", ConversationIDs: test.requested}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(index.last.ConversationIDs, test.want) {
+				t.Fatalf("searched %v, want %v", index.last.ConversationIDs, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// MuteForever mutes a conversation until it is unmuted
+const MuteForever time.Duration = -1
+
+// MaxNicknameLength is the longest nickname in characters, after surrounding whitespace is trimmed
+const MaxNicknameLength = 64
+
+// SettingsUpdate changes some of the settings of a conversation, nil fields are left as they are
+type SettingsUpdate struct {
+	// How long to mute the conversation for, MuteForever mutes it until it is unmuted and 0 unmutes it
+	MuteFor     *time.Duration
+	NotifyLevel *string
+	Nickname    *string
+}
+
+type ISettingsService interface {
+	// Find the settings of a user for a conversation
+	Find(ctx context.Context, userID string, conversationID string) (*model.ConversationSettings, error)
+
+	// Find the settings of a user for some of their conversations, by conversation id
+	FindByUserID(ctx context.Context, userID string, conversationIDs []string) (map[string]*model.ConversationSettings, error)
+
+	// Update the settings of a user for a conversation
+	Update(ctx context.Context, userID string, conversationID string, update SettingsUpdate) (*model.ConversationSettings, error)
+
+	// Filter the recipients of a message down to the ones it notifies.
+	// A message notifies a recipient who did not mute its sender and whose settings for the conversation allow it,
+	// a mention notifies them in a muted conversation as well.
+	Notified(ctx context.Context, message *model.Message, recipients []string) ([]string, error)
+}
+
+// SettingsService is a service for the conversation settings of users
+type SettingsService struct {
+	repository   repository.ISettingsRepository
+	blockService IBlockService
+}
+
+// NewSettingsService creates a new settings service
+func NewSettingsService(repository repository.ISettingsRepository, blockService IBlockService) *SettingsService {
+	return &SettingsService{
+		repository:   repository,
+		blockService: blockService,
+	}
+}
+
+// Find the settings of a user for a conversation
+func (s *SettingsService) Find(ctx context.Context, userID string, conversationID string) (*model.ConversationSettings, error) {
+	return s.repository.Find(ctx, userID, conversationID)
+}
+
+// Find the settings of a user for some of their conversations, by conversation id.
+// Every conversation has an entry, the defaults when the user never changed its settings.
+func (s *SettingsService) FindByUserID(ctx context.Context, userID string, conversationIDs []string) (map[string]*model.ConversationSettings, error) {
+	settings, err := s.repository.FindByUserID(ctx, userID, conversationIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, conversationID := range conversationIDs {
+		if _, ok := settings[conversationID]; !ok {
+			settings[conversationID] = model.DefaultConversationSettings(userID, conversationID)
+		}
+	}
+	return settings, nil
+}
+
+// Update the settings of a user for a conversation
+func (s *SettingsService) Update(ctx context.Context, userID string, conversationID string, update SettingsUpdate) (*model.ConversationSettings, error) {
+	settings, err := s.repository.Find(ctx, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.MuteFor != nil {
+		switch muteFor := *update.MuteFor; {
+		case muteFor == MuteForever:
+			settings.Muted = true
+			settings.MutedUntil = nil
+		case muteFor > 0:
+			until := time.Now().Add(muteFor)
+			settings.Muted = true
+			settings.MutedUntil = &until
+		case muteFor == 0:
+			settings.Muted = false
+			settings.MutedUntil = nil
+		default:
+			return nil, ErrInvalidSettings
+		}
+	}
+
+	if update.NotifyLevel != nil {
+		switch *update.NotifyLevel {
+		case model.NotifyAll, model.NotifyMentions, model.NotifyNone:
+			settings.NotifyLevel = *update.NotifyLevel
+		default:
+			return nil, ErrInvalidSettings
+		}
+	}
+
+	if update.Nickname != nil {
+		nickname, err := validateNickname(*update.Nickname)
+		if err != nil {
+			return nil, err
+		}
+		settings.Nickname = nickname
+	}
+
+	if err := s.repository.Save(ctx, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// validateNickname trims a nickname and checks it is short and printable, an empty nickname clears it
+func validateNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > MaxNicknameLength {
+		return "", ErrInvalidSettings
+	}
+
+	for _, r := range nickname {
+		if unicode.IsControl(r) || (unicode.IsSpace(r) && r != ' ') {
+			return "", ErrInvalidSettings
+		}
+	}
+	return nickname, nil
+}
+
+// Filter the recipients of a message down to the ones it notifies.
+// A message notifies a recipient who did not mute its sender and whose settings for the conversation allow it,
+// a mention notifies them in a muted conversation as well.
+func (s *SettingsService) Notified(ctx context.Context, message *model.Message, recipients []string) ([]string, error) {
+	if len(recipients) == 0 {
+		return []string{}, nil
+	}
+
+	settings, err := s.repository.FindByConversationID(ctx, message.ConversationID, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notified := []string{}
+	for _, recipientID := range recipients {
+		// A recipient whose mutes cannot be read is not notified, the others still are
+		muted, err := s.blockService.IsMuted(ctx, recipientID, message.Sender)
+		if err != nil {
+			log.Println("settings:", err)
+			continue
+		}
+		if muted {
+			continue
+		}
+
+		if recipientSettings, ok := settings[recipientID]; ok && !recipientSettings.Notifies(now, message.IsMentioned(recipientID)) {
+			continue
+		}
+		notified = append(notified, recipientID)
+	}
+	return notified, nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+// settingsStore keeps the settings of one conversation in memory
+type settingsStore struct {
+	repository.ISettingsRepository
+	settings map[string]*model.ConversationSettings
+}
+
+func (s *settingsStore) Find(ctx context.Context, userID string, conversationID string) (*model.ConversationSettings, error) {
+	if settings, ok := s.settings[userID]; ok {
+		return settings, nil
+	}
+	return model.DefaultConversationSettings(userID, conversationID), nil
+}
+
+func (s *settingsStore) FindByConversationID(ctx context.Context, conversationID string, userIDs []string) (map[string]*model.ConversationSettings, error) {
+	return s.settings, nil
+}
+
+func (s *settingsStore) Save(ctx context.Context, settings *model.ConversationSettings) error {
+	s.settings[settings.UserID] = settings
+	return nil
+}
+
+// mutes answers whether a user muted the sender, the mutes of failing users cannot be read
+type mutes struct {
+	IBlockService
+	muted   map[string]bool
+	failing map[string]bool
+}
+
+func (m *mutes) IsMuted(ctx context.Context, userID string, targetID string) (bool, error) {
+	if m.failing[userID] {
+		return false, errors.New("mutes unavailable")
+	}
+	return m.muted[userID], nil
+}
+
+func TestUpdateNickname(t *testing.T) {
+	tests := []struct {
+		nickname string
+		want     string
+		invalid  bool
+	}{
+		{nickname: "Bobby", want: "Bobby"},
+		{nickname: "  Bobby Tables \t", want: "Bobby Tables"},
+		{nickname: "   ", want: ""},
+		{nickname: strings.Repeat("é", MaxNicknameLength), want: strings.Repeat("é", MaxNicknameLength)},
+		{nickname: strings.Repeat("é", MaxNicknameLength+1), invalid: true},
+		{nickname: "Bobby\nTables", invalid: true},
+		{nickname: "Bobby\u0000", invalid: true},
+	}
+
+	for _, test := range tests {
+		store := &settingsStore{settings: map[string]*model.ConversationSettings{}}
+		s := NewSettingsService(store, &mutes{})
+
+		nickname := test.nickname
+		settings, err := s.Update(context.Background(), "alice", "conversation", SettingsUpdate{Nickname: &nickname})
+		if test.invalid {
+			if !errors.Is(err, ErrInvalidSettings) {
+				t.Errorf("%q: err = %v, want ErrInvalidSettings", test.nickname, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.nickname, err)
+		}
+		if settings.Nickname != test.want {
+			t.Errorf("%q: nickname = %q, want %q", test.nickname, settings.Nickname, test.want)
+		}
+	}
+}
+
+func TestNotifiedSkipsFailingRecipient(t *testing.T) {
+	store := &settingsStore{settings: map[string]*model.ConversationSettings{}}
+	s := NewSettingsService(store, &mutes{
+		muted:   map[string]bool{"carol": true},
+		failing: map[string]bool{"bob": true},
+	})
+
+	message := &model.Message{ConversationID: "conversation", Sender: "alice", Text: "hello"}
+	notified, err := s.Notified(context.Background(), message, []string{"bob", "carol", "dave"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 1 || notified[0] != "dave" {
+		t.Fatalf("notified %v, want [dave]", notified)
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+const (
+	ThrottleScopeUsername = "username"
+	ThrottleScopeEmail    = "email"
+	ThrottleScopeIP       = "ip"
+)
+
+// ThrottlePolicy is the backoff and lockout policy of a throttling scope
+type ThrottlePolicy struct {
+	// Failures allowed before the backoff starts
+	FreeAttempts int
+
+	// Delay after the first failure past FreeAttempts, it doubles with every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Failures after which the key is locked out for LockoutDuration after its last failure, zero disables the lockout
+	LockoutAfter    int
+	LockoutDuration time.Duration
+
+	// Failures are forgotten after Window without a new failure
+	Window time.Duration
+}
+
+// ThrottleKey identifies what is throttled, for example a username or an ip
+type ThrottleKey struct {
+	Scope string
+	Value string
+}
+
+// UsernameKey returns the throttling key of a username
+func UsernameKey(username string) ThrottleKey {
+	return ThrottleKey{Scope: ThrottleScopeUsername, Value: strings.ToLower(NormalizeUsername(username))}
+}
+
+// EmailKey returns the throttling key of an email
+func EmailKey(email string) ThrottleKey {
+	return ThrottleKey{Scope: ThrottleScopeEmail, Value: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// IPKey returns the throttling key of a client ip
+func IPKey(ip string) ThrottleKey {
+	return ThrottleKey{Scope: ThrottleScopeIP, Value: ip}
+}
+
+func (k ThrottleKey) String() string {
+	return k.Scope + ":" + k.Value
+}
+
+type IThrottleService interface {
+	// Record an attempt of the keys before it is made, it returns how long the keys must wait when they may not try now.
+	// The attempt counts as a failure of every key until it is forgiven or the key succeeds.
+	Attempt(ctx context.Context, keys ...ThrottleKey) (time.Duration, error)
+
+	// Confirm that the last attempt of the keys failed
+	Fail(ctx context.Context, keys ...ThrottleKey) error
+
+	// Forgive the last attempt of the keys, it no longer counts as a failure
+	Forgive(ctx context.Context, keys ...ThrottleKey) error
+
+	// Reset the failed attempts of the keys
+	Succeed(ctx context.Context, keys ...ThrottleKey) error
+}
+
+// maxClaims is how many times an attempt is retried when concurrent attempts of the same keys are recorded first
+const maxClaims = 5
+
+// ThrottleService is a service for failed attempt tracking with exponential backoff and lockout
+type ThrottleService struct {
+	repository   repository.IAttemptRepository
+	auditService IAuditService
+	policies     map[string]ThrottlePolicy
+}
+
+// NewThrottleService creates a new throttle service, keys of a scope without a policy are never throttled
+func NewThrottleService(
+	repository repository.IAttemptRepository,
+	auditService IAuditService,
+	policies map[string]ThrottlePolicy,
+) *ThrottleService {
+	return &ThrottleService{
+		repository:   repository,
+		auditService: auditService,
+		policies:     policies,
+	}
+}
+
+// Record an attempt of the keys before it is made, it returns how long the keys must wait when they may not try now.
+// The attempt counts as a failure of every key until it is forgiven or the key succeeds.
+func (s *ThrottleService) Attempt(ctx context.Context, keys ...ThrottleKey) (time.Duration, error) {
+	for i := 0; i < maxClaims; i++ {
+		wait, claimed, err := s.attempt(ctx, keys)
+		if err != nil || wait > 0 || claimed {
+			return wait, err
+		}
+	}
+
+	// The keys are flooded with concurrent attempts
+	return time.Second, nil
+}
+
+// attempt checks the keys and claims an attempt of each of them, it returns false when another attempt was recorded first
+func (s *ThrottleService) attempt(ctx context.Context, keys []ThrottleKey) (time.Duration, bool, error) {
+	now := time.Now()
+	failures := make([]int, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		policy, ok := s.policies[key.Scope]
+		if !ok {
+			continue
+		}
+
+		attempt, err := s.repository.Find(ctx, key.String())
+		if err != nil {
+			return 0, false, err
+		}
+
+		if attempt == nil {
+			continue
+		}
+
+		failures[i] = attempt.Failures
+		if keyWait := policy.wait(attempt, now); keyWait > wait {
+			wait = keyWait
+		}
+	}
+
+	if wait > 0 {
+		return wait, false, nil
+	}
+
+	// A claim only succeeds while the key still has the failures checked above
+	for i, key := range keys {
+		policy, ok := s.policies[key.Scope]
+		if !ok {
+			continue
+		}
+
+		attempt, err := s.repository.Claim(ctx, key.String(), failures[i], policy.ttl())
+		if err != nil || attempt == nil {
+			if forgiveErr := s.Forgive(ctx, keys[:i]...); err == nil {
+				err = forgiveErr
+			}
+			return 0, false, err
+		}
+	}
+
+	return 0, true, nil
+}
+
+// Confirm that the last attempt of the keys failed, a failure that locks a key out is audited
+func (s *ThrottleService) Fail(ctx context.Context, keys ...ThrottleKey) error {
+	for _, key := range keys {
+		policy, ok := s.policies[key.Scope]
+		if !ok || policy.LockoutAfter <= 0 {
+			continue
+		}
+
+		attempt, err := s.repository.Find(ctx, key.String())
+		if err != nil {
+			return err
+		}
+
+		if attempt == nil || attempt.Failures < policy.LockoutAfter {
+			continue
+		}
+
+		s.auditService.Record(ctx, model.AuditLockout, key.String(), map[string]string{
+			"failures": strconv.Itoa(attempt.Failures),
+			"until":    attempt.LastFailure.Add(policy.LockoutDuration).Format(time.RFC3339),
+		})
+	}
+
+	return nil
+}
+
+// Forgive the last attempt of the keys, it no longer counts as a failure
+func (s *ThrottleService) Forgive(ctx context.Context, keys ...ThrottleKey) error {
+	for _, key := range keys {
+		if _, ok := s.policies[key.Scope]; !ok {
+			continue
+		}
+
+		if err := s.repository.Forgive(ctx, key.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reset the failed attempts of the keys
+func (s *ThrottleService) Succeed(ctx context.Context, keys ...ThrottleKey) error {
+	for _, key := range keys {
+		if err := s.repository.Reset(ctx, key.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wait is how long a key has to wait before its next attempt
+func (p ThrottlePolicy) wait(attempt *model.LoginAttempt, now time.Time) time.Duration {
+	if next := attempt.LastFailure.Add(p.delay(attempt.Failures)); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// delay is how long a key with the given failures waits after its last failure
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration
+	}
+
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+
+	delay := p.MaxDelay
+	if over <= 32 {
+		delay = p.BaseDelay << (over - 1)
+	}
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// ttl is how long the failures of a key are kept, a lockout outlives the window
+func (p ThrottlePolicy) ttl() time.Duration {
+	if p.LockoutAfter > 0 && p.LockoutDuration > p.Window {
+		return p.LockoutDuration
+	}
+	return p.Window
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/repository"
+)
+
+// audits keeps the recorded audit events
+type audits struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (a *audits) Record(ctx context.Context, eventType string, subject string, detail map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.events = append(a.events, eventType+" "+subject)
+}
+
+var testPolicy = ThrottlePolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        10 * time.Second,
+	LockoutAfter:    10,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+func TestThrottleDelay(t *testing.T) {
+	tests := []struct {
+		policy   ThrottlePolicy
+		failures int
+		want     time.Duration
+	}{
+		{policy: testPolicy, failures: 0, want: 0},
+		{policy: testPolicy, failures: 3, want: 0},
+		{policy: testPolicy, failures: 4, want: time.Second},
+		{policy: testPolicy, failures: 5, want: 2 * time.Second},
+		{policy: testPolicy, failures: 7, want: 8 * time.Second},
+		{policy: testPolicy, failures: 8, want: 10 * time.Second},
+		{policy: testPolicy, failures: 9, want: 10 * time.Second},
+		{policy: testPolicy, failures: 10, want: 15 * time.Minute},
+		{policy: testPolicy, failures: 25, want: 15 * time.Minute},
+		// A shift past the width of a duration falls back to the maximum delay
+		{policy: ThrottlePolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, failures: 70, want: time.Minute},
+		{policy: ThrottlePolicy{BaseDelay: time.Hour, MaxDelay: 24 * time.Hour}, failures: 33, want: 24 * time.Hour},
+		{policy: ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Minute}, failures: 1000, want: time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.delay(test.failures); got != test.want {
+			t.Errorf("%+v with %d failures: delay = %s, want %s", test.policy, test.failures, got, test.want)
+		}
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	now := time.Now()
+	attempt := &model.LoginAttempt{Failures: 5, LastFailure: now.Add(-500 * time.Millisecond)}
+	if wait := testPolicy.wait(attempt, now); wait != 1500*time.Millisecond {
+		t.Fatalf("wait = %s, want 1.5s", wait)
+	}
+
+	attempt.LastFailure = now.Add(-3 * time.Second)
+	if wait := testPolicy.wait(attempt, now); wait != 0 {
+		t.Fatalf("wait = %s after the delay passed, want 0", wait)
+	}
+}
+
+func TestThrottleAttemptConcurrent(t *testing.T) {
+	s := NewThrottleService(repository.NewMemoryAttemptRepository(), &audits{}, map[string]ThrottlePolicy{
+		ThrottleScopeUsername: testPolicy,
+	})
+	key := UsernameKey("alice")
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := s.Attempt(context.Background(), key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts and one more get through, the failure after them starts the backoff
+	if allowed != int32(testPolicy.FreeAttempts+1) {
+		t.Fatalf("allowed %d concurrent attempts, want %d", allowed, testPolicy.FreeAttempts+1)
+	}
+}
+
+func TestThrottleForgiveAndSucceed(t *testing.T) {
+	s := NewThrottleService(repository.NewMemoryAttemptRepository(), &audits{}, map[string]ThrottlePolicy{
+		ThrottleScopeUsername: testPolicy,
+		ThrottleScopeIP:       {FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Hour},
+	})
+	ctx := context.Background()
+	username, ip := UsernameKey("alice"), IPKey("10.0.0.1")
+
+	// A forgiven attempt is not a failure
+	for i := 0; i < 5; i++ {
+		if wait, err := s.Attempt(ctx, username, ip); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: wait %s err %v, want to try now", i, wait, err)
+		}
+		if err := s.Forgive(ctx, username, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two failures put the ip in its backoff
+	for i := 0; i < 2; i++ {
+		if wait, err := s.Attempt(ctx, ip); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: wait %s err %v, want to try now", i, wait, err)
+		}
+	}
+
+	// A key that has to wait is not counted, the other keys of the attempt are left alone
+	if wait, err := s.Attempt(ctx, username, ip); err != nil || wait <= 0 {
+		t.Fatalf("wait %s err %v, want the ip to wait", wait, err)
+	}
+	if wait, err := s.Attempt(ctx, username); err != nil || wait != 0 {
+		t.Fatalf("wait %s err %v, want the username to try now", wait, err)
+	}
+
+	if err := s.Succeed(ctx, ip); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := s.Attempt(ctx, ip); err != nil || wait != 0 {
+		t.Fatalf("wait %s err %v after success, want to try now", wait, err)
+	}
+}
+
+func TestThrottleLockoutAudit(t *testing.T) {
+	audit := &audits{}
+	policy := ThrottlePolicy{LockoutAfter: 2, LockoutDuration: time.Minute, Window: time.Hour}
+	s := NewThrottleService(repository.NewMemoryAttemptRepository(), audit, map[string]ThrottlePolicy{
+		ThrottleScopeUsername: policy,
+	})
+	ctx := context.Background()
+	key := UsernameKey("Alice")
+
+	for i := 0; i < 2; i++ {
+		if wait, err := s.Attempt(ctx, key); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: wait %s err %v, want to try now", i, wait, err)
+		}
+		if err := s.Fail(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(audit.events) != 1 || audit.events[0] != model.AuditLockout+" username:alice" {
+		t.Fatalf("audit events %v, want one lockout of username:alice", audit.events)
+	}
+
+	wait, err := s.Attempt(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 59*time.Second || wait > time.Minute {
+		t.Fatalf("wait = %s, want the lockout of a minute", wait)
+	}
+}
@@ -3,13 +3,17 @@ package service
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/guutong/chat-backend/model"
 	"github.com/guutong/chat-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+var ErrUsernameTaken = errors.New("username already exists")
+
 type IUserService interface {
-	// Register a new user
+	// Register a new user, the password of the user is given in plain text
 	Register(ctx context.Context, user *model.User) error
 
 	// Find a user by username
@@ -23,34 +27,64 @@ type IUserService interface {
 
 	// Find all users
 	FindAll(ctx context.Context) ([]*model.User, error)
+
+	// Search the users visible to a user, it returns the cursor of the next page or an empty cursor on the last page
+	Search(ctx context.Context, userID string, query string, cursor string, limit int64) ([]*model.User, string, error)
 }
 
 // UserService is a service for user
 type UserService struct {
-	repository repository.IUserRepository
+	repository     repository.IUserRepository
+	usernamePolicy UsernamePolicy
+	passwordPolicy PasswordPolicy
 }
 
 // NewUserService creates a new user service
-func NewUserService(repository repository.IUserRepository) *UserService {
+func NewUserService(
+	repository repository.IUserRepository,
+	usernamePolicy UsernamePolicy,
+	passwordPolicy PasswordPolicy,
+) *UserService {
 	return &UserService{
-		repository: repository,
+		repository:     repository,
+		usernamePolicy: usernamePolicy,
+		passwordPolicy: passwordPolicy,
 	}
 }
 
-// Create a new user
+// Register a new user, the password of the user is given in plain text
 func (s *UserService) Register(ctx context.Context, user *model.User) error {
-	// Generate a unique ID for the user
-	existsUser, _ := s.FindByUsername(ctx, user.Username)
-	if existsUser != nil {
-		return errors.New("username already exists")
+	user.Username = NormalizeUsername(user.Username)
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+
+	if err := s.usernamePolicy.Validate(user.Username); err != nil {
+		return err
+	}
+
+	if err := s.passwordPolicy.Validate(user.Password, user.Username); err != nil {
+		return err
 	}
 
-	return s.repository.Create(ctx, user)
+	hashed, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	user.Password = hashed
+
+	// Uniqueness is enforced by the unique indexes of the repository
+	err = s.repository.Create(ctx, user)
+	switch {
+	case errors.Is(err, repository.ErrDuplicateUsername):
+		return ErrUsernameTaken
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		return ErrEmailTaken
+	}
+	return err
 }
 
 // Find a user by username
 func (s *UserService) FindByUsername(ctx context.Context, username string) (*model.User, error) {
-	return s.repository.FindByUsername(ctx, username)
+	return s.repository.FindByUsername(ctx, NormalizeUsername(username))
 }
 
 // Find a user by id
@@ -67,3 +101,35 @@ func (s *UserService) Update(ctx context.Context, user *model.User) error {
 func (s *UserService) FindAll(ctx context.Context) ([]*model.User, error) {
 	return s.repository.FindAll(ctx)
 }
+
+// Search the users visible to a user, it returns the cursor of the next page or an empty cursor on the last page
+func (s *UserService) Search(ctx context.Context, userID string, query string, cursor string, limit int64) ([]*model.User, string, error) {
+	user, err := s.repository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Blocking hides users from each other in both directions
+	blockerIDs, err := s.repository.FindBlockerIDs(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	exclude := []primitive.ObjectID{user.ID}
+	for _, id := range append(user.BlockedUsers, blockerIDs...) {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			exclude = append(exclude, objectID)
+		}
+	}
+
+	users, err := s.repository.Search(ctx, query, exclude, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if limit > 0 && int64(len(users)) == limit {
+		nextCursor = users[len(users)-1].ID.Hex()
+	}
+	return users, nextCursor, nil
+}
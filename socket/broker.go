@@ -0,0 +1,85 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Delivery is an event published on the broker, every node delivers it to its own matching sessions
+type Delivery struct {
+	// Users to deliver to, empty means every session
+	UserIDs []string `json:"userIds,omitempty"`
+
+	// Conversation room to deliver to, it takes precedence over UserIDs
+	Room string `json:"room,omitempty"`
+
+	// Session that must not receive the event, usually the one that caused it
+	ExcludeSession string `json:"excludeSession,omitempty"`
+
+	// Users that must not receive the event, such as the users blocked from or by the user that caused it
+	ExcludeUserIDs []string `json:"excludeUserIds,omitempty"`
+
+	// Sequence number of the event in the log of its single user, zero for events that are not logged
+	Seq int64 `json:"seq,omitempty"`
+
+	Event   string          `json:"event"`
+	Message json.RawMessage `json:"message"`
+}
+
+// excludedUsers returns the users that must not receive the delivery as a set
+func (d Delivery) excludedUsers() map[string]bool {
+	excluded := make(map[string]bool, len(d.ExcludeUserIDs))
+	for _, userID := range d.ExcludeUserIDs {
+		excluded[userID] = true
+	}
+	return excluded
+}
+
+// Broker fans socket events out to every node of the chat
+type Broker interface {
+	// Publish a delivery to every node, including this one
+	Publish(ctx context.Context, delivery Delivery) error
+
+	// Subscribe to the deliveries published by every node
+	Subscribe(handler func(Delivery)) error
+
+	// Close the broker
+	Close() error
+}
+
+// LocalBroker is an in-process broker for a single node
+type LocalBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Delivery)
+}
+
+// NewLocalBroker creates a new in-process broker
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+// Publish a delivery to every node, including this one
+func (b *LocalBroker) Publish(ctx context.Context, delivery Delivery) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(delivery)
+	}
+	return nil
+}
+
+// Subscribe to the deliveries published by every node
+func (b *LocalBroker) Subscribe(handler func(Delivery)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+// Close the broker
+func (b *LocalBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/olahol/melody"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols of the codecs, a client asks for one in the Sec-WebSocket-Protocol header when it connects
+const (
+	SubprotocolJSON     = "chat.json"
+	SubprotocolMsgpack  = "chat.v2.msgpack"
+	SubprotocolProtobuf = "chat.v2.protobuf"
+)
+
+// Codec encodes the frames of a session, the payloads are the same typed events under every codec
+type Codec interface {
+	// Subprotocol names the codec during the websocket handshake
+	Subprotocol() string
+
+	// Binary tells whether frames are written as binary messages
+	Binary() bool
+
+	// EncodeFrame encodes a frame for a protocol version
+	EncodeFrame(frame Frame, version int) ([]byte, error)
+
+	// DecodeRequest decodes a client frame, the payload is converted to JSON for DecodePayload
+	DecodeRequest(msg []byte, version int) (*Request, *ProtocolError)
+}
+
+// codecs are the codecs a client can negotiate, in order of preference of the server
+var codecs = []Codec{JSONCodec{}, MsgpackCodec{}, ProtobufCodec{}}
+
+// negotiate picks the first subprotocol of the client that has a codec, JSON when there is none.
+// The upgrader picks the same subprotocol since it also goes through the client's list in order.
+func negotiate(subprotocols []string) Codec {
+	for _, subprotocol := range subprotocols {
+		for _, codec := range codecs {
+			if codec.Subprotocol() == subprotocol {
+				return codec
+			}
+		}
+	}
+	return JSONCodec{}
+}
+
+func subprotocols() []string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Subprotocol()
+	}
+	return names
+}
+
+// codecOf returns the codec of a session
+func codecOf(s *melody.Session) Codec {
+	value, _ := s.Get("codec")
+	if codec, ok := value.(Codec); ok {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// JSONCodec encodes frames as JSON text, it is the codec of sessions that do not negotiate one
+type JSONCodec struct{}
+
+// Subprotocol names the codec during the websocket handshake
+func (JSONCodec) Subprotocol() string { return SubprotocolJSON }
+
+// Binary tells whether frames are written as binary messages
+func (JSONCodec) Binary() bool { return false }
+
+// EncodeFrame encodes a frame for a protocol version
+func (JSONCodec) EncodeFrame(frame Frame, version int) ([]byte, error) {
+	return frame.Encode(version)
+}
+
+// DecodeRequest decodes a client frame
+func (JSONCodec) DecodeRequest(msg []byte, version int) (*Request, *ProtocolError) {
+	return ParseRequest(msg, version)
+}
+
+// binaryFrame is the version 2 envelope of the binary codecs
+type binaryFrame struct {
+	ID      string      `msgpack:"id,omitempty"`
+	Type    string      `msgpack:"type"`
+	Version int         `msgpack:"version"`
+	Payload interface{} `msgpack:"payload"`
+	Seq     int64       `msgpack:"seq,omitempty"`
+}
+
+// MsgpackCodec encodes frames as MessagePack maps shaped like the version 2 JSON frames
+type MsgpackCodec struct{}
+
+// Subprotocol names the codec during the websocket handshake
+func (MsgpackCodec) Subprotocol() string { return SubprotocolMsgpack }
+
+// Binary tells whether frames are written as binary messages
+func (MsgpackCodec) Binary() bool { return true }
+
+// EncodeFrame encodes a frame, binary codecs only speak protocol version 2
+func (MsgpackCodec) EncodeFrame(frame Frame, version int) ([]byte, error) {
+	payload, err := genericValue(frame.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(binaryFrame{ID: frame.ID, Type: frame.Event, Version: ProtocolV2, Payload: payload, Seq: frame.Seq})
+}
+
+// DecodeRequest decodes a client frame
+func (MsgpackCodec) DecodeRequest(msg []byte, version int) (*Request, *ProtocolError) {
+	var frame binaryFrame
+	if err := msgpack.Unmarshal(msg, &frame); err != nil {
+		return nil, protocolError(CodeInvalidFrame, "Frame is not a MessagePack map")
+	}
+
+	payload, err := json.Marshal(frame.Payload)
+	if err != nil {
+		return nil, protocolError(CodeInvalidFrame, "Payload cannot be converted to JSON")
+	}
+	return checkRequestV2(&Request{ID: frame.ID, Type: frame.Type, Version: frame.Version, Payload: payload})
+}
+
+// genericValue converts a value to the maps, slices and scalars of its JSON form so every codec encodes the same fields
+func genericValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return normalizeNumbers(generic)
+}
+
+// normalizeNumbers turns JSON numbers into int64 when they are whole and float64 otherwise
+func normalizeNumbers(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := value.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", value)
+		}
+		return f, nil
+	case map[string]interface{}:
+		for key, item := range value {
+			normalized, err := normalizeNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = normalized
+		}
+		return value, nil
+	case []interface{}:
+		for i, item := range value {
+			normalized, err := normalizeNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = normalized
+		}
+		return value, nil
+	}
+	return v, nil
+}
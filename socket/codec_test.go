@@ -0,0 +1,360 @@
+package socket
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxExactDouble is the largest integer a double holds exactly, 2^53
+const maxExactDouble = int64(1) << 53
+
+// requestCases returns a payload of every request type, newPayload gives an empty one to decode into
+func requestCases() []struct {
+	event   string
+	payload Payload
+} {
+	lastSeq := int64(41)
+	return []struct {
+		event   string
+		payload Payload
+	}{
+		{"ping", &PingData{Nonce: "n-1"}},
+		{"addUser", &EmptyData{}},
+		{"sendMessage", &SendMessageData{
+			ConversationID:  "64b7f0c2a1b2c3d4e5f60718",
+			RecipientID:     "64b7f0c2a1b2c3d4e5f60719",
+			Text:            "hello @bob",
+			ClientMessageID: "client-1",
+		}},
+		{"subscribe", &RoomData{ConversationID: "64b7f0c2a1b2c3d4e5f60718"}},
+		{"unsubscribe", &RoomData{ConversationID: "64b7f0c2a1b2c3d4e5f60718"}},
+		{"typing", &TypingData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", Typing: true}},
+		{"resume", &ResumeData{LastSeq: &lastSeq}},
+		{"resume", &ResumeData{}},
+		{"ack", &AckData{Seq: 42}},
+		{"read", &ReadData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", Seq: 7}},
+	}
+}
+
+// newPayload returns an empty payload of the same type
+func newPayload(payload Payload) Payload {
+	return reflect.New(reflect.TypeOf(payload).Elem()).Interface().(Payload)
+}
+
+// clientFrame encodes a request the way a client of the codec sends it
+func clientFrame(t *testing.T, codec Codec, version int, id string, event string, payload interface{}) []byte {
+	t.Helper()
+
+	// The client envelope is the server envelope of the same version
+	b, err := codec.EncodeFrame(Frame{ID: id, Event: event, Message: payload}, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type codecVersion struct {
+	codec   Codec
+	version int
+}
+
+func (c codecVersion) String() string {
+	return c.codec.Subprotocol() + "/v" + strconv.Itoa(c.version)
+}
+
+var codecVersions = []codecVersion{
+	{JSONCodec{}, ProtocolV1},
+	{JSONCodec{}, ProtocolV2},
+	{MsgpackCodec{}, ProtocolV2},
+	{ProtobufCodec{}, ProtocolV2},
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, cv := range codecVersions {
+		for _, test := range requestCases() {
+			t.Run(cv.String()+"/"+test.event, func(t *testing.T) {
+				msg := clientFrame(t, cv.codec, cv.version, "req-1", test.event, test.payload)
+
+				request, perr := cv.codec.DecodeRequest(msg, cv.version)
+				if perr != nil {
+					t.Fatal(perr)
+				}
+				if request.Type != test.event || request.ID != "req-1" || request.Version != cv.version {
+					t.Fatalf("decoded envelope %+v, want type %s id req-1 version %d", request, test.event, cv.version)
+				}
+
+				got := newPayload(test.payload)
+				if perr := DecodePayload(request, got); perr != nil {
+					t.Fatal(perr)
+				}
+				if !reflect.DeepEqual(got, test.payload) {
+					t.Fatalf("decoded payload %+v, want %+v", got, test.payload)
+				}
+			})
+		}
+	}
+}
+
+// decodeFrame decodes a frame written by a codec into its type, sequence number and payload
+func decodeFrame(t *testing.T, codec Codec, version int, b []byte) (string, int64, json.RawMessage) {
+	t.Helper()
+
+	switch codec.(type) {
+	case JSONCodec:
+		if version == ProtocolV1 {
+			var frame struct {
+				Event   string          `json:"event"`
+				Message json.RawMessage `json:"message"`
+				Seq     int64           `json:"seq"`
+			}
+			if err := json.Unmarshal(b, &frame); err != nil {
+				t.Fatal(err)
+			}
+			return frame.Event, frame.Seq, frame.Message
+		}
+
+		var frame struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+			Seq     int64           `json:"seq"`
+		}
+		if err := json.Unmarshal(b, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame.Type, frame.Seq, frame.Payload
+	case MsgpackCodec:
+		var frame binaryFrame
+		if err := msgpack.Unmarshal(b, &frame); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame.Type, frame.Seq, payload
+	}
+
+	frame, err := decodeProtoFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(frame.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame.Type, frame.Seq, payload
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	messageID, _ := primitive.ObjectIDFromHex("64b7f0c2a1b2c3d4e5f6071a")
+	message := &model.Message{
+		ID:              messageID,
+		ConversationID:  "64b7f0c2a1b2c3d4e5f60718",
+		Sender:          "64b7f0c2a1b2c3d4e5f60719",
+		Text:            "hello @bob",
+		Seq:             12,
+		CreateAt:        at,
+		ClientMessageID: "client-1",
+		Mentions:        []string{"64b7f0c2a1b2c3d4e5f60720"},
+	}
+
+	frames := []struct {
+		frame Frame
+		typed interface{}
+	}{
+		{Frame{ID: "req-1", Event: "pong", Message: PongData{Nonce: "n-1", Time: at}}, &PongData{}},
+		{Frame{Event: "getMessage", Message: message, Seq: 3}, &model.Message{}},
+		{Frame{ID: "req-2", Event: "messageAck", Message: MessageAckData{ClientMessageID: "client-1", Message: message}}, &MessageAckData{}},
+		{Frame{Event: "notification", Message: Notification{Type: "mention", ConversationID: message.ConversationID, SenderID: message.Sender, Text: message.Text}, Seq: 4}, &Notification{}},
+		{Frame{Event: "messageStatus", Message: MessageStatusData{ConversationID: message.ConversationID, MessageIDs: []string{messageID.Hex()}, UserID: message.Sender, Status: "read", At: at}, Seq: 5}, &MessageStatusData{}},
+		{Frame{Event: "readPointer", Message: ReadPointerData{ConversationID: message.ConversationID, UserID: message.Sender, Seq: 12, At: at}, Seq: 6}, &ReadPointerData{}},
+		{Frame{Event: "memberJoined", Message: MembershipData{ConversationID: message.ConversationID, UserID: message.Sender}, Seq: 7}, &MembershipData{}},
+		{Frame{Event: "messagePinned", Message: PinData{ConversationID: message.ConversationID, MessageID: messageID.Hex(), UserID: message.Sender}, Seq: 8}, &PinData{}},
+		{Frame{Event: "conversationState", Message: ConversationStateData{ConversationID: message.ConversationID, Pinned: true}, Seq: 9}, &ConversationStateData{}},
+		{Frame{Event: "typing", Message: TypingData{ConversationID: message.ConversationID, UserID: message.Sender, Typing: true}}, &TypingData{}},
+		{Frame{ID: "req-3", Event: "resumed", Message: SeqData{Seq: 42}}, &SeqData{}},
+		{Frame{Event: "resync", Message: SeqData{Seq: 42}}, &SeqData{}},
+		{Frame{ID: "req-4", Event: "error", Message: ErrorData{Event: "sendMessage", Code: CodeForbidden, Error: "Email not verified"}}, &ErrorData{}},
+		{Frame{Event: "getUsers", Message: []string{"64b7f0c2a1b2c3d4e5f60719", "64b7f0c2a1b2c3d4e5f60720"}}, &[]string{}},
+		{Frame{Event: "getUsers", Message: []string{}}, &[]string{}},
+		{Frame{ID: "req-5", Event: "subscribed", Message: RoomData{ConversationID: message.ConversationID}}, &RoomData{}},
+		{Frame{Event: "messageUnpinned", Message: PinData{ConversationID: message.ConversationID, MessageID: messageID.Hex(), UserID: message.Sender}, Seq: 10}, &PinData{}},
+		{Frame{Event: "conversationSettings", Message: &model.ConversationSettings{ConversationID: message.ConversationID, Muted: true, MutedUntil: &at, NotifyLevel: model.NotifyMentions, Nickname: "team", UpdateAt: &at}, Seq: 11}, &model.ConversationSettings{}},
+		{Frame{Event: "contactAccepted", Message: &model.ContactRequest{ID: messageID, From: message.Sender, To: "64b7f0c2a1b2c3d4e5f60720", Status: model.ContactRequestAccepted, CreateAt: at, UpdateAt: at.Add(time.Minute)}, Seq: 12}, &model.ContactRequest{}},
+		// Types without a payload message are sent untyped
+		{Frame{Event: "somethingNew", Message: map[string]interface{}{"name": "x", "count": 3, "tags": []string{"a"}}}, &map[string]interface{}{}},
+	}
+
+	for _, cv := range codecVersions {
+		for _, test := range frames {
+			t.Run(cv.String()+"/"+test.frame.Event, func(t *testing.T) {
+				b, err := cv.codec.EncodeFrame(test.frame, cv.version)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				event, seq, payload := decodeFrame(t, cv.codec, cv.version, b)
+				if event != test.frame.Event || seq != test.frame.Seq {
+					t.Fatalf("decoded event %s seq %d, want %s seq %d", event, seq, test.frame.Event, test.frame.Seq)
+				}
+
+				got := reflect.New(reflect.TypeOf(test.typed).Elem()).Interface()
+				if err := json.Unmarshal(payload, got); err != nil {
+					t.Fatal(err)
+				}
+				want := reflect.New(reflect.TypeOf(test.typed).Elem()).Interface()
+				original, _ := json.Marshal(test.frame.Message)
+				if err := json.Unmarshal(original, want); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("decoded payload %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// Sequence numbers are int64 under every codec, in the frame and in the payloads
+func TestLargeSequenceNumbers(t *testing.T) {
+	large := maxExactDouble + 1
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	frames := []struct {
+		frame Frame
+		typed interface{}
+	}{
+		{Frame{Event: "resumed", Message: SeqData{Seq: large, More: true}, Seq: large}, &SeqData{}},
+		{Frame{Event: "getMessage", Message: &model.Message{ID: primitive.NewObjectID(), Text: "hello", Seq: large, CreateAt: at}, Seq: large}, &model.Message{}},
+		{Frame{Event: "readPointer", Message: ReadPointerData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", Seq: large, At: at}, Seq: large}, &ReadPointerData{}},
+	}
+	requests := []struct {
+		event   string
+		payload Payload
+	}{
+		{"resume", &ResumeData{LastSeq: &large}},
+		{"ack", &AckData{Seq: large}},
+		{"read", &ReadData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", Seq: large}},
+	}
+
+	for _, cv := range codecVersions {
+		t.Run(cv.String(), func(t *testing.T) {
+			for _, test := range frames {
+				b, err := cv.codec.EncodeFrame(test.frame, cv.version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				event, seq, payload := decodeFrame(t, cv.codec, cv.version, b)
+				if seq != large {
+					t.Errorf("%s: frame seq = %d, want %d", event, seq, large)
+				}
+
+				got := reflect.New(reflect.TypeOf(test.typed).Elem()).Interface()
+				if err := json.Unmarshal(payload, got); err != nil {
+					t.Fatal(err)
+				}
+				want := reflect.New(reflect.TypeOf(test.typed).Elem()).Interface()
+				original, _ := json.Marshal(test.frame.Message)
+				if err := json.Unmarshal(original, want); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: decoded payload %+v, want %+v", event, got, want)
+				}
+			}
+
+			for _, test := range requests {
+				request, perr := cv.codec.DecodeRequest(clientFrame(t, cv.codec, cv.version, "", test.event, test.payload), cv.version)
+				if perr != nil {
+					t.Fatal(perr)
+				}
+				got := newPayload(test.payload)
+				if perr := DecodePayload(request, got); perr != nil {
+					t.Fatal(perr)
+				}
+				if !reflect.DeepEqual(got, test.payload) {
+					t.Errorf("%s: decoded payload %+v, want %+v", test.event, got, test.payload)
+				}
+			}
+		})
+	}
+}
+
+// Numbers of untyped protobuf payloads are doubles
+func TestProtobufUntypedNumbers(t *testing.T) {
+	b, err := ProtobufCodec{}.EncodeFrame(Frame{Event: "somethingNew", Message: map[string]int64{"seq": maxExactDouble + 1}}, ProtocolV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := decodeProtoFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2^53+1 is rounded to the nearest double, 2^53
+	if seq := frame.Payload.(map[string]interface{})["seq"]; seq != float64(maxExactDouble) {
+		t.Fatalf("seq = %v, want it rounded to %d", seq, maxExactDouble)
+	}
+}
+
+func TestProtobufBatch(t *testing.T) {
+	frames := []Frame{
+		{Event: "typing", Message: TypingData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", UserID: "64b7f0c2a1b2c3d4e5f60719", Typing: true}},
+		{Event: "readPointer", Message: ReadPointerData{ConversationID: "64b7f0c2a1b2c3d4e5f60718", UserID: "64b7f0c2a1b2c3d4e5f60719", Seq: 9, At: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)}, Seq: 4},
+	}
+	envelopes := make([]interface{}, len(frames))
+	for i, f := range frames {
+		envelopes[i] = f.envelope(ProtocolV2)
+	}
+
+	b, err := ProtobufCodec{}.EncodeFrame(Frame{Event: "batch", Message: envelopes}, ProtocolV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, payload := decodeFrame(t, ProtobufCodec{}, ProtocolV2, b)
+
+	// The batch reads like the batch of a JSON session
+	want, err := JSONCodec{}.EncodeFrame(Frame{Event: "batch", Message: envelopes}, ProtocolV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, wantPayload := decodeFrame(t, JSONCodec{}, ProtocolV2, want)
+
+	var got, expected interface{}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(wantPayload, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("batch = %s, want %s", payload, wantPayload)
+	}
+}
+
+func TestProtobufPayloadWireType(t *testing.T) {
+	// An ack whose seq is sent as a string
+	payload := protowire.AppendTag(nil, 1, protowire.BytesType)
+	payload = protowire.AppendString(payload, "42")
+
+	var b []byte
+	b = protowire.AppendTag(b, protoFieldType, protowire.BytesType)
+	b = protowire.AppendString(b, "ack")
+	b = protowire.AppendTag(b, protoFieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, ProtocolV2)
+	b = protowire.AppendTag(b, protoPayloads["ack"].number, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+
+	if _, perr := (ProtobufCodec{}).DecodeRequest(b, ProtocolV2); perr == nil || perr.Code != CodeInvalidFrame {
+		t.Fatalf("err = %v, want %s", perr, CodeInvalidFrame)
+	}
+}
@@ -0,0 +1,372 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/service"
+	"github.com/olahol/melody"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// eventHandler handles one type of client event
+type eventHandler struct {
+	// payload creates the value the payload of the event is decoded into
+	payload func() Payload
+
+	// authenticated events need a session opened with a token
+	authenticated bool
+
+	handle func(s *melody.Session, request *Request, payload Payload) *ProtocolError
+}
+
+// eventHandlers returns the handlers of the client events by type
+func (h *Hub) eventHandlers() map[string]eventHandler {
+	return map[string]eventHandler{
+		"ping": {
+			payload: func() Payload { return &PingData{} },
+			handle:  h.ping,
+		},
+		"addUser": {
+			payload: func() Payload { return &EmptyData{} },
+			handle:  h.addUser,
+		},
+		"sendMessage": {
+			payload:       func() Payload { return &SendMessageData{} },
+			authenticated: true,
+			handle:        h.sendMessage,
+		},
+		"subscribe": {
+			payload:       func() Payload { return &RoomData{} },
+			authenticated: true,
+			handle:        h.subscribe,
+		},
+		"unsubscribe": {
+			payload: func() Payload { return &RoomData{} },
+			handle:  h.unsubscribe,
+		},
+		"typing": {
+			payload: func() Payload { return &TypingData{} },
+			handle:  h.typing,
+		},
+		"resume": {
+			payload:       func() Payload { return &ResumeData{} },
+			authenticated: true,
+			handle:        h.resume,
+		},
+		"ack": {
+			payload:       func() Payload { return &AckData{} },
+			authenticated: true,
+			handle:        h.ack,
+		},
+		"read": {
+			payload:       func() Payload { return &ReadData{} },
+			authenticated: true,
+			handle:        h.read,
+		},
+	}
+}
+
+func internalError(err error) *ProtocolError {
+	log.Println("socket:", err)
+	return protocolError(CodeInternal, "Internal server error")
+}
+
+func (h *Hub) ping(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*PingData)
+	h.reply(s, request, "pong", PongData{Nonce: data.Nonce, Time: time.Now()})
+	return nil
+}
+
+func (h *Hub) addUser(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	if err := h.publishOnline(context.Background(), Delivery{ExcludeSession: sessionIDOf(s)}); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// sendMessage saves a message sent over the socket before delivering it, with the checks of the message API.
+// The sender gets a messageAck with the stored message, a retried message is acknowledged again but not delivered twice.
+func (h *Hub) sendMessage(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	ctx := context.Background()
+	data := payload.(*SendMessageData)
+
+	// The sender is the user of the session, not whoever the payload claims
+	senderID := userIDOf(s)
+	allowed, err := h.accountService.CanSendMessages(ctx, senderID)
+	if err != nil {
+		return internalError(err)
+	}
+	if !allowed {
+		return protocolError(CodeForbidden, "Email not verified")
+	}
+
+	conversation, err := h.conversationService.FindByID(ctx, data.ConversationID)
+	if err != nil || !conversation.HasMember(senderID) {
+		return protocolError(CodeNotFound, "Conversation not found")
+	}
+	if data.RecipientID != "" && (data.RecipientID == senderID || !conversation.HasMember(data.RecipientID)) {
+		return protocolError(CodeNotFound, "Recipient not found")
+	}
+
+	// A block in either direction closes the direct conversation
+	recipients := h.unblocked(ctx, senderID, otherMembers(conversation, senderID))
+	if conversation.Recipient(senderID) != nil && len(recipients) == 0 {
+		return protocolError(CodeForbidden, service.ErrBlocked.Error())
+	}
+
+	message := model.Message{
+		ID:              primitive.NewObjectID(),
+		ConversationID:  data.ConversationID,
+		Sender:          senderID,
+		Text:            data.Text,
+		ClientMessageID: data.ClientMessageID,
+		CreateAt:        time.Now(),
+	}
+
+	err = h.messageService.Create(ctx, &message)
+	if errors.Is(err, service.ErrDuplicateMessage) {
+		h.reply(s, request, "messageAck", MessageAckData{ClientMessageID: data.ClientMessageID, Message: &message})
+		return nil
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	// Blocked members get a receipt too so the status does not reveal the block
+	if err := h.receiptService.Create(ctx, &message, otherMembers(conversation, senderID)); err != nil {
+		log.Println("socket:", err)
+	}
+
+	h.reply(s, request, "messageAck", MessageAckData{ClientMessageID: data.ClientMessageID, Message: &message})
+	h.deliverMessage(ctx, recipients, &message)
+	return nil
+}
+
+// DeliverMessage sends a new message to its recipients and notifies the ones whose settings allow it
+func (h *Hub) DeliverMessage(recipients []string, message *model.Message) {
+	h.deliverMessage(context.Background(), recipients, message)
+}
+
+// deliverMessage sends a message to its recipients and notifies those whose settings allow it
+func (h *Hub) deliverMessage(ctx context.Context, recipients []string, message *model.Message) {
+	h.SendToUsers(recipients, "getMessage", message)
+
+	notified, err := h.settingsService.Notified(ctx, message, recipients)
+	if err != nil {
+		log.Println("socket:", err)
+		return
+	}
+
+	for _, recipientID := range notified {
+		notificationType := "message"
+		if message.IsMentioned(recipientID) {
+			notificationType = "mention"
+		}
+
+		h.SendToUser(recipientID, "notification", Notification{
+			Type:           notificationType,
+			ConversationID: message.ConversationID,
+			SenderID:       message.Sender,
+			Text:           message.Text,
+		})
+	}
+}
+
+// unblocked filters out the recipients that are blocked from or by the sender
+func (h *Hub) unblocked(ctx context.Context, senderID string, candidates []string) []string {
+	recipients := []string{}
+	for _, recipientID := range candidates {
+		blocked, err := h.blockService.IsBlocked(ctx, senderID, recipientID)
+		if err != nil {
+			log.Println("socket:", err)
+			continue
+		}
+
+		if !blocked {
+			recipients = append(recipients, recipientID)
+		}
+	}
+	return recipients
+}
+
+// otherMembers returns the ids of the members of a conversation except the given user
+func otherMembers(conversation *model.Conversation, userID string) []string {
+	members := []string{}
+	for _, member := range conversation.Members {
+		if memberID := member.ID.Hex(); memberID != userID {
+			members = append(members, memberID)
+		}
+	}
+	return members
+}
+
+// subscribe a session to a conversation it is a member of
+func (h *Hub) subscribe(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*RoomData)
+
+	conversation, err := h.conversationService.FindByID(context.Background(), data.ConversationID)
+	if err != nil || !conversation.HasMember(userIDOf(s)) {
+		return protocolError(CodeNotFound, "Conversation not found")
+	}
+
+	h.index.Subscribe(data.ConversationID, s)
+	h.reply(s, request, "subscribed", data)
+	return nil
+}
+
+func (h *Hub) unsubscribe(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*RoomData)
+
+	h.index.Unsubscribe(data.ConversationID, s)
+	h.reply(s, request, "unsubscribed", data)
+	return nil
+}
+
+// typing tells the other sessions viewing a conversation that the user is typing, members blocked from or by the user are not told
+func (h *Hub) typing(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	ctx := context.Background()
+	data := payload.(*TypingData)
+	if !h.index.Subscribed(data.ConversationID, s) {
+		return protocolError(CodeForbidden, "Not subscribed")
+	}
+
+	conversation, err := h.conversationService.FindByID(ctx, data.ConversationID)
+	if err != nil || !conversation.HasMember(userIDOf(s)) {
+		return protocolError(CodeNotFound, "Conversation not found")
+	}
+
+	data.UserID = userIDOf(s)
+	others := otherMembers(conversation, data.UserID)
+	recipients := make(map[string]bool, len(others))
+	for _, recipientID := range h.unblocked(ctx, data.UserID, others) {
+		recipients[recipientID] = true
+	}
+
+	delivery := Delivery{Room: data.ConversationID, ExcludeSession: sessionIDOf(s)}
+	for _, memberID := range others {
+		if !recipients[memberID] {
+			delivery.ExcludeUserIDs = append(delivery.ExcludeUserIDs, memberID)
+		}
+	}
+
+	h.publish(delivery, "typing", data)
+	return nil
+}
+
+// resume replays the events a session missed since the last one it saw, then switches it back to live delivery.
+// A replay larger than half the send buffer is paged, resumed tells the client the last event of the page and that more follow,
+// the client sends resume again with it as lastSeq until a resumed without more.
+// When the log no longer holds every missed event the session gets a resync event and has to reload its state.
+func (h *Hub) resume(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*ResumeData)
+
+	st := streamOf(s)
+	if st == nil || !st.begin() {
+		return protocolError(CodeForbidden, "Resume already in progress")
+	}
+
+	// Batched frames go out before the replay
+	if bt := batcherOf(s); bt != nil {
+		bt.flush(s)
+	}
+
+	ctx := context.Background()
+	userID := userIDOf(s)
+	replayed := map[int64]bool{}
+	more := false
+	defer func() { st.finish(s, replayed, more) }()
+
+	var lastSeq int64
+	if data.LastSeq != nil {
+		lastSeq = *data.LastSeq
+	} else {
+		cursor, err := h.eventService.FindCursor(ctx, userID)
+		if err != nil {
+			return internalError(err)
+		}
+		lastSeq = cursor.Acked
+	}
+
+	events, latest, err := h.eventService.Replay(ctx, userID, lastSeq)
+	if errors.Is(err, service.ErrEventsExpired) {
+		h.reply(s, request, "resync", SeqData{Seq: latest})
+		return nil
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	// A page leaves room in the send buffer for live events and the reply
+	if page := replayPage(s); len(events) > page {
+		events = events[:page]
+		latest = events[page-1].Seq
+		more = true
+	}
+
+	for _, event := range events {
+		replayed[event.Seq] = true
+		h.writeFrame(s, Frame{Event: event.Event, Message: event.Message, Seq: event.Seq})
+	}
+	h.reply(s, request, "resumed", SeqData{Seq: latest, More: more})
+	return nil
+}
+
+// ack records that a client of the user processed the events up to a sequence number.
+// The messages among the newly acknowledged events count as delivered to the user.
+func (h *Hub) ack(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*AckData)
+
+	ctx := context.Background()
+	userID := userIDOf(s)
+	events, err := h.eventService.Ack(ctx, userID, data.Seq)
+	if err != nil {
+		return internalError(err)
+	}
+
+	messageIDs := []primitive.ObjectID{}
+	for _, event := range events {
+		if event.Event != "getMessage" {
+			continue
+		}
+
+		var message model.Message
+		if err := json.Unmarshal(event.Message, &message); err != nil || message.Seq == 0 {
+			continue
+		}
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	receipts, err := h.receiptService.MarkDelivered(ctx, userID, messageIDs)
+	if err != nil {
+		return internalError(err)
+	}
+	PublishStatus(h, receipts)
+	return nil
+}
+
+// read marks the messages of a conversation up to a sequence number as read by the user of the session
+func (h *Hub) read(s *melody.Session, request *Request, payload Payload) *ProtocolError {
+	data := payload.(*ReadData)
+
+	ctx := context.Background()
+	userID := userIDOf(s)
+	conversation, err := h.conversationService.FindByID(ctx, data.ConversationID)
+	if err != nil || !conversation.HasMember(userID) {
+		return protocolError(CodeNotFound, "Conversation not found")
+	}
+
+	receipts, err := h.receiptService.MarkRead(ctx, userID, data.ConversationID, data.Seq)
+	if err != nil {
+		return internalError(err)
+	}
+	PublishStatus(h, receipts)
+	if len(receipts) > 0 {
+		PublishReadPointer(h, conversation, userID, data.Seq)
+	}
+	return nil
+}
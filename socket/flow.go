@@ -0,0 +1,215 @@
+package socket
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+// reservedSlots are kept free in the send buffer of a session so a close frame always fits
+const reservedSlots = 4
+
+// outbox counts the frames queued for a session that melody has not written yet.
+// Melody drops frames once its buffer is full, so a session about to fill it is closed instead and resumes from the event log.
+type outbox struct {
+	queued   int64
+	capacity int64
+	closing  int32
+}
+
+func newOutbox(bufferSize int) *outbox {
+	capacity := bufferSize - reservedSlots
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &outbox{capacity: int64(capacity)}
+}
+
+// outboxOf returns the outbox of a session
+func outboxOf(s *melody.Session) *outbox {
+	value, ok := s.Get("outbox")
+	if !ok {
+		return nil
+	}
+	ob, _ := value.(*outbox)
+	return ob
+}
+
+// full tells whether the send buffer of the session has no room left
+func (o *outbox) full() bool {
+	return o != nil && atomic.LoadInt64(&o.queued) >= o.capacity
+}
+
+// replayPage returns the number of replayed events written to a session at once, half of its send buffer
+func replayPage(s *melody.Session) int {
+	ob := outboxOf(s)
+	if ob == nil || ob.capacity < 2 {
+		return 1
+	}
+	return int(ob.capacity / 2)
+}
+
+// writeTo writes an encoded frame to a session as a text or binary message depending on its codec
+func writeTo(s *melody.Session, data []byte) {
+	if ob := outboxOf(s); ob != nil {
+		if atomic.LoadInt32(&ob.closing) == 1 {
+			return
+		}
+		if atomic.AddInt64(&ob.queued, 1) > ob.capacity {
+			atomic.AddInt64(&ob.queued, -1)
+			overflow(s)
+			return
+		}
+	}
+
+	if codecOf(s).Binary() {
+		s.WriteBinary(data)
+		return
+	}
+	s.Write(data)
+}
+
+// sent releases the slot of a frame melody wrote to the connection
+func sent(s *melody.Session, _ []byte) {
+	if ob := outboxOf(s); ob != nil {
+		atomic.AddInt64(&ob.queued, -1)
+	}
+}
+
+// overflow closes a session that cannot keep up, the client reconnects and resumes from the last sequence number it saw
+func overflow(s *melody.Session) {
+	ob := outboxOf(s)
+	if ob == nil || !atomic.CompareAndSwapInt32(&ob.closing, 0, 1) {
+		return
+	}
+
+	metrics.Add("sendBufferFull", 1)
+	s.CloseWithMsg(websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "send buffer full"))
+}
+
+const (
+	// maxBatchFrames is the largest number of frames in a batch frame
+	maxBatchFrames = 64
+
+	// maxHeldFrames is the largest number of frames a batching session holds while its send buffer is full
+	maxHeldFrames = 1024
+)
+
+// batcher coalesces the frames delivered to a session within a window into batch frames
+type batcher struct {
+	mu      sync.Mutex
+	window  time.Duration
+	frames  []Frame
+	timer   *time.Timer
+	stopped bool
+}
+
+func newBatcher(window time.Duration) *batcher {
+	return &batcher{window: window}
+}
+
+// batcherOf returns the batcher of a session that opted in to batching
+func batcherOf(s *melody.Session) *batcher {
+	value, ok := s.Get("batcher")
+	if !ok {
+		return nil
+	}
+	b, _ := value.(*batcher)
+	return b
+}
+
+// add a frame to the next batch
+func (b *batcher) add(s *melody.Session, frame Frame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return
+	}
+
+	b.frames = append(b.frames, frame)
+	if len(b.frames) > maxHeldFrames {
+		b.frames = nil
+		overflow(s)
+		return
+	}
+
+	if len(b.frames) >= maxBatchFrames && !outboxOf(s).full() {
+		b.flushLocked(s)
+		return
+	}
+	b.schedule(s)
+}
+
+// flush the held frames now
+func (b *batcher) flush(s *melody.Session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.flushLocked(s)
+}
+
+// stop drops the held frames of a closed session
+func (b *batcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.frames = nil
+	b.stopped = true
+}
+
+func (b *batcher) schedule(s *melody.Session) {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, func() { b.flush(s) })
+	}
+}
+
+// flushLocked writes the held frames while the send buffer has room, the rest waits for the next window
+func (b *batcher) flushLocked(s *melody.Session) {
+	for len(b.frames) > 0 && !b.stopped {
+		if outboxOf(s).full() {
+			b.schedule(s)
+			return
+		}
+
+		n := len(b.frames)
+		if n > maxBatchFrames {
+			n = maxBatchFrames
+		}
+		writeBatch(s, b.frames[:n])
+		b.frames = b.frames[n:]
+	}
+	b.frames = nil
+}
+
+// writeBatch writes frames as one batch frame, a single frame is written as is
+func writeBatch(s *melody.Session, frames []Frame) {
+	frame := frames[0]
+	if len(frames) > 1 {
+		version := versionOf(s)
+		envelopes := make([]interface{}, len(frames))
+		for i, f := range frames {
+			envelopes[i] = f.envelope(version)
+		}
+		frame = Frame{Event: "batch", Message: envelopes}
+	}
+
+	b, err := codecOf(s).EncodeFrame(frame, versionOf(s))
+	if err != nil {
+		log.Println("socket:", err)
+		return
+	}
+	writeTo(s, b)
+}
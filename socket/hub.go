@@ -0,0 +1,555 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/guutong/chat-backend/middleware"
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/service"
+	"github.com/olahol/melody"
+)
+
+// IPublisher sends events to connected users
+type IPublisher interface {
+	// Send an event to every session of a user
+	SendToUser(userID string, event string, message interface{})
+
+	// Send an event to every session of several users, such as the members of a conversation
+	SendToUsers(userIDs []string, event string, message interface{})
+
+	// Send an event to the sessions subscribed to a conversation
+	SendToRoom(conversationID string, event string, message interface{})
+
+	// Send a new message to its recipients and notify the ones whose settings allow it
+	DeliverMessage(recipients []string, message *model.Message)
+}
+
+// Config holds the connection settings of the hub, zero values keep the melody defaults
+type Config struct {
+	// Time allowed to write a frame to a client
+	WriteWait time.Duration
+
+	// Time allowed between pongs from a client, a session without one is closed
+	PongWait time.Duration
+
+	// Interval of the ping control frames sent to clients, it must be shorter than PongWait
+	PingPeriod time.Duration
+
+	// Largest message accepted from a client in bytes
+	MaxMessageSize int64
+
+	// Rate limits of the events sent by clients
+	Limits Limits
+
+	// Negotiate permessage-deflate with clients that offer it
+	Compression bool
+
+	// Frames queued for a session before it counts as too slow and is closed
+	MessageBufferSize int
+
+	// Longest batch window a session can ask for, batching is off when it is zero
+	MaxBatchWindow time.Duration
+}
+
+// Hub is the websocket server of the chat.
+// Events go through the broker so sessions connected to other nodes receive them as well.
+type Hub struct {
+	melody       *melody.Melody
+	events       map[string]eventHandler
+	index        *SessionIndex
+	sse          *sseRegistry
+	listeners    *listeners
+	limiter      *limiter
+	broker       Broker
+	presence     Presence
+	blockService service.IBlockService
+
+	conversationService service.IConversationService
+	eventService        service.IEventService
+	messageService      service.IMessageService
+	accountService      service.IAccountService
+	receiptService      service.IReceiptService
+	settingsService     service.ISettingsService
+	maxBatchWindow      time.Duration
+
+	// Appends of a user are published in the order of their sequence numbers by this node
+	appendLocks [64]sync.Mutex
+}
+
+// NewHub creates a new websocket hub
+func NewHub(
+	broker Broker,
+	presence Presence,
+	blockService service.IBlockService,
+	conversationService service.IConversationService,
+	eventService service.IEventService,
+	messageService service.IMessageService,
+	accountService service.IAccountService,
+	receiptService service.IReceiptService,
+	settingsService service.ISettingsService,
+	config Config,
+) (*Hub, error) {
+	m := melody.New()
+	if config.WriteWait > 0 {
+		m.Config.WriteWait = config.WriteWait
+	}
+	if config.PongWait > 0 {
+		m.Config.PongWait = config.PongWait
+	}
+	if config.PingPeriod > 0 {
+		m.Config.PingPeriod = config.PingPeriod
+	}
+	if config.MaxMessageSize > 0 {
+		m.Config.MaxMessageSize = config.MaxMessageSize
+	}
+	if config.MessageBufferSize > 0 {
+		m.Config.MessageBufferSize = config.MessageBufferSize
+	}
+	if m.Config.PingPeriod >= m.Config.PongWait {
+		return nil, errors.New("socket: ping period must be shorter than pong wait")
+	}
+	m.Upgrader.CheckOrigin = func(r *http.Request) bool { return true } // origni check
+
+	h := &Hub{
+		melody:       m,
+		index:        NewSessionIndex(),
+		sse:          newSSERegistry(),
+		listeners:    newListeners(),
+		limiter:      newLimiter(config.Limits),
+		broker:       broker,
+		presence:     presence,
+		blockService: blockService,
+
+		conversationService: conversationService,
+		eventService:        eventService,
+		messageService:      messageService,
+		accountService:      accountService,
+		receiptService:      receiptService,
+		settingsService:     settingsService,
+		maxBatchWindow:      config.MaxBatchWindow,
+	}
+	h.events = h.eventHandlers()
+	m.HandleConnect(h.handleConnect)
+	m.HandleMessage(h.handleMessage)
+	m.HandleMessageBinary(h.handleMessage)
+	m.HandleSentMessage(sent)
+	m.HandleSentMessageBinary(sent)
+	m.Upgrader.Subprotocols = subprotocols()
+	m.Upgrader.EnableCompression = config.Compression
+	m.HandleDisconnect(h.handleDisconnect)
+	m.HandleError(h.handleError)
+
+	if err := broker.Subscribe(h.deliver); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// HandleRequest upgrades a request to a websocket session.
+// The token query parameter authenticates the session, a request without a valid token is rejected.
+// The version query parameter picks the protocol version of the session, version 1 by default.
+// A client can negotiate a binary codec with a websocket subprotocol, binary codecs use protocol version 2.
+// The batch query parameter opts in to batch frames, the events delivered within that many milliseconds are sent together.
+func (h *Hub) HandleRequest(c *gin.Context) {
+	codec := negotiate(websocket.Subprotocols(c.Request))
+
+	version := ProtocolV1
+	if codec.Binary() {
+		version = ProtocolV2
+	}
+	if v := c.Query("version"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || (parsed != ProtocolV1 && parsed != ProtocolV2) || (codec.Binary() && parsed != ProtocolV2) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported protocol version"})
+			return
+		}
+		version = parsed
+	}
+
+	keys := map[string]interface{}{"version": version, "codec": codec}
+	if b := c.Query("batch"); b != "" {
+		ms, err := strconv.Atoi(b)
+		if err != nil || ms <= 0 || int64(ms) > h.maxBatchWindow.Milliseconds() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch window"})
+			return
+		}
+		keys["batch"] = time.Duration(ms) * time.Millisecond
+	}
+
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, err := middleware.ParseToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	keys["userId"] = userID
+
+	// The slot is taken before the upgrade so concurrent upgrades cannot go over the cap, the disconnect gives it back
+	if !h.limiter.reserve(userID) {
+		metrics.Add("connectionsRejected", 1)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many connections"})
+		return
+	}
+
+	if err := h.melody.HandleRequestWithKeys(c.Writer, c.Request, keys); err != nil {
+		h.limiter.release(userID)
+	}
+}
+
+// Send an event to every session of a user
+func (h *Hub) SendToUser(userID string, event string, message interface{}) {
+	h.SendToUsers([]string{userID}, event, message)
+}
+
+// Send an event to every session of several users, such as the members of a conversation.
+// The event is appended to the log of each user so a session that missed it can replay it.
+func (h *Hub) SendToUsers(userIDs []string, event string, message interface{}) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(message)
+	if err != nil {
+		log.Println("socket:", err)
+		return
+	}
+
+	ctx := context.Background()
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		h.appendAndPublish(ctx, Delivery{UserIDs: []string{userID}, Event: event, Message: b})
+	}
+}
+
+// appendAndPublish appends the event of a delivery to the log of its user and publishes it.
+// Events of a user appended on other nodes at the same time can still arrive out of order, the client resumes the gap.
+func (h *Hub) appendAndPublish(ctx context.Context, delivery Delivery) {
+	userID := delivery.UserIDs[0]
+	hash := fnv.New32a()
+	hash.Write([]byte(userID))
+	lock := &h.appendLocks[hash.Sum32()%uint32(len(h.appendLocks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The event is still delivered live when it cannot be logged
+	if userEvent, err := h.eventService.Append(ctx, userID, delivery.Event, delivery.Message); err != nil {
+		log.Println("socket:", err)
+	} else {
+		delivery.Seq = userEvent.Seq
+	}
+
+	if err := h.broker.Publish(ctx, delivery); err != nil {
+		log.Println("socket:", err)
+	}
+}
+
+// Send an event to the sessions subscribed to a conversation
+func (h *Hub) SendToRoom(conversationID string, event string, message interface{}) {
+	h.publish(Delivery{Room: conversationID}, event, message)
+}
+
+func (h *Hub) publish(delivery Delivery, event string, message interface{}) {
+	b, err := json.Marshal(message)
+	if err != nil {
+		log.Println("socket:", err)
+		return
+	}
+
+	delivery.Event = event
+	delivery.Message = b
+	if err := h.broker.Publish(context.Background(), delivery); err != nil {
+		log.Println("socket:", err)
+	}
+}
+
+// deliver writes a delivery from the broker to the matching sessions of this node
+func (h *Hub) deliver(delivery Delivery) {
+	h.deliverSSE(delivery)
+	if delivery.Seq > 0 {
+		h.listeners.notify(delivery.UserIDs)
+	}
+
+	frame := newEncodedFrame(Frame{Event: delivery.Event, Message: delivery.Message, Seq: delivery.Seq})
+
+	var sessions []*melody.Session
+	switch {
+	case delivery.Room != "":
+		sessions = h.index.RoomSessions(delivery.Room)
+	case len(delivery.UserIDs) == 0:
+		var err error
+		if sessions, err = h.melody.Sessions(); err != nil {
+			log.Println("socket:", err)
+			return
+		}
+	default:
+		seen := make(map[string]bool, len(delivery.UserIDs))
+		for _, userID := range delivery.UserIDs {
+			if !seen[userID] {
+				seen[userID] = true
+				sessions = append(sessions, h.index.Sessions(userID)...)
+			}
+		}
+	}
+
+	excluded := delivery.excludedUsers()
+	for _, q := range sessions {
+		if delivery.ExcludeSession != "" && sessionIDOf(q) == delivery.ExcludeSession {
+			continue
+		}
+		if excluded[userIDOf(q)] {
+			continue
+		}
+
+		// Durable frames held back by a resume are not batched so the replay can skip them
+		st := streamOf(q)
+		if bt := batcherOf(q); bt != nil && (st == nil || !st.holding(delivery.Seq)) {
+			bt.add(q, frame.frame)
+			continue
+		}
+
+		// A frame the codec of the session cannot encode is only lost for that session
+		b, err := frame.bytes(codecOf(q), versionOf(q))
+		if err != nil {
+			log.Println("socket:", err)
+			continue
+		}
+
+		if st != nil {
+			st.write(q, delivery.Seq, b)
+		} else {
+			writeTo(q, b)
+		}
+	}
+}
+
+// handleMessage decodes a client frame and runs the handler of its type, a request that fails gets an error frame
+func (h *Hub) handleMessage(s *melody.Session, msg []byte) {
+	request, perr := codecOf(s).DecodeRequest(msg, versionOf(s))
+
+	// Malformed frames count against the limit of every event
+	event := ""
+	if request != nil {
+		event = request.Type
+	}
+	if !h.allow(s, request, event) {
+		return
+	}
+
+	if perr != nil {
+		h.fail(s, request, perr)
+		return
+	}
+
+	handler, ok := h.events[request.Type]
+	if !ok {
+		h.fail(s, request, protocolError(CodeUnknownType, "Unknown type "+request.Type))
+		return
+	}
+
+	if handler.authenticated && !authenticated(s) {
+		h.fail(s, request, protocolError(CodeUnauthorized, "Unauthorized"))
+		return
+	}
+
+	payload := handler.payload()
+	if perr := DecodePayload(request, payload); perr != nil {
+		h.fail(s, request, perr)
+		return
+	}
+
+	if perr := handler.handle(s, request, payload); perr != nil {
+		h.fail(s, request, perr)
+	}
+}
+
+// allow checks the rate limits of an event, a session that keeps going over them is closed
+func (h *Hub) allow(s *melody.Session, request *Request, event string) bool {
+	metrics.Add("events", 1)
+
+	sessionBuckets, _ := s.Get("limits")
+	session, _ := sessionBuckets.(*buckets)
+	if session == nil {
+		return true
+	}
+
+	allowed := session.allow(event)
+	if userID := userIDOf(s); allowed && userID != "" {
+		allowed = h.limiter.user(userID).allow(event)
+	}
+	if allowed {
+		return true
+	}
+
+	metrics.Add("eventsLimited", 1)
+	if max := h.limiter.limits.MaxViolations; max > 0 && session.violate() >= max {
+		metrics.Add("sessionsClosed", 1)
+		s.CloseWithMsg(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"))
+		return false
+	}
+
+	h.fail(s, request, protocolError(CodeRateLimited, "Rate limited"))
+	return false
+}
+
+// fail sends an error frame for a request, the request is nil when the frame could not be decoded at all
+func (h *Hub) fail(s *melody.Session, request *Request, perr *ProtocolError) {
+	metrics.Add("protocolErrors", 1)
+
+	frame := Frame{Event: "error", Message: ErrorData{Code: perr.Code, Error: perr.Message}}
+	if request != nil {
+		frame.ID = request.ID
+		frame.Message = ErrorData{Event: request.Type, Code: perr.Code, Error: perr.Message}
+	}
+	h.writeFrame(s, frame)
+}
+
+// reply sends an event answering a request to the session that sent it
+func (h *Hub) reply(s *melody.Session, request *Request, event string, message interface{}) {
+	h.writeFrame(s, Frame{ID: request.ID, Event: event, Message: message})
+}
+
+// writeFrame sends a frame to a single session of this node
+func (h *Hub) writeFrame(s *melody.Session, frame Frame) {
+	b, err := codecOf(s).EncodeFrame(frame, versionOf(s))
+	if err != nil {
+		log.Println("socket:", err)
+		return
+	}
+	writeTo(s, b)
+}
+
+// ServeSchema serves the JSON Schema of the socket protocol
+func (h *Hub) ServeSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", Schema)
+}
+
+func (h *Hub) handleConnect(s *melody.Session) {
+	s.Set("sessionId", uuid.NewString())
+	s.Set("stream", &stream{})
+	s.Set("limits", newBuckets(h.limiter.limits.Session))
+	s.Set("outbox", newOutbox(h.melody.Config.MessageBufferSize))
+	if window, ok := s.Get("batch"); ok {
+		s.Set("batcher", newBatcher(window.(time.Duration)))
+	}
+	metrics.Add("connections", 1)
+	if userID := userIDOf(s); userID != "" {
+		h.index.Add(userID, s)
+		if err := h.presence.Connect(context.Background(), userID); err != nil {
+			log.Println("presence:", err)
+		}
+	}
+}
+
+// handleDisconnect runs once for every closed session, including the ones reaped for missing pongs
+func (h *Hub) handleDisconnect(s *melody.Session) {
+	s.UnSet("data")
+	metrics.Add("connections", -1)
+	if b := batcherOf(s); b != nil {
+		b.stop()
+	}
+
+	userID := userIDOf(s)
+	if userID == "" {
+		return
+	}
+
+	h.index.Remove(userID, s)
+	h.limiter.release(userID)
+	last := h.index.Count(userID) == 0
+
+	if err := h.presence.Disconnect(context.Background(), userID); err != nil {
+		log.Println("presence:", err)
+		return
+	}
+
+	// Tell the other users once the last session of the user on this node is gone
+	if last {
+		if err := h.publishOnline(context.Background(), Delivery{}); err != nil {
+			log.Println("presence:", err)
+		}
+	}
+}
+
+// publishOnline sends the online users to everyone, users that blocked each other are left out of each other's list
+func (h *Hub) publishOnline(ctx context.Context, delivery Delivery) error {
+	socketUsers, err := h.presence.Online(ctx)
+	if err != nil {
+		return err
+	}
+
+	hidden, err := h.blockService.FindBlockedAmong(ctx, socketUsers)
+	if err != nil {
+		return err
+	}
+
+	// The users with blocks get a list of their own, everyone else gets the whole list
+	for userID, hiddenUsers := range hidden {
+		visible := []string{}
+		for _, onlineID := range socketUsers {
+			if !hiddenUsers[onlineID] {
+				visible = append(visible, onlineID)
+			}
+		}
+		h.publish(Delivery{UserIDs: []string{userID}, ExcludeSession: delivery.ExcludeSession}, "getUsers", visible)
+		delivery.ExcludeUserIDs = append(delivery.ExcludeUserIDs, userID)
+	}
+
+	h.publish(delivery, "getUsers", socketUsers)
+	return nil
+}
+
+func (h *Hub) handleError(s *melody.Session, err error) {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return
+	}
+	log.Println("socket:", userIDOf(s), err)
+}
+
+// userIDOf returns the user of a session, taken from the token it was opened with
+func userIDOf(s *melody.Session) string {
+	if userID, ok := s.Get("userId"); ok {
+		return userID.(string)
+	}
+	return ""
+}
+
+// authenticated checks whether the session was opened with a valid token
+func authenticated(s *melody.Session) bool {
+	_, ok := s.Get("userId")
+	return ok
+}
+
+// versionOf returns the protocol version of a session
+func versionOf(s *melody.Session) int {
+	value, _ := s.Get("version")
+	if version, ok := value.(int); ok {
+		return version
+	}
+	return ProtocolV1
+}
+
+func sessionIDOf(s *melody.Session) string {
+	sessionID, _ := s.Get("sessionId")
+	id, _ := sessionID.(string)
+	return id
+}
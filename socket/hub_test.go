@@ -0,0 +1,333 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guutong/chat-backend/model"
+	"github.com/guutong/chat-backend/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHandleRequestRequiresToken(t *testing.T) {
+	server := newTestServer(t, Config{})
+
+	for _, url := range []string{
+		"ws://chat.test/ws",
+		"ws://chat.test/ws?userId=64b7f0c2a1b2c3d4e5f60718",
+		"ws://chat.test/ws?token=invalid&userId=64b7f0c2a1b2c3d4e5f60718",
+	} {
+		conn, res, err := server.dialer.Dial(url, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: upgraded without a valid token", url)
+			continue
+		}
+		if res == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: got %v, want status %d", url, err, http.StatusUnauthorized)
+		}
+	}
+
+	if count := server.hub.index.Count("64b7f0c2a1b2c3d4e5f60718"); count != 0 {
+		t.Errorf("the index holds %d sessions of the user, want 0", count)
+	}
+}
+
+func TestServeEventsQueryToken(t *testing.T) {
+	server := newTestServer(t, Config{})
+	client := &http.Client{Transport: &http.Transport{DialContext: server.listener.dial}}
+
+	res, err := client.Get("http://chat.test/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d without a token, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	res, err = client.Get("http://chat.test/api/events?token=" + signToken(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d with a token, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	server.hub.deliver(Delivery{UserIDs: []string{"alice"}, Seq: 7, Event: "getMessage", Message: []byte(`{"text":"hello"}`)})
+
+	want := "id: 7\nevent: getMessage\ndata: {\"text\":\"hello\"}\n\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(res.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("streamed %q, want %q", got, want)
+	}
+}
+
+func TestServeEventsConnectionCap(t *testing.T) {
+	server := newTestServer(t, Config{Limits: Limits{MaxConnections: 1}})
+	client := &http.Client{Transport: &http.Transport{DialContext: server.listener.dial}}
+	token := signToken(t, "alice")
+
+	stream, err := client.Get("http://chat.test/api/events?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for the first stream, want %d", stream.StatusCode, http.StatusOK)
+	}
+
+	// The stream holds the only slot of the user, a socket session is refused as well
+	res, err := client.Get("http://chat.test/api/events?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for a second stream, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+	if _, res, err := server.dialer.Dial("ws://chat.test/ws?token="+token, nil); err == nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("dial with a stream open: err %v, want status %d", err, http.StatusTooManyRequests)
+	}
+
+	// Closing the stream gives the slot back
+	stream.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := client.Get("http://chat.test/api/events?token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %d after the stream closed, want %d", res.StatusCode, http.StatusOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// memoryEvents is an event service holding the log of every user in memory
+type memoryEvents struct {
+	mu   sync.Mutex
+	logs map[string][]*model.UserEvent
+}
+
+func (m *memoryEvents) Append(ctx context.Context, userID string, event string, message json.RawMessage) (*model.UserEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userEvent := &model.UserEvent{UserID: userID, Seq: int64(len(m.logs[userID])) + 1, Event: event, Message: message}
+	m.logs[userID] = append(m.logs[userID], userEvent)
+	return userEvent, nil
+}
+
+func (m *memoryEvents) Replay(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log := m.logs[userID]
+	return append([]*model.UserEvent{}, log[seq:]...), int64(len(log)), nil
+}
+
+func (m *memoryEvents) FindCursor(ctx context.Context, userID string) (*model.EventCursor, error) {
+	return &model.EventCursor{UserID: userID}, nil
+}
+
+func (m *memoryEvents) Ack(ctx context.Context, userID string, seq int64) ([]*model.UserEvent, error) {
+	return nil, nil
+}
+
+func TestResumePages(t *testing.T) {
+	// A buffer of 20 frames leaves 16 for events, pages of 8
+	server := newTestServer(t, Config{MessageBufferSize: 20})
+	events := &memoryEvents{logs: map[string][]*model.UserEvent{}}
+	server.hub.eventService = events
+	for i := 0; i < 20; i++ {
+		events.Append(context.Background(), "alice", "getMessage", json.RawMessage(`{}`))
+	}
+
+	conn := server.connect(t, "alice", "version=2")
+	defer conn.Close()
+	server.waitSessions(t, "alice", 1)
+
+	var lastSeq int64
+	for _, want := range []struct {
+		events int
+		seq    int64
+		more   bool
+	}{{8, 8, true}, {8, 16, true}, {4, 20, false}} {
+		request := fmt.Sprintf(`{"id":"r","type":"resume","version":2,"payload":{"lastSeq":%d}}`, lastSeq)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < want.events; i++ {
+			var frame struct {
+				Type string `json:"type"`
+				Seq  int64  `json:"seq"`
+			}
+			if err := conn.ReadJSON(&frame); err != nil {
+				t.Fatal(err)
+			}
+			if frame.Type != "getMessage" || frame.Seq != lastSeq+int64(i)+1 {
+				t.Fatalf("got %s %d, want getMessage %d", frame.Type, frame.Seq, lastSeq+int64(i)+1)
+			}
+		}
+
+		var resumed struct {
+			Type    string  `json:"type"`
+			Payload SeqData `json:"payload"`
+		}
+		if err := conn.ReadJSON(&resumed); err != nil {
+			t.Fatal(err)
+		}
+		if resumed.Type != "resumed" || resumed.Payload.Seq != want.seq || resumed.Payload.More != want.more {
+			t.Fatalf("got %s %+v, want resumed seq %d more %v", resumed.Type, resumed.Payload, want.seq, want.more)
+		}
+		lastSeq = resumed.Payload.Seq
+	}
+}
+
+// blocks answers from a fixed set of blocks, blocked maps a user to the users they blocked
+type blocks struct {
+	service.IBlockService
+	blocked map[string][]string
+}
+
+func (b *blocks) IsBlocked(ctx context.Context, userID string, otherID string) (bool, error) {
+	for _, blockedID := range b.blocked[userID] {
+		if blockedID == otherID {
+			return true, nil
+		}
+	}
+	for _, blockedID := range b.blocked[otherID] {
+		if blockedID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *blocks) FindBlockedAmong(ctx context.Context, userIDs []string) (map[string]map[string]bool, error) {
+	hidden := map[string]map[string]bool{}
+	for _, userID := range userIDs {
+		for _, otherID := range userIDs {
+			if blocked, _ := b.IsBlocked(ctx, userID, otherID); blocked {
+				if hidden[userID] == nil {
+					hidden[userID] = map[string]bool{}
+				}
+				hidden[userID][otherID] = true
+			}
+		}
+	}
+	return hidden, nil
+}
+
+// conversations finds the same conversation for every id
+type conversations struct {
+	service.IConversationService
+	conversation *model.Conversation
+}
+
+func (c *conversations) FindByID(ctx context.Context, id string) (*model.Conversation, error) {
+	return c.conversation, nil
+}
+
+// readFrame reads the next frame of a version 2 JSON session
+func readFrame(t *testing.T, conn *websocket.Conn) (string, json.RawMessage) {
+	t.Helper()
+
+	var frame struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame.Type, frame.Payload
+}
+
+func TestBlockedUsersDoNotSeeEachOther(t *testing.T) {
+	alice, bob, carol := "64b7f0c2a1b2c3d4e5f60701", "64b7f0c2a1b2c3d4e5f60702", "64b7f0c2a1b2c3d4e5f60703"
+	conversation := &model.Conversation{}
+	for _, userID := range []string{alice, bob, carol} {
+		id, _ := primitive.ObjectIDFromHex(userID)
+		conversation.Members = append(conversation.Members, model.User{ID: id})
+	}
+
+	server := newTestServer(t, Config{})
+	server.hub.blockService = &blocks{blocked: map[string][]string{alice: {bob}}}
+	server.hub.conversationService = &conversations{conversation: conversation}
+
+	conns := map[string]*websocket.Conn{}
+	for _, userID := range []string{alice, bob, carol} {
+		conn := server.connect(t, userID, "version=2")
+		defer conn.Close()
+		server.waitSessions(t, userID, 1)
+		conns[userID] = conn
+
+		request := `{"id":"s","type":"subscribe","version":2,"payload":{"conversationId":"64b7f0c2a1b2c3d4e5f60718"}}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		if event, payload := readFrame(t, conn); event != "subscribed" {
+			t.Fatalf("got %s %s, want subscribed", event, payload)
+		}
+	}
+
+	if err := conns[carol].WriteMessage(websocket.TextMessage, []byte(`{"type":"addUser","version":2,"payload":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	for userID, want := range map[string][]string{alice: {alice, carol}, bob: {bob, carol}} {
+		event, payload := readFrame(t, conns[userID])
+		var online []string
+		if err := json.Unmarshal(payload, &online); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(online)
+		if event != "getUsers" || !reflect.DeepEqual(online, want) {
+			t.Fatalf("%s got %s %v, want getUsers %v", userID, event, online, want)
+		}
+	}
+
+	// Bob does not see alice typing, the typing of carol is the first frame he gets
+	for _, userID := range []string{alice, carol} {
+		request := `{"type":"typing","version":2,"payload":{"conversationId":"64b7f0c2a1b2c3d4e5f60718","typing":true}}`
+		if err := conns[userID].WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event, payload := readFrame(t, conns[bob])
+	var typing TypingData
+	if err := json.Unmarshal(payload, &typing); err != nil {
+		t.Fatal(err)
+	}
+	if event != "typing" || typing.UserID != carol {
+		t.Fatalf("bob got %s from %s, want typing from carol", event, typing.UserID)
+	}
+
+	event, payload = readFrame(t, conns[carol])
+	if err := json.Unmarshal(payload, &typing); err != nil {
+		t.Fatal(err)
+	}
+	if event != "typing" || typing.UserID != alice {
+		t.Fatalf("carol got %s from %s, want typing from alice", event, typing.UserID)
+	}
+}
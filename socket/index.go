@@ -0,0 +1,142 @@
+package socket
+
+import (
+	"sync"
+
+	"github.com/olahol/melody"
+)
+
+// SessionIndex maps users and conversation rooms to their sessions on this node so delivery does not scan every session
+type SessionIndex struct {
+	mu           sync.RWMutex
+	users        map[string]map[*melody.Session]struct{}
+	rooms        map[string]map[*melody.Session]struct{}
+	sessionRooms map[*melody.Session]map[string]struct{}
+}
+
+// NewSessionIndex creates a new session index
+func NewSessionIndex() *SessionIndex {
+	return &SessionIndex{
+		users:        map[string]map[*melody.Session]struct{}{},
+		rooms:        map[string]map[*melody.Session]struct{}{},
+		sessionRooms: map[*melody.Session]map[string]struct{}{},
+	}
+}
+
+// Add a session of a user
+func (i *SessionIndex) Add(userID string, s *melody.Session) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	sessions, ok := i.users[userID]
+	if !ok {
+		sessions = map[*melody.Session]struct{}{}
+		i.users[userID] = sessions
+	}
+	sessions[s] = struct{}{}
+}
+
+// Remove a session of a user along with its room subscriptions
+func (i *SessionIndex) Remove(userID string, s *melody.Session) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for room := range i.sessionRooms[s] {
+		i.unsubscribe(room, s)
+	}
+
+	sessions, ok := i.users[userID]
+	if !ok {
+		return
+	}
+
+	delete(sessions, s)
+	if len(sessions) == 0 {
+		delete(i.users, userID)
+	}
+}
+
+// Subscribe a session to a room
+func (i *SessionIndex) Subscribe(room string, s *melody.Session) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	sessions, ok := i.rooms[room]
+	if !ok {
+		sessions = map[*melody.Session]struct{}{}
+		i.rooms[room] = sessions
+	}
+	sessions[s] = struct{}{}
+
+	rooms, ok := i.sessionRooms[s]
+	if !ok {
+		rooms = map[string]struct{}{}
+		i.sessionRooms[s] = rooms
+	}
+	rooms[room] = struct{}{}
+}
+
+// Unsubscribe a session from a room
+func (i *SessionIndex) Unsubscribe(room string, s *melody.Session) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.unsubscribe(room, s)
+}
+
+// Subscribed checks whether a session is subscribed to a room
+func (i *SessionIndex) Subscribed(room string, s *melody.Session) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	_, ok := i.rooms[room][s]
+	return ok
+}
+
+// RoomSessions returns the sessions subscribed to a room
+func (i *SessionIndex) RoomSessions(room string) []*melody.Session {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	sessions := make([]*melody.Session, 0, len(i.rooms[room]))
+	for s := range i.rooms[room] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (i *SessionIndex) unsubscribe(room string, s *melody.Session) {
+	if sessions, ok := i.rooms[room]; ok {
+		delete(sessions, s)
+		if len(sessions) == 0 {
+			delete(i.rooms, room)
+		}
+	}
+
+	if rooms, ok := i.sessionRooms[s]; ok {
+		delete(rooms, room)
+		if len(rooms) == 0 {
+			delete(i.sessionRooms, s)
+		}
+	}
+}
+
+// Sessions returns the sessions of a user
+func (i *SessionIndex) Sessions(userID string) []*melody.Session {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	sessions := make([]*melody.Session, 0, len(i.users[userID]))
+	for s := range i.users[userID] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Count returns the number of sessions of a user
+func (i *SessionIndex) Count(userID string) int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.users[userID])
+}
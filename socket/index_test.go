@@ -0,0 +1,208 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/guutong/chat-backend/middleware"
+	"github.com/olahol/melody"
+)
+
+// pipeListener is a listener of in-memory connections, thousands of sessions fit in it without a file descriptor each
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// dial opens a connection to the listener
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// testServer serves a hub on an in-memory listener
+type testServer struct {
+	hub      *Hub
+	listener *pipeListener
+	dialer   *websocket.Dialer
+}
+
+func newTestServer(tb testing.TB, config Config) *testServer {
+	tb.Helper()
+
+	if os.Getenv("JWT_SECRET") == "" {
+		os.Setenv("JWT_SECRET", "test-secret")
+	}
+
+	hub, err := NewHub(NewLocalBroker(), NewLocalPresence(), &blocks{}, nil, nil, nil, nil, nil, nil, config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.GET("/ws", hub.HandleRequest)
+	r.GET("/api/events", middleware.QueryAuthMiddleware(), hub.ServeEvents)
+
+	listener := newPipeListener()
+	server := &http.Server{Handler: r}
+	go server.Serve(listener)
+
+	tb.Cleanup(func() {
+		hub.melody.Close()
+		server.Close()
+	})
+
+	return &testServer{
+		hub:      hub,
+		listener: listener,
+		dialer:   &websocket.Dialer{NetDialContext: listener.dial, HandshakeTimeout: 5 * time.Second},
+	}
+}
+
+// signToken signs a token for the user
+func signToken(tb testing.TB, userID string) string {
+	tb.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userId": userID,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(os.Getenv("JWT_SECRET")))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return token
+}
+
+// connect opens a session authenticated as the user
+func (s *testServer) connect(tb testing.TB, userID string, query string) *websocket.Conn {
+	tb.Helper()
+
+	url := "ws://chat.test/ws?token=" + signToken(tb, userID)
+	if query != "" {
+		url += "&" + query
+	}
+	conn, _, err := s.dialer.Dial(url, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// waitSessions waits until the index holds the sessions of a user
+func (s *testServer) waitSessions(tb testing.TB, userID string, count int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.hub.index.Count(userID) < count {
+		if time.Now().After(deadline) {
+			tb.Fatalf("user %s has %d sessions, want %d", userID, s.hub.index.Count(userID), count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkDeliver delivers an event to one user among 10k sessions, through the index and by scanning every session
+func BenchmarkDeliver(b *testing.B) {
+	const sessions = 10000
+
+	server := newTestServer(b, Config{})
+	conns := make([]*websocket.Conn, 0, sessions)
+	for i := 0; i < sessions-1; i++ {
+		conns = append(conns, server.connect(b, fmt.Sprintf("user-%d", i), ""))
+	}
+	target := server.connect(b, "target", "")
+	conns = append(conns, target)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < sessions-1; i++ {
+		server.waitSessions(b, fmt.Sprintf("user-%d", i), 1)
+	}
+	server.waitSessions(b, "target", 1)
+
+	received := make(chan struct{}, 1)
+	go func() {
+		for {
+			if _, _, err := target.ReadMessage(); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	delivery := Delivery{UserIDs: []string{"target"}, Event: "getMessage", Message: []byte(`{"text":"hello"}`)}
+	frame, err := newEncodedFrame(Frame{Event: delivery.Event, Message: delivery.Message}).bytes(JSONCodec{}, ProtocolV1)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	wait := func(b *testing.B) {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			b.Fatal("the target received nothing")
+		}
+	}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			server.hub.deliver(delivery)
+			wait(b)
+		}
+	})
+
+	b.Run("BroadcastFilter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := server.hub.melody.BroadcastFilter(frame, func(s *melody.Session) bool {
+				return userIDOf(s) == "target"
+			})
+			if err != nil && !errors.Is(err, melody.ErrClosed) {
+				b.Fatal(err)
+			}
+			wait(b)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package socket
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// AnyEvent is the rate key that applies to every event
+const AnyEvent = "*"
+
+// metrics of the socket layer, served by expvar on /debug/vars
+var metrics = expvar.NewMap("socket")
+
+// Rate is a token bucket, Burst events at once refilled at PerSecond
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Limits protects the hub from flooding clients
+type Limits struct {
+	// Rates per session by event type, AnyEvent applies to every event and events without a rate are not limited
+	Session map[string]Rate
+
+	// Rates per user across the sessions of the user on this node
+	User map[string]Rate
+
+	// Concurrent sessions of a user on this node, zero means no cap.
+	// Sessions are counted under the user of their token.
+	MaxConnections int
+
+	// Limited events a session may send before it is closed, zero means never close
+	MaxViolations int
+}
+
+type bucket struct {
+	mu     sync.Mutex
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate Rate) *bucket {
+	return &bucket{rate: rate, tokens: float64(rate.Burst), last: time.Now()}
+}
+
+// take a token from the bucket
+func (b *bucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond
+	if b.tokens > float64(b.rate.Burst) {
+		b.tokens = float64(b.rate.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// buckets holds the token buckets of one session or user by event type
+type buckets struct {
+	mu         sync.Mutex
+	rates      map[string]Rate
+	buckets    map[string]*bucket
+	violations int
+}
+
+func newBuckets(rates map[string]Rate) *buckets {
+	return &buckets{rates: rates, buckets: map[string]*bucket{}}
+}
+
+// allow an event if both its own bucket and the bucket of every event have a token
+func (b *buckets) allow(event string) bool {
+	for _, key := range []string{AnyEvent, event} {
+		bucket := b.get(key)
+		if bucket != nil && !bucket.take() {
+			return false
+		}
+	}
+	return true
+}
+
+// refilledAt returns the time all the buckets are full again, buckets that never refill are left out
+func (b *buckets) refilledAt(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	refilled := now
+	for _, bucket := range b.buckets {
+		bucket.mu.Lock()
+		if bucket.rate.PerSecond > 0 {
+			missing := float64(bucket.rate.Burst) - bucket.tokens
+			at := bucket.last.Add(time.Duration(missing / bucket.rate.PerSecond * float64(time.Second)))
+			if at.After(refilled) {
+				refilled = at
+			}
+		}
+		bucket.mu.Unlock()
+	}
+	return refilled
+}
+
+// violate records a limited event and returns the number of limited events so far
+func (b *buckets) violate() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.violations++
+	return b.violations
+}
+
+func (b *buckets) get(key string) *bucket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if existing, ok := b.buckets[key]; ok {
+		return existing
+	}
+
+	rate, ok := b.rates[key]
+	if !ok {
+		return nil
+	}
+
+	created := newBucket(rate)
+	b.buckets[key] = created
+	return created
+}
+
+// limiter keeps the buckets and counts the sessions of the users of this node.
+// The buckets of a user outlive the sessions until they refill, so reconnecting does not reset them.
+type limiter struct {
+	mu          sync.Mutex
+	limits      Limits
+	users       map[string]*buckets
+	connections map[string]int
+	idle        map[string]time.Time
+	lastSweep   time.Time
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits:      limits,
+		users:       map[string]*buckets{},
+		connections: map[string]int{},
+		idle:        map[string]time.Time{},
+	}
+}
+
+// user returns the buckets of a user
+func (l *limiter) user(userID string) *buckets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.users[userID]
+	if !ok {
+		b = newBuckets(l.limits.User)
+		l.users[userID] = b
+	}
+	return b
+}
+
+// reserve a session of a user, it fails when the user is at the connection cap
+func (l *limiter) reserve(userID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(time.Now())
+	if max := l.limits.MaxConnections; max > 0 && l.connections[userID] >= max {
+		return false
+	}
+	l.connections[userID]++
+	delete(l.idle, userID)
+	return true
+}
+
+// release a session reserved for a user, the buckets of a user without sessions are dropped once they refill
+func (l *limiter) release(userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.connections[userID]--
+	if l.connections[userID] <= 0 {
+		delete(l.connections, userID)
+		if b, ok := l.users[userID]; ok {
+			l.idle[userID] = b.refilledAt(now)
+		}
+	}
+	l.sweep(now)
+}
+
+// sweep drops the refilled buckets of the users without sessions, at most once a second
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Second {
+		return
+	}
+	l.lastSweep = now
+
+	for userID, refilled := range l.idle {
+		if !now.Before(refilled) {
+			delete(l.idle, userID)
+			delete(l.users, userID)
+		}
+	}
+}
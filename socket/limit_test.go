@@ -0,0 +1,67 @@
+package socket
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserveConcurrent(t *testing.T) {
+	l := newLimiter(Limits{MaxConnections: 3})
+
+	var reserved int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.reserve("alice") {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 3 {
+		t.Fatalf("reserved %d sessions, want 3", reserved)
+	}
+
+	l.release("alice")
+	if !l.reserve("alice") {
+		t.Fatal("a released slot was not given back")
+	}
+	if l.reserve("alice") {
+		t.Fatal("reserved a session over the cap")
+	}
+}
+
+func TestLimiterKeepsBucketsUntilRefilled(t *testing.T) {
+	l := newLimiter(Limits{User: map[string]Rate{AnyEvent: {PerSecond: 1, Burst: 2}}})
+
+	if !l.reserve("alice") {
+		t.Fatal("reserve failed without a cap")
+	}
+	for i := 0; i < 2; i++ {
+		if !l.user("alice").allow("sendMessage") {
+			t.Fatalf("event %d was limited within the burst", i)
+		}
+	}
+	l.release("alice")
+
+	// Reconnecting right away does not refill the buckets
+	if !l.reserve("alice") {
+		t.Fatal("reserve failed without a cap")
+	}
+	if l.user("alice").allow("sendMessage") {
+		t.Fatal("the buckets were reset by reconnecting")
+	}
+	l.release("alice")
+
+	// Once refilled the buckets of a user without sessions are dropped
+	l.lastSweep = time.Time{}
+	l.sweep(time.Now().Add(3 * time.Second))
+	if _, ok := l.users["alice"]; ok {
+		t.Fatal("the refilled buckets of alice were kept")
+	}
+}
@@ -0,0 +1,64 @@
+package socket
+
+import "sync"
+
+// IListener tells when a user gets a new event in their log
+type IListener interface {
+	// Listen for the next logged event of a user, stop must be called once the channel is no longer read
+	Listen(userID string) (events <-chan struct{}, stop func())
+}
+
+// listeners keeps the channels waiting for the logged events of users on this node
+type listeners struct {
+	mu    sync.Mutex
+	users map[string]map[chan struct{}]struct{}
+}
+
+func newListeners() *listeners {
+	return &listeners{users: map[string]map[chan struct{}]struct{}{}}
+}
+
+func (l *listeners) add(userID string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	l.mu.Lock()
+	channels, ok := l.users[userID]
+	if !ok {
+		channels = map[chan struct{}]struct{}{}
+		l.users[userID] = channels
+	}
+	channels[ch] = struct{}{}
+	l.mu.Unlock()
+
+	stop := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if channels, ok := l.users[userID]; ok {
+			delete(channels, ch)
+			if len(channels) == 0 {
+				delete(l.users, userID)
+			}
+		}
+	}
+	return ch, stop
+}
+
+func (l *listeners) notify(userIDs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, userID := range userIDs {
+		for ch := range l.users[userID] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Listen for the next logged event of a user, the event itself is read from the log
+func (h *Hub) Listen(userID string) (<-chan struct{}, func()) {
+	return h.listeners.add(userID)
+}
@@ -0,0 +1,73 @@
+package socket
+
+import (
+	"context"
+	"sync"
+)
+
+// Presence tracks the users that have at least one session on any node
+type Presence interface {
+	// Record a new session of a user
+	Connect(ctx context.Context, userID string) error
+
+	// Record a closed session of a user
+	Disconnect(ctx context.Context, userID string) error
+
+	// List the online users
+	Online(ctx context.Context) ([]string, error)
+
+	// Close the presence
+	Close() error
+}
+
+// LocalPresence is an in-process presence for a single node
+type LocalPresence struct {
+	mu       sync.Mutex
+	sessions map[string]int
+}
+
+// NewLocalPresence creates a new in-process presence
+func NewLocalPresence() *LocalPresence {
+	return &LocalPresence{
+		sessions: map[string]int{},
+	}
+}
+
+// Record a new session of a user
+func (p *LocalPresence) Connect(ctx context.Context, userID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sessions[userID]++
+	return nil
+}
+
+// Record a closed session of a user
+func (p *LocalPresence) Disconnect(ctx context.Context, userID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sessions[userID] <= 1 {
+		delete(p.sessions, userID)
+	} else {
+		p.sessions[userID]--
+	}
+	return nil
+}
+
+// List the online users
+func (p *LocalPresence) Online(ctx context.Context) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	users := make([]string, 0, len(p.sessions))
+	for userID := range p.sessions {
+		users = append(users, userID)
+	}
+	return users, nil
+}
+
+// Close the presence
+func (p *LocalPresence) Close() error {
+	return nil
+}
@@ -0,0 +1,630 @@
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Field numbers of the Frame message in protocol.proto
+const (
+	protoFieldID      protowire.Number = 1
+	protoFieldType    protowire.Number = 2
+	protoFieldVersion protowire.Number = 3
+	protoFieldUntyped protowire.Number = 4
+	protoFieldSeq     protowire.Number = 5
+	protoFieldBatch   protowire.Number = 31
+)
+
+// protoKind is how a payload field is written on the wire
+type protoKind int
+
+const (
+	protoString protoKind = iota
+	protoBool
+	protoInt64
+
+	// google.protobuf.Timestamp, an RFC 3339 string in the JSON form
+	protoTime
+
+	// repeated string
+	protoStrings
+
+	// another payload message
+	protoMessage
+)
+
+// protoField maps a field of the JSON form of a payload to a field of its payload message
+type protoField struct {
+	name   string
+	number protowire.Number
+	kind   protoKind
+
+	// Optional fields are sent when they are set, even to the default of their type
+	optional bool
+
+	// Payload message of a protoMessage field
+	message *protoPayload
+}
+
+// protoPayload is a payload message of protocol.proto
+type protoPayload struct {
+	// Field of the message in the payload of the frame
+	number protowire.Number
+	fields []protoField
+
+	// The JSON form of the payload is the value of the only field rather than an object
+	wrapped bool
+}
+
+var protoMessagePayload = &protoPayload{number: 21, fields: []protoField{
+	{name: "id", number: 1, kind: protoString},
+	{name: "conversationId", number: 2, kind: protoString},
+	{name: "sender", number: 3, kind: protoString},
+	{name: "text", number: 4, kind: protoString},
+	{name: "seq", number: 5, kind: protoInt64},
+	{name: "createAt", number: 6, kind: protoTime},
+	{name: "clientMessageId", number: 7, kind: protoString},
+	{name: "mentions", number: 8, kind: protoStrings},
+}}
+
+// protoPayloads are the payload messages by the type of the frames that carry them, types without one are sent untyped
+var protoPayloads = func() map[string]*protoPayload {
+	empty := &protoPayload{number: 10}
+	room := &protoPayload{number: 14, fields: []protoField{
+		{name: "conversationId", number: 1, kind: protoString},
+	}}
+	sequence := &protoPayload{number: 19, fields: []protoField{
+		{name: "seq", number: 1, kind: protoInt64},
+		{name: "more", number: 2, kind: protoBool},
+	}}
+	pin := &protoPayload{number: 26, fields: []protoField{
+		{name: "conversationId", number: 1, kind: protoString},
+		{name: "messageId", number: 2, kind: protoString},
+		{name: "userId", number: 3, kind: protoString},
+	}}
+	membership := &protoPayload{number: 29, fields: []protoField{
+		{name: "conversationId", number: 1, kind: protoString},
+		{name: "userId", number: 2, kind: protoString},
+	}}
+	contactRequest := &protoPayload{number: 32, fields: []protoField{
+		{name: "id", number: 1, kind: protoString},
+		{name: "from", number: 2, kind: protoString},
+		{name: "to", number: 3, kind: protoString},
+		{name: "status", number: 4, kind: protoString},
+		{name: "createAt", number: 5, kind: protoTime},
+		{name: "updateAt", number: 6, kind: protoTime},
+	}}
+
+	return map[string]*protoPayload{
+		"addUser": empty,
+		"ping": {number: 11, fields: []protoField{
+			{name: "nonce", number: 1, kind: protoString},
+		}},
+		"pong": {number: 12, fields: []protoField{
+			{name: "nonce", number: 1, kind: protoString},
+			{name: "time", number: 2, kind: protoTime},
+		}},
+		"sendMessage": {number: 13, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "senderId", number: 2, kind: protoString},
+			{name: "text", number: 3, kind: protoString},
+			{name: "recipientId", number: 4, kind: protoString},
+			{name: "clientMessageId", number: 5, kind: protoString},
+		}},
+		"subscribe":    room,
+		"unsubscribe":  room,
+		"subscribed":   room,
+		"unsubscribed": room,
+		"typing": {number: 15, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "userId", number: 2, kind: protoString},
+			{name: "typing", number: 3, kind: protoBool},
+		}},
+		"resume": {number: 16, fields: []protoField{
+			{name: "lastSeq", number: 1, kind: protoInt64, optional: true},
+		}},
+		"ack": {number: 17, fields: []protoField{
+			{name: "seq", number: 1, kind: protoInt64},
+		}},
+		"read": {number: 18, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "seq", number: 2, kind: protoInt64},
+		}},
+		"resumed": sequence,
+		"resync":  sequence,
+		"error": {number: 20, fields: []protoField{
+			{name: "event", number: 1, kind: protoString},
+			{name: "code", number: 2, kind: protoString},
+			{name: "error", number: 3, kind: protoString},
+		}},
+		"getMessage": protoMessagePayload,
+		"messageAck": {number: 22, fields: []protoField{
+			{name: "clientMessageId", number: 1, kind: protoString},
+			{name: "message", number: 2, kind: protoMessage, message: protoMessagePayload},
+		}},
+		"notification": {number: 23, fields: []protoField{
+			{name: "type", number: 1, kind: protoString},
+			{name: "conversationId", number: 2, kind: protoString},
+			{name: "senderId", number: 3, kind: protoString},
+			{name: "text", number: 4, kind: protoString},
+		}},
+		"messageStatus": {number: 24, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "messageIds", number: 2, kind: protoStrings},
+			{name: "userId", number: 3, kind: protoString},
+			{name: "status", number: 4, kind: protoString},
+			{name: "at", number: 5, kind: protoTime},
+		}},
+		"readPointer": {number: 25, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "userId", number: 2, kind: protoString},
+			{name: "seq", number: 3, kind: protoInt64},
+			{name: "at", number: 4, kind: protoTime},
+		}},
+		"messagePinned":   pin,
+		"messageUnpinned": pin,
+		"conversationState": {number: 27, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "pinned", number: 2, kind: protoBool},
+			{name: "archived", number: 3, kind: protoBool},
+		}},
+		"conversationSettings": {number: 28, fields: []protoField{
+			{name: "conversationId", number: 1, kind: protoString},
+			{name: "muted", number: 2, kind: protoBool},
+			{name: "mutedUntil", number: 3, kind: protoTime},
+			{name: "notifyLevel", number: 4, kind: protoString},
+			{name: "nickname", number: 5, kind: protoString},
+			{name: "updateAt", number: 6, kind: protoTime},
+		}},
+		"conversationCreated": membership,
+		"memberJoined":        membership,
+		"getUsers": {number: 30, wrapped: true, fields: []protoField{
+			{name: "userIds", number: 1, kind: protoStrings},
+		}},
+		"contactRequest":   contactRequest,
+		"contactAccepted":  contactRequest,
+		"contactDeclined":  contactRequest,
+		"contactCancelled": contactRequest,
+	}
+}()
+
+// protoPayloadsByNumber are the payload messages by their field in the payload of the frame
+var protoPayloadsByNumber = func() map[protowire.Number]*protoPayload {
+	payloads := map[protowire.Number]*protoPayload{}
+	for _, payload := range protoPayloads {
+		payloads[payload.number] = payload
+	}
+	return payloads
+}()
+
+// ProtobufCodec encodes frames as the Frame message of protocol.proto.
+// The payload of every type of the protocol is its own message, payloads of other types are sent as a google.protobuf.Value.
+type ProtobufCodec struct{}
+
+// Subprotocol names the codec during the websocket handshake
+func (ProtobufCodec) Subprotocol() string { return SubprotocolProtobuf }
+
+// Binary tells whether frames are written as binary messages
+func (ProtobufCodec) Binary() bool { return true }
+
+// EncodeFrame encodes a frame, binary codecs only speak protocol version 2
+func (ProtobufCodec) EncodeFrame(frame Frame, version int) ([]byte, error) {
+	return appendProtoFrame(nil, frame)
+}
+
+// DecodeRequest decodes a client frame, unknown fields are skipped as protobuf does
+func (ProtobufCodec) DecodeRequest(msg []byte, version int) (*Request, *ProtocolError) {
+	frame, err := decodeProtoFrame(msg)
+	if err != nil {
+		return nil, protocolError(CodeInvalidFrame, "Frame is not a protobuf Frame message: "+err.Error())
+	}
+
+	request := &Request{ID: frame.ID, Type: frame.Type, Version: frame.Version}
+	if frame.Payload != nil {
+		raw, err := json.Marshal(frame.Payload)
+		if err != nil {
+			return nil, protocolError(CodeInvalidFrame, "Payload cannot be converted to JSON")
+		}
+		request.Payload = raw
+	}
+	return checkRequestV2(request)
+}
+
+// appendProtoFrame writes a frame as a Frame message
+func appendProtoFrame(b []byte, frame Frame) ([]byte, error) {
+	number, payload, err := encodeProtoPayload(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	if frame.ID != "" {
+		b = protowire.AppendTag(b, protoFieldID, protowire.BytesType)
+		b = protowire.AppendString(b, frame.ID)
+	}
+	b = protowire.AppendTag(b, protoFieldType, protowire.BytesType)
+	b = protowire.AppendString(b, frame.Event)
+	b = protowire.AppendTag(b, protoFieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, ProtocolV2)
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	if frame.Seq > 0 {
+		b = protowire.AppendTag(b, protoFieldSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(frame.Seq))
+	}
+	return b, nil
+}
+
+// encodeProtoPayload writes the payload of a frame as the message of its type, it returns the field of the message in the frame
+func encodeProtoPayload(frame Frame) (protowire.Number, []byte, error) {
+	// A batch holds the envelopes of its frames
+	if envelopes, ok := frame.Message.([]interface{}); ok && frame.Event == "batch" {
+		var b []byte
+		for _, envelope := range envelopes {
+			f, ok := envelope.(frameV2)
+			if !ok {
+				return 0, nil, fmt.Errorf("batch holds a %T", envelope)
+			}
+
+			inner, err := appendProtoFrame(nil, Frame{ID: f.ID, Event: f.Type, Message: f.Payload, Seq: f.Seq})
+			if err != nil {
+				return 0, nil, err
+			}
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, inner)
+		}
+		return protoFieldBatch, b, nil
+	}
+
+	generic, err := genericValue(frame.Message)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if payload, ok := protoPayloads[frame.Event]; ok {
+		b, ok, err := payload.append(nil, generic)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", frame.Event, err)
+		}
+		if ok {
+			return payload.number, b, nil
+		}
+	}
+
+	// Numbers in a google.protobuf.Value are doubles, integers above 2^53 are rounded
+	value, err := structpb.NewValue(generic)
+	if err != nil {
+		return 0, nil, err
+	}
+	b, err := proto.Marshal(value)
+	return protoFieldUntyped, b, err
+}
+
+// decodeProtoFrame reads a Frame message into a version 2 envelope holding the JSON form of the payload
+func decodeProtoFrame(b []byte) (*frameV2, error) {
+	frame := &frameV2{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var err error
+		switch {
+		case num == protoFieldID && typ == protowire.BytesType:
+			frame.ID, n = protowire.ConsumeString(b)
+		case num == protoFieldType && typ == protowire.BytesType:
+			frame.Type, n = protowire.ConsumeString(b)
+		case num == protoFieldVersion && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			frame.Version = int(int32(v))
+		case num == protoFieldSeq && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			frame.Seq = int64(v)
+		case num == protoFieldUntyped && typ == protowire.BytesType:
+			var payload []byte
+			payload, n = protowire.ConsumeBytes(b)
+			value := &structpb.Value{}
+			if err = proto.Unmarshal(payload, value); err == nil {
+				frame.Payload = value.AsInterface()
+			}
+		case num == protoFieldBatch && typ == protowire.BytesType:
+			var payload []byte
+			payload, n = protowire.ConsumeBytes(b)
+			frame.Payload, err = decodeProtoBatch(payload)
+		case protoPayloadsByNumber[num] != nil && typ == protowire.BytesType:
+			var payload []byte
+			payload, n = protowire.ConsumeBytes(b)
+			frame.Payload, err = protoPayloadsByNumber[num].decode(payload)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+	}
+	return frame, nil
+}
+
+// decodeProtoBatch reads a Batch message into the envelopes of its frames
+func decodeProtoBatch(b []byte) ([]interface{}, error) {
+	frames := []interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		} else {
+			var inner []byte
+			inner, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				frame, err := decodeProtoFrame(inner)
+				if err != nil {
+					return nil, err
+				}
+				frames = append(frames, *frame)
+			}
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return frames, nil
+}
+
+// append writes the JSON form of a payload as the message, it returns false when the payload does not have the shape of the message
+func (p *protoPayload) append(b []byte, value interface{}) ([]byte, bool, error) {
+	var object map[string]interface{}
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		if p.wrapped {
+			return nil, false, nil
+		}
+		object = v
+	case []interface{}:
+		if !p.wrapped {
+			return nil, false, nil
+		}
+		object = map[string]interface{}{p.fields[0].name: v}
+	default:
+		return nil, false, nil
+	}
+
+	for _, field := range p.fields {
+		value, ok := object[field.name]
+		if !ok || value == nil {
+			continue
+		}
+
+		var err error
+		if b, err = field.append(b, value); err != nil {
+			return nil, false, err
+		}
+	}
+	return b, true, nil
+}
+
+// decode reads the message into the JSON form of the payload
+func (p *protoPayload) decode(b []byte) (interface{}, error) {
+	object := map[string]interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := p.field(num)
+		if field == nil {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		} else {
+			var value interface{}
+			var err error
+			if value, n, err = field.consume(typ, b); err != nil {
+				return nil, err
+			}
+			if field.kind == protoStrings {
+				items, _ := object[field.name].([]interface{})
+				value = append(items, value)
+			}
+			object[field.name] = value
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	if p.wrapped {
+		if items, ok := object[p.fields[0].name]; ok {
+			return items, nil
+		}
+		return []interface{}{}, nil
+	}
+	return object, nil
+}
+
+func (p *protoPayload) field(number protowire.Number) *protoField {
+	for i := range p.fields {
+		if p.fields[i].number == number {
+			return &p.fields[i]
+		}
+	}
+	return nil
+}
+
+// append writes a value of the JSON form of a payload, fields holding the default of their type are left out unless they are optional
+func (f *protoField) append(b []byte, value interface{}) ([]byte, error) {
+	switch f.kind {
+	case protoString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		if s != "" || f.optional {
+			b = protowire.AppendTag(b, f.number, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	case protoBool:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		if v || f.optional {
+			b = protowire.AppendTag(b, f.number, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+		}
+	case protoInt64:
+		v, ok := value.(int64)
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		if v != 0 || f.optional {
+			b = protowire.AppendTag(b, f.number, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	case protoTime:
+		s, ok := value.(string)
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+
+		var timestamp []byte
+		if seconds := t.Unix(); seconds != 0 {
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(seconds))
+		}
+		if nanos := t.Nanosecond(); nanos != 0 {
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(nanos))
+		}
+		b = protowire.AppendTag(b, f.number, protowire.BytesType)
+		b = protowire.AppendBytes(b, timestamp)
+	case protoStrings:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return nil, f.mismatch(item)
+			}
+			b = protowire.AppendTag(b, f.number, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	case protoMessage:
+		inner, ok, err := f.message.append(nil, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		if !ok {
+			return nil, f.mismatch(value)
+		}
+		b = protowire.AppendTag(b, f.number, protowire.BytesType)
+		b = protowire.AppendBytes(b, inner)
+	}
+	return b, nil
+}
+
+// consume reads a value of the field into its JSON form, it returns the length it read
+func (f *protoField) consume(typ protowire.Type, b []byte) (interface{}, int, error) {
+	switch f.kind {
+	case protoBool, protoInt64:
+		if typ != protowire.VarintType {
+			return nil, 0, f.wireMismatch(typ)
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if f.kind == protoBool {
+			return protowire.DecodeBool(v), n, nil
+		}
+		return int64(v), n, nil
+	}
+
+	if typ != protowire.BytesType {
+		return nil, 0, f.wireMismatch(typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, n, nil
+	}
+
+	switch f.kind {
+	case protoTime:
+		t, err := decodeTimestamp(v)
+		if err != nil {
+			return nil, n, fmt.Errorf("%s: %w", f.name, err)
+		}
+		return t.Format(time.RFC3339Nano), n, nil
+	case protoMessage:
+		message, err := f.message.decode(v)
+		if err != nil {
+			return nil, n, fmt.Errorf("%s: %w", f.name, err)
+		}
+		return message, n, nil
+	}
+	return string(v), n, nil
+}
+
+func (f *protoField) mismatch(value interface{}) error {
+	return fmt.Errorf("%s cannot hold a %T", f.name, value)
+}
+
+func (f *protoField) wireMismatch(typ protowire.Type) error {
+	return fmt.Errorf("%s has wire type %d", f.name, typ)
+}
+
+// decodeTimestamp reads a google.protobuf.Timestamp, the time is in UTC
+func decodeTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if (num == 1 || num == 2) && typ == protowire.VarintType {
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			if num == 1 {
+				seconds = int64(v)
+			} else {
+				nanos = int64(int32(v))
+			}
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	if nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, errors.New("nanos out of range")
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
@@ -0,0 +1,354 @@
+package socket
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Versions of the socket protocol, a session picks one with the version query parameter when it connects
+const (
+	// ProtocolV1 frames are {event, message}, kept for older clients
+	ProtocolV1 = 1
+
+	// ProtocolV2 frames are {id, type, version, payload}, payloads are decoded strictly
+	ProtocolV2 = 2
+)
+
+// Codes of the error frames
+const (
+	CodeInvalidFrame       = "invalid_frame"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownType        = "unknown_type"
+	CodeInvalidPayload     = "invalid_payload"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
+)
+
+// Schema is the JSON Schema of the socket protocol
+//
+//go:embed protocol.schema.json
+var Schema []byte
+
+// Frame is an event sent to clients, it is encoded for the protocol version of each session
+type Frame struct {
+	// Id of the request the frame answers
+	ID string
+
+	Event   string
+	Message interface{}
+
+	// Sequence number of the event for the user, set on events that can be replayed
+	Seq int64
+}
+
+type frameV1 struct {
+	ID      string      `json:"id,omitempty"`
+	Event   string      `json:"event"`
+	Message interface{} `json:"message"`
+	Seq     int64       `json:"seq,omitempty"`
+}
+
+type frameV2 struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Version int         `json:"version"`
+	Payload interface{} `json:"payload"`
+	Seq     int64       `json:"seq,omitempty"`
+}
+
+// Encode a frame for a protocol version
+func (f Frame) Encode(version int) ([]byte, error) {
+	return json.Marshal(f.envelope(version))
+}
+
+// envelope returns the frame shaped for a protocol version
+func (f Frame) envelope(version int) interface{} {
+	if version == ProtocolV2 {
+		return frameV2{ID: f.ID, Type: f.Event, Version: ProtocolV2, Payload: f.Message, Seq: f.Seq}
+	}
+	return frameV1{ID: f.ID, Event: f.Event, Message: f.Message, Seq: f.Seq}
+}
+
+// encodedFrame encodes a frame once per codec and protocol version
+type encodedFrame struct {
+	frame   Frame
+	formats map[frameFormat][]byte
+}
+
+type frameFormat struct {
+	subprotocol string
+	version     int
+}
+
+func newEncodedFrame(frame Frame) *encodedFrame {
+	return &encodedFrame{frame: frame, formats: map[frameFormat][]byte{}}
+}
+
+func (e *encodedFrame) bytes(codec Codec, version int) ([]byte, error) {
+	format := frameFormat{subprotocol: codec.Subprotocol(), version: version}
+	if b, ok := e.formats[format]; ok {
+		return b, nil
+	}
+
+	b, err := codec.EncodeFrame(e.frame, version)
+	if err != nil {
+		return nil, err
+	}
+	e.formats[format] = b
+	return b, nil
+}
+
+// Request is a frame sent by a client
+type Request struct {
+	ID      string
+	Type    string
+	Version int
+	Payload json.RawMessage
+}
+
+type requestFrame struct {
+	// Protocol version 2
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+
+	// Protocol version 1
+	Event   string          `json:"event"`
+	Message json.RawMessage `json:"message"`
+}
+
+// ProtocolError is sent back to the client in an error frame
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func protocolError(code string, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// ParseRequest decodes a client frame of a session using the given protocol version
+func ParseRequest(msg []byte, version int) (*Request, *ProtocolError) {
+	var frame requestFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		return nil, protocolError(CodeInvalidFrame, "Frame is not a JSON object")
+	}
+
+	if version == ProtocolV2 {
+		return checkRequestV2(&Request{ID: frame.ID, Type: frame.Type, Version: frame.Version, Payload: frame.Payload})
+	}
+
+	request := &Request{ID: frame.ID, Type: frame.Event, Version: ProtocolV1, Payload: frame.Message}
+	if frame.Event == "" {
+		return request, protocolError(CodeInvalidFrame, "Missing event")
+	}
+	return request, nil
+}
+
+// checkRequestV2 checks the envelope of a version 2 request
+func checkRequestV2(request *Request) (*Request, *ProtocolError) {
+	if request.Version != ProtocolV2 {
+		return request, protocolError(CodeUnsupportedVersion, "Expected protocol version "+strconv.Itoa(ProtocolV2))
+	}
+	if request.Type == "" {
+		return request, protocolError(CodeInvalidFrame, "Missing type")
+	}
+	return request, nil
+}
+
+// Payload is the typed payload of a client event
+type Payload interface {
+	// Validate the payload after decoding
+	Validate() error
+}
+
+// DecodePayload decodes the payload of a request, version 2 payloads must not carry unknown fields
+func DecodePayload(request *Request, payload Payload) *ProtocolError {
+	raw := request.Payload
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		raw = []byte("{}")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if request.Version == ProtocolV2 {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(payload); err != nil {
+		return protocolError(CodeInvalidPayload, err.Error())
+	}
+
+	if err := payload.Validate(); err != nil {
+		return protocolError(CodeInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+func validateObjectID(field string, value string) error {
+	if !primitive.IsValidObjectID(value) {
+		return fmt.Errorf("%s must be an object id", field)
+	}
+	return nil
+}
+
+// EmptyData is the payload of events that carry nothing
+type EmptyData struct{}
+
+// Validate the payload
+func (d *EmptyData) Validate() error {
+	return nil
+}
+
+// PingData is the payload of a ping event, browsers cannot see ping control frames so they ping with an event instead
+type PingData struct {
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// Validate the payload
+func (d *PingData) Validate() error {
+	if len(d.Nonce) > 64 {
+		return errors.New("nonce must be at most 64 characters")
+	}
+	return nil
+}
+
+// PongData is the payload of a pong event
+type PongData struct {
+	Nonce string    `json:"nonce,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// SendMessageData is the payload of a sendMessage event
+type SendMessageData struct {
+	ConversationID string `json:"conversationId"`
+	SenderID       string `json:"senderId,omitempty"`
+	Text           string `json:"text"`
+
+	// Deprecated, the message goes to every other member of the conversation, it must be one of them
+	RecipientID string `json:"recipientId,omitempty"`
+
+	// Id chosen by the client to make retries safe, a retry with the same id is acknowledged again but not stored twice
+	ClientMessageID string `json:"clientMessageId,omitempty"`
+}
+
+// Validate the payload
+func (d *SendMessageData) Validate() error {
+	if d.Text == "" {
+		return errors.New("text is required")
+	}
+	if len(d.ClientMessageID) > 64 {
+		return errors.New("clientMessageId must be at most 64 characters")
+	}
+	if d.RecipientID != "" {
+		if err := validateObjectID("recipientId", d.RecipientID); err != nil {
+			return err
+		}
+	}
+	return validateObjectID("conversationId", d.ConversationID)
+}
+
+// MessageAckData is the payload of a messageAck event, it tells the sender that a message was stored
+type MessageAckData struct {
+	ClientMessageID string         `json:"clientMessageId"`
+	Message         *model.Message `json:"message"`
+}
+
+// RoomData is the payload of subscribe and unsubscribe events
+type RoomData struct {
+	ConversationID string `json:"conversationId"`
+}
+
+// Validate the payload
+func (d *RoomData) Validate() error {
+	return validateObjectID("conversationId", d.ConversationID)
+}
+
+// TypingData is the payload of a typing event, the server sets the user
+type TypingData struct {
+	ConversationID string `json:"conversationId"`
+	UserID         string `json:"userId,omitempty"`
+	Typing         bool   `json:"typing"`
+}
+
+// Validate the payload
+func (d *TypingData) Validate() error {
+	return validateObjectID("conversationId", d.ConversationID)
+}
+
+// ResumeData is the payload of a resume event, without a last seen sequence number the last acknowledged one is used
+type ResumeData struct {
+	LastSeq *int64 `json:"lastSeq,omitempty"`
+}
+
+// Validate the payload
+func (d *ResumeData) Validate() error {
+	if d.LastSeq != nil && *d.LastSeq < 0 {
+		return errors.New("lastSeq must not be negative")
+	}
+	return nil
+}
+
+// AckData is the payload of an ack event
+type AckData struct {
+	Seq int64 `json:"seq"`
+}
+
+// Validate the payload
+func (d *AckData) Validate() error {
+	if d.Seq < 1 {
+		return errors.New("seq must be positive")
+	}
+	return nil
+}
+
+// ReadData is the payload of a read event, the messages of the conversation up to seq are read
+type ReadData struct {
+	ConversationID string `json:"conversationId"`
+	Seq            int64  `json:"seq"`
+}
+
+// Validate the payload
+func (d *ReadData) Validate() error {
+	if d.Seq < 1 {
+		return errors.New("seq must be positive")
+	}
+	return validateObjectID("conversationId", d.ConversationID)
+}
+
+// SeqData is the payload of resumed and resync events
+type SeqData struct {
+	Seq int64 `json:"seq"`
+
+	// More events follow the replayed page, the client resumes again after seq
+	More bool `json:"more,omitempty"`
+}
+
+// ErrorData is the payload of an error event, the frame carries the id of the request that failed
+type ErrorData struct {
+	Event string `json:"event"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// Notification asks a client to alert its user, a getMessage alone should not alert
+type Notification struct {
+	Type           string `json:"type"`
+	ConversationID string `json:"conversationId"`
+	SenderID       string `json:"senderId"`
+	Text           string `json:"text"`
+}
@@ -0,0 +1,217 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBroker is a broker on Redis pub/sub, it lets several nodes share the socket events
+type RedisBroker struct {
+	client  redis.UniversalClient
+	channel string
+
+	mu     sync.Mutex
+	pubsub []*redis.PubSub
+}
+
+// NewRedisBroker creates a new Redis broker publishing on the channel
+func NewRedisBroker(client redis.UniversalClient, channel string) *RedisBroker {
+	return &RedisBroker{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// Publish a delivery to every node, including this one
+func (b *RedisBroker) Publish(ctx context.Context, delivery Delivery) error {
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe to the deliveries published by every node
+func (b *RedisBroker) Subscribe(handler func(Delivery)) error {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.channel)
+
+	// Wait for the subscription so nothing published after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.pubsub = append(b.pubsub, pubsub)
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var delivery Delivery
+			if err := json.Unmarshal([]byte(msg.Payload), &delivery); err != nil {
+				log.Println("broker:", err)
+				continue
+			}
+			handler(delivery)
+		}
+	}()
+	return nil
+}
+
+// Close the broker
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, pubsub := range b.pubsub {
+		pubsub.Close()
+	}
+	b.pubsub = nil
+	return nil
+}
+
+// RedisPresence is a presence on Redis shared by every node.
+// The users hash counts the sessions of every online user across the nodes, so listing them is a single read.
+// Each node also counts its own sessions in a hash of its own and refreshes its heartbeat in the nodes sorted set.
+// A node that stops refreshing its heartbeat is reaped by the others, which take its sessions out of the users hash,
+// so the users of a crashed node go offline on their own. A node stalled for longer than the ttl is reaped as well,
+// its sessions open at that time no longer count.
+// The scripts build the keys of the node hashes themselves, the keys must live on a single Redis node.
+type RedisPresence struct {
+	client   redis.UniversalClient
+	prefix   string
+	nodeID   string
+	nodeKey  string
+	nodesKey string
+	usersKey string
+	ttl      time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// disconnectScript records a closed session in the node and users hashes.
+// A session of a node that was already reaped is no longer counted and is ignored.
+var disconnectScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if redis.call('HINCRBY', KEYS[1], ARGV[1], -1) <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+if redis.call('HINCRBY', KEYS[2], ARGV[1], -1) <= 0 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+// reapScript removes the nodes whose heartbeat is older than ARGV[1], and the node ARGV[3] when it is set,
+// and takes their sessions out of the users hash. ARGV[2] is the prefix of the node hashes.
+var reapScript = redis.NewScript(`
+local nodes = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if ARGV[3] ~= '' then
+	table.insert(nodes, ARGV[3])
+end
+for _, node in ipairs(nodes) do
+	local key = ARGV[2] .. node
+	local counts = redis.call('HGETALL', key)
+	for i = 1, #counts, 2 do
+		if redis.call('HINCRBY', KEYS[2], counts[i], -tonumber(counts[i + 1])) <= 0 then
+			redis.call('HDEL', KEYS[2], counts[i])
+		end
+	end
+	redis.call('DEL', key)
+	redis.call('ZREM', KEYS[1], node)
+end
+return #nodes
+`)
+
+// NewRedisPresence creates a new Redis presence for a node.
+// It refreshes the heartbeat of the node and reaps the nodes that stopped until ctx is done or the presence is closed,
+// then it takes the sessions of the node out of the presence.
+func NewRedisPresence(ctx context.Context, client redis.UniversalClient, prefix string, nodeID string, ttl time.Duration) *RedisPresence {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &RedisPresence{
+		client:   client,
+		prefix:   prefix,
+		nodeID:   nodeID,
+		nodeKey:  prefix + "node:" + nodeID,
+		nodesKey: prefix + "nodes",
+		usersKey: prefix + "users",
+		ttl:      ttl,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go p.run(ctx)
+	return p
+}
+
+func (p *RedisPresence) run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := p.reap(context.Background(), p.nodeID); err != nil {
+				log.Println("presence:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := p.heartbeat(ctx); err != nil {
+				log.Println("presence:", err)
+			}
+			if err := p.reap(ctx, ""); err != nil {
+				log.Println("presence:", err)
+			}
+		}
+	}
+}
+
+func (p *RedisPresence) heartbeat(ctx context.Context) error {
+	return p.client.ZAdd(ctx, p.nodesKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: p.nodeID}).Err()
+}
+
+// reap removes the nodes that missed their heartbeat, and the given node when it is not empty
+func (p *RedisPresence) reap(ctx context.Context, nodeID string) error {
+	cutoff := strconv.FormatInt(time.Now().Add(-p.ttl).UnixMilli(), 10)
+	keys := []string{p.nodesKey, p.usersKey}
+	return reapScript.Run(ctx, p.client, keys, cutoff, p.prefix+"node:", nodeID).Err()
+}
+
+// Record a new session of a user
+func (p *RedisPresence) Connect(ctx context.Context, userID string) error {
+	pipe := p.client.TxPipeline()
+	pipe.HIncrBy(ctx, p.nodeKey, userID, 1)
+	pipe.HIncrBy(ctx, p.usersKey, userID, 1)
+	pipe.ZAdd(ctx, p.nodesKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: p.nodeID})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Record a closed session of a user
+func (p *RedisPresence) Disconnect(ctx context.Context, userID string) error {
+	return disconnectScript.Run(ctx, p.client, []string{p.nodeKey, p.usersKey}, userID).Err()
+}
+
+// List the online users
+func (p *RedisPresence) Online(ctx context.Context) ([]string, error) {
+	return p.client.HKeys(ctx, p.usersKey).Result()
+}
+
+// Close the presence, the sessions of the node are taken out of it
+func (p *RedisPresence) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
@@ -0,0 +1,229 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	// Two brokers on one channel stand for two nodes
+	first := NewRedisBroker(client, "chat:socket")
+	second := NewRedisBroker(client, "chat:socket")
+	defer first.Close()
+	defer second.Close()
+
+	firstReceived := make(chan Delivery, 1)
+	secondReceived := make(chan Delivery, 1)
+	if err := first.Subscribe(func(d Delivery) { firstReceived <- d }); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Subscribe(func(d Delivery) { secondReceived <- d }); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := Delivery{
+		UserIDs:        []string{"user-1", "user-2"},
+		ExcludeSession: "session-1",
+		Seq:            42,
+		Event:          "getMessage",
+		Message:        json.RawMessage(`{"text":"hello"}`),
+	}
+	if err := first.Publish(context.Background(), sent); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, received := range map[string]chan Delivery{"publishing node": firstReceived, "other node": secondReceived} {
+		select {
+		case got := <-received:
+			if got.Event != sent.Event || got.Seq != sent.Seq || got.ExcludeSession != sent.ExcludeSession ||
+				len(got.UserIDs) != 2 || string(got.Message) != string(sent.Message) {
+				t.Errorf("%s received %+v, want %+v", name, got, sent)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s received nothing", name)
+		}
+	}
+}
+
+func TestRedisBrokerClose(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	broker := NewRedisBroker(client, "chat:socket")
+	received := make(chan Delivery, 1)
+	if err := broker.Subscribe(func(d Delivery) { received <- d }); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.Publish(context.Background(), Delivery{Event: "getUsers"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-received:
+		t.Fatalf("closed broker received %+v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func online(t *testing.T, p Presence) []string {
+	t.Helper()
+
+	users, err := p.Online(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func assertOnline(t *testing.T, p Presence, want ...string) {
+	t.Helper()
+
+	got := online(t, p)
+	if len(got) != len(want) {
+		t.Fatalf("online users = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("online users = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRedisPresenceConnectDisconnect(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	first := NewRedisPresence(ctx, client, "chat:presence:", "node-1", time.Minute)
+	second := NewRedisPresence(ctx, client, "chat:presence:", "node-2", time.Minute)
+	defer first.Close()
+	defer second.Close()
+
+	assertOnline(t, first)
+
+	// alice has a session on each node, bob two sessions on the first one
+	for _, connect := range []struct {
+		presence *RedisPresence
+		userID   string
+	}{{first, "alice"}, {second, "alice"}, {first, "bob"}, {first, "bob"}} {
+		if err := connect.presence.Connect(ctx, connect.userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertOnline(t, second, "alice", "bob")
+
+	if err := first.Disconnect(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, first, "alice", "bob")
+
+	if err := second.Disconnect(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Disconnect(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, first, "bob")
+
+	if err := first.Disconnect(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, first)
+
+	// A disconnect the node never counted leaves the others alone
+	if err := second.Connect(ctx, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Disconnect(ctx, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, first, "carol")
+}
+
+func TestRedisPresenceClose(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	first := NewRedisPresence(ctx, client, "chat:presence:", "node-1", time.Minute)
+	second := NewRedisPresence(ctx, client, "chat:presence:", "node-2", time.Minute)
+	defer second.Close()
+
+	for _, p := range []*RedisPresence{first, second} {
+		if err := p.Connect(ctx, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Connect(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, second, "alice")
+
+	// Sessions of the closed node that disconnect later are not counted twice
+	if err := first.Disconnect(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, second, "alice")
+}
+
+func TestRedisPresenceExpiry(t *testing.T) {
+	server, client := newTestRedis(t)
+	ctx := context.Background()
+	ttl := 300 * time.Millisecond
+
+	// The crashed node has no janitor, it never refreshes its heartbeat
+	crashed := &RedisPresence{
+		client:   client,
+		prefix:   "chat:presence:",
+		nodeID:   "node-crashed",
+		nodeKey:  "chat:presence:node:node-crashed",
+		nodesKey: "chat:presence:nodes",
+		usersKey: "chat:presence:users",
+		ttl:      ttl,
+	}
+
+	alive := NewRedisPresence(ctx, client, "chat:presence:", "node-alive", ttl)
+	defer alive.Close()
+
+	if err := crashed.Connect(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alive.Connect(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	assertOnline(t, alive, "alice", "bob")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if users := online(t, alive); len(users) == 1 && users[0] == "bob" {
+			if server.Exists("chat:presence:node:node-crashed") {
+				t.Fatal("hash of the crashed node was not removed")
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("online users = %v after the crashed node expired, want [bob]", online(t, alive))
+}
@@ -0,0 +1,236 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guutong/chat-backend/service"
+)
+
+// sseBuffer is the number of events an SSE client may fall behind before it is dropped
+const sseBuffer = 256
+
+// sseFrame is an event waiting to be written to an SSE client
+type sseFrame struct {
+	seq   int64
+	event string
+	data  []byte
+}
+
+// sseClient is a Server-Sent Events connection of a user
+type sseClient struct {
+	userID string
+	frames chan sseFrame
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSSEClient(userID string) *sseClient {
+	return &sseClient{
+		userID: userID,
+		frames: make(chan sseFrame, sseBuffer),
+		closed: make(chan struct{}),
+	}
+}
+
+// send queues an event, a client that fell too far behind is closed and has to resume with Last-Event-ID
+func (c *sseClient) send(frame sseFrame) {
+	select {
+	case c.frames <- frame:
+	default:
+		metrics.Add("sseDropped", 1)
+		c.close()
+	}
+}
+
+func (c *sseClient) close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+// sseRegistry keeps the SSE clients of this node by user
+type sseRegistry struct {
+	mu    sync.RWMutex
+	users map[string]map[*sseClient]struct{}
+}
+
+func newSSERegistry() *sseRegistry {
+	return &sseRegistry{users: map[string]map[*sseClient]struct{}{}}
+}
+
+func (r *sseRegistry) add(client *sseClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, ok := r.users[client.userID]
+	if !ok {
+		clients = map[*sseClient]struct{}{}
+		r.users[client.userID] = clients
+	}
+	clients[client] = struct{}{}
+}
+
+func (r *sseRegistry) remove(client *sseClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if clients, ok := r.users[client.userID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(r.users, client.userID)
+		}
+	}
+}
+
+// clients returns the clients of the given users, or of every user when userIDs is empty
+func (r *sseRegistry) clients(userIDs []string) []*sseClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := []*sseClient{}
+	if len(userIDs) == 0 {
+		for _, userClients := range r.users {
+			for client := range userClients {
+				clients = append(clients, client)
+			}
+		}
+		return clients
+	}
+
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		for client := range r.users[userID] {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// deliverSSE queues a delivery for the matching SSE clients of this node.
+// SSE clients cannot subscribe to rooms, so room events such as typing only reach websocket sessions.
+func (h *Hub) deliverSSE(delivery Delivery) {
+	if delivery.Room != "" {
+		return
+	}
+
+	excluded := delivery.excludedUsers()
+	for _, client := range h.sse.clients(delivery.UserIDs) {
+		if excluded[client.userID] {
+			continue
+		}
+		client.send(sseFrame{seq: delivery.Seq, event: delivery.Event, data: delivery.Message})
+	}
+}
+
+// ServeEvents streams the events of the authenticated user with Server-Sent Events, for clients that cannot open a websocket.
+// EventSource cannot set headers, so the token can be sent in the token query parameter as with the websocket.
+// The id of an event is its sequence number, a client reconnecting with Last-Event-ID gets the events it missed first.
+// Room events such as typing are not streamed, they need a websocket subscribed to the conversation.
+func (h *Hub) ServeEvents(c *gin.Context) {
+	userID := c.GetString("userId")
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	var lastSeq int64 = -1
+	if lastEventID != "" {
+		parsed, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		lastSeq = parsed
+	}
+
+	// An event stream counts towards the connection cap like a socket session
+	if !h.limiter.reserve(userID) {
+		metrics.Add("connectionsRejected", 1)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many connections"})
+		return
+	}
+	defer h.limiter.release(userID)
+
+	ctx := c.Request.Context()
+	client := newSSEClient(userID)
+
+	// Live events queue up while the missed ones are replayed
+	h.sse.add(client)
+	defer h.sse.remove(client)
+
+	if err := h.presence.Connect(context.Background(), userID); err != nil {
+		log.Println("presence:", err)
+	}
+	defer func() {
+		if err := h.presence.Disconnect(context.Background(), userID); err != nil {
+			log.Println("presence:", err)
+		}
+	}()
+	metrics.Add("sseConnections", 1)
+	defer metrics.Add("sseConnections", -1)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	replayed := map[int64]bool{}
+	if lastSeq >= 0 {
+		events, latest, err := h.eventService.Replay(ctx, userID, lastSeq)
+		switch {
+		case errors.Is(err, service.ErrEventsExpired):
+			writeSSE(c, sseFrame{event: "resync", data: []byte(fmt.Sprintf(`{"seq":%d}`, latest))})
+		case err != nil:
+			log.Println("socket:", err)
+			return
+		default:
+			for _, event := range events {
+				replayed[event.Seq] = true
+				writeSSE(c, sseFrame{seq: event.Seq, event: event.Event, data: event.Message})
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(h.melody.Config.PingPeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.closed:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		case frame := <-client.frames:
+			if frame.seq > 0 && replayed[frame.seq] {
+				continue
+			}
+			writeSSE(c, frame)
+		}
+	}
+}
+
+// writeSSE writes an event in the text/event-stream format
+func writeSSE(c *gin.Context, frame sseFrame) {
+	if frame.seq > 0 {
+		fmt.Fprintf(c.Writer, "id: %d\n", frame.seq)
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", frame.event, frame.data)
+	c.Writer.Flush()
+}
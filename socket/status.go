@@ -0,0 +1,106 @@
+package socket
+
+import (
+	"time"
+
+	"github.com/guutong/chat-backend/model"
+)
+
+// MessageStatusData is the payload of a messageStatus event, it tells a sender how far their messages got with a recipient
+type MessageStatusData struct {
+	ConversationID string    `json:"conversationId"`
+	MessageIDs     []string  `json:"messageIds"`
+	UserID         string    `json:"userId"`
+	Status         string    `json:"status"`
+	At             time.Time `json:"at"`
+}
+
+// PublishStatus sends a messageStatus event to the senders of changed receipts, one event per sender and conversation
+func PublishStatus(publisher IPublisher, receipts []*model.Receipt) {
+	type key struct{ sender, conversationID, userID, status string }
+
+	statuses := map[key]*MessageStatusData{}
+	order := []key{}
+	for _, receipt := range receipts {
+		k := key{receipt.Sender, receipt.ConversationID, receipt.UserID, receipt.Status()}
+		data, ok := statuses[k]
+		if !ok {
+			data = &MessageStatusData{
+				ConversationID: receipt.ConversationID,
+				UserID:         receipt.UserID,
+				Status:         k.status,
+			}
+			statuses[k] = data
+			order = append(order, k)
+		}
+
+		data.MessageIDs = append(data.MessageIDs, receipt.MessageID.Hex())
+		at := receipt.DeliveredAt
+		if receipt.ReadAt != nil {
+			at = receipt.ReadAt
+		}
+		if at != nil && at.After(data.At) {
+			data.At = *at
+		}
+	}
+
+	for _, k := range order {
+		publisher.SendToUser(k.sender, "messageStatus", statuses[k])
+	}
+}
+
+// ReadPointerData is the payload of a readPointer event, the messages of the conversation up to seq are read by the user
+type ReadPointerData struct {
+	ConversationID string    `json:"conversationId"`
+	UserID         string    `json:"userId"`
+	Seq            int64     `json:"seq"`
+	At             time.Time `json:"at"`
+}
+
+// PublishReadPointer sends a readPointer event to every member of the conversation, the other sessions of the reader included
+func PublishReadPointer(publisher IPublisher, conversation *model.Conversation, userID string, seq int64) {
+	members := []string{}
+	for _, member := range conversation.Members {
+		members = append(members, member.ID.Hex())
+	}
+
+	publisher.SendToUsers(members, "readPointer", ReadPointerData{
+		ConversationID: conversation.ID.Hex(),
+		UserID:         userID,
+		Seq:            seq,
+		At:             time.Now(),
+	})
+}
+
+// MembershipData is the payload of conversationCreated and memberJoined events
+type MembershipData struct {
+	ConversationID string `json:"conversationId"`
+	UserID         string `json:"userId"`
+}
+
+// PublishMembership sends a membership event to every member of the conversation
+func PublishMembership(publisher IPublisher, event string, conversation *model.Conversation, userID string) {
+	members := []string{}
+	for _, member := range conversation.Members {
+		members = append(members, member.ID.Hex())
+	}
+
+	publisher.SendToUsers(members, event, MembershipData{
+		ConversationID: conversation.ID.Hex(),
+		UserID:         userID,
+	})
+}
+
+// PinData is the payload of messagePinned and messageUnpinned events
+type PinData struct {
+	ConversationID string `json:"conversationId"`
+	MessageID      string `json:"messageId"`
+	UserID         string `json:"userId"`
+}
+
+// ConversationStateData is the payload of a conversationState event, it syncs the list of a user between their sessions
+type ConversationStateData struct {
+	ConversationID string `json:"conversationId"`
+	Pinned         bool   `json:"pinned"`
+	Archived       bool   `json:"archived"`
+}
@@ -0,0 +1,84 @@
+package socket
+
+import (
+	"sync"
+
+	"github.com/olahol/melody"
+)
+
+// stream orders the durable events written to a session, live events wait while missed events are replayed.
+// Between the pages of a long replay live durable events are dropped, the next page reads them from the log.
+type stream struct {
+	mu       sync.Mutex
+	resuming bool
+	paging   bool
+	pending  []pendingFrame
+}
+
+type pendingFrame struct {
+	seq  int64
+	data []byte
+}
+
+// streamOf returns the stream of a session
+func streamOf(s *melody.Session) *stream {
+	value, ok := s.Get("stream")
+	if !ok {
+		return nil
+	}
+	st, _ := value.(*stream)
+	return st
+}
+
+// write a frame to the session, durable frames are held back while the session resumes
+func (st *stream) write(s *melody.Session, seq int64, data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch {
+	case st.resuming && seq > 0:
+		st.pending = append(st.pending, pendingFrame{seq: seq, data: data})
+	case st.paging && seq > 0:
+		metrics.Add("framesPaged", 1)
+	default:
+		writeTo(s, data)
+	}
+}
+
+// holding tells whether a frame with the sequence number would be held back
+func (st *stream) holding(seq int64) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return (st.resuming || st.paging) && seq > 0
+}
+
+// begin holding back live durable frames
+func (st *stream) begin() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.resuming {
+		return false
+	}
+	st.resuming = true
+	return true
+}
+
+// finish a resume, the held back frames that were not replayed are written in order of arrival.
+// When more pages follow the held back frames are dropped, they are in the log after the page.
+func (st *stream) finish(s *melody.Session, replayed map[int64]bool, more bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !more {
+		for _, frame := range st.pending {
+			if !replayed[frame.seq] {
+				writeTo(s, frame.data)
+			}
+		}
+	}
+	st.pending = nil
+	st.resuming = false
+	st.paging = more
+}